@@ -3,27 +3,70 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/verath/owbot-bot/owbot"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"github.com/verath/owbot-bot/owbot/playoverwatch"
+	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+// The interval expired entries are removed from the persistent stats cache
+const statsCacheCompactionInterval = 1 * time.Hour
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			logger := logrus.New()
+			if err := run(logger, os.Args[2:]); err != nil {
+				logger.Fatalf("Error running %s: %+v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	var (
-		debug   bool
-		logJSON bool
-		token   string
-		dbFile  string
+		debug     bool
+		logJSON   bool
+		token     string
+		dbFile    string
+		dbCache   bool
+		providers string
+		owAPIURL  string
+		owAPIConc int
+		owAPIRPS  float64
+
+		backupDir      string
+		backupInterval time.Duration
+		backupRetain   int
+
+		verifyIconsFile string
 	)
 	flag.BoolVar(&debug, "debug", false, "Optional. Enables logging of debug messages.")
 	flag.BoolVar(&logJSON, "logjson", false, "Changes the log format to output logs as json")
 	flag.StringVar(&token, "token", "", "The secret discord token for the bot.")
 	flag.StringVar(&dbFile, "dbfile", "", "Optional. Path to a file to be used for bolt database. ")
+	flag.BoolVar(&dbCache, "dbcache", false, "Optional. Persists the owapi stats cache to the -dbfile bolt database, "+
+		"so that cached stats survive restarts.")
+	flag.StringVar(&providers, "providers", "owapi", "Optional. Comma separated list of stats providers to use, "+
+		"in order of preference. Available providers: owapi, playoverwatch")
+	flag.StringVar(&owAPIURL, "owapiurl", "", "Optional. Base url of the owapi to use for the owapi stats provider.")
+	flag.IntVar(&owAPIConc, "owapiconcurrency", 0, "Optional. Max number of concurrent requests to the owapi.")
+	flag.Float64Var(&owAPIRPS, "owapirps", 0, "Optional. Max average number of requests per second to the owapi. "+
+		"A negative value disables the limit.")
+	flag.StringVar(&backupDir, "backupdir", "", "Optional. Directory to periodically write snapshots of the "+
+		"-dbfile bolt database to. Restore a snapshot with the restore command.")
+	flag.DurationVar(&backupInterval, "backupinterval", 1*time.Hour, "Optional. Interval between snapshots.")
+	flag.IntVar(&backupRetain, "backupretain", 24, "Optional. Number of most recent snapshots to keep.")
+	flag.StringVar(&verifyIconsFile, "verifyicons", "", "Optional. Path to a JSON file of the profile icons "+
+		"users are asked to change to when verifying their accounts. Verifying is disabled if not set.")
 	flag.Parse()
 
 	logger := logrus.New()
@@ -36,16 +79,81 @@ func main() {
 	if token == "" {
 		logger.Fatal("The token argument is required.")
 	}
-	userSource, err := createUserSource(logger, dbFile)
+	if dbCache && dbFile == "" {
+		logger.Fatal("The dbcache argument requires the dbfile argument.")
+	}
+	if backupDir != "" && dbFile == "" {
+		logger.Fatal("The backupdir argument requires the dbfile argument.")
+	}
+	if backupInterval <= 0 {
+		logger.Fatal("The backupinterval argument must be positive.")
+	}
+	verifyIcons, err := readVerifyIcons(verifyIconsFile)
+	if err != nil {
+		logger.Fatalf("Could not read verify icons: %+v", err)
+	}
+	db, err := openBoltDB(logger, dbFile)
+	if err != nil {
+		logger.Fatalf("Could not open db: %+v", err)
+	}
+	var backup *owbot.BoltBackup
+	if backupDir != "" {
+		backup, err = owbot.NewBoltBackup(logger, db, backupDir, backupRetain)
+		if err != nil {
+			logger.Fatalf("Could not create backup: %+v", err)
+		}
+	}
+	var statsCache *owapi.BoltCache
+	if dbCache {
+		statsCache, err = owapi.NewBoltCache(logger, db)
+		if err != nil {
+			logger.Fatalf("Could not create stats cache: %+v", err)
+		}
+	}
+	owAPIOpts := owapi.ClientOptions{
+		BaseURL:               owAPIURL,
+		MaxConcurrentRequests: owAPIConc,
+		RequestsPerSecond:     owAPIRPS,
+	}
+	if statsCache != nil {
+		owAPIOpts.PersistentCache = statsCache
+	}
+	statsProvider, err := createStatsProvider(logger, providers, owAPIOpts)
+	if err != nil {
+		logger.Fatalf("Could not create stats provider: %+v", err)
+	}
+	userSource, err := createUserSource(logger, db)
 	if err != nil {
 		logger.Fatalf("Could not create user source: %+v", err)
 	}
 	defer userSource.Close()
-	bot, err := owbot.New(logger, token, userSource)
+	achievementSource, err := createAchievementSource(logger, db)
+	if err != nil {
+		logger.Fatalf("Could not create achievement source: %+v", err)
+	}
+	defer achievementSource.Close()
+	preferenceSource, err := createPreferenceSource(logger, db)
+	if err != nil {
+		logger.Fatalf("Could not create preference source: %+v", err)
+	}
+	defer preferenceSource.Close()
+	historySource, err := createHistorySource(logger, db)
+	if err != nil {
+		logger.Fatalf("Could not create history source: %+v", err)
+	}
+	defer historySource.Close()
+	bot, err := owbot.New(logger, token, statsProvider, userSource, achievementSource, preferenceSource, historySource,
+		verifyIcons)
 	if err != nil {
 		logger.Fatalf("Error creating bot instance: %+v", err)
 	}
 	ctx := lifetimeContext(logger)
+	if statsCache != nil {
+		go statsCache.RunCompaction(ctx, statsCacheCompactionInterval)
+	}
+	if backup != nil {
+		go backup.Run(ctx, backupInterval)
+	}
 	err = bot.Run(ctx)
 	if errors.Cause(err) == context.Canceled {
 		logger.Debugf("Error caught in main: %+v", err)
@@ -54,23 +162,272 @@ func main() {
 	}
 }
 
-func createUserSource(logger *logrus.Logger, dbFile string) (owbot.UserSource, error) {
-	if dbFile != "" {
-		path, err := filepath.Abs(dbFile)
+// subcommands are the commands run instead of the bot, by giving their
+// name as the first argument
+var subcommands = map[string]func(logger *logrus.Logger, args []string) error{
+	"export":  runExport,
+	"import":  runImport,
+	"restore": runRestore,
+}
+
+// runExport writes all users of a bolt db to a file, or to stdout.
+func runExport(logger *logrus.Logger, args []string) error {
+	var (
+		dbFile    string
+		format    string
+		outFile   string
+		guilds    string
+		createdBy string
+	)
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&dbFile, "dbfile", "", "Path to the bolt database to export the users of.")
+	flags.StringVar(&format, "format", "json", "Optional. Format to export in, json or csv.")
+	flags.StringVar(&outFile, "out", "", "Optional. File to write the users to. Standard output if not set.")
+	flags.StringVar(&guilds, "guilds", "", "Optional. Comma separated list of the guild ids to export the users "+
+		"of, \"global\" for the global users. All users if not set.")
+	flags.StringVar(&createdBy, "createdby", "", "Optional. Only export the users last set by this user id.")
+	flags.Parse(args)
+	if dbFile == "" {
+		return errors.New("The dbfile argument is required.")
+	}
+	filter := owbot.UserFilter{CreatedBy: createdBy}
+	if guilds != "" {
+		for _, guildID := range strings.Split(guilds, ",") {
+			guildID = strings.TrimSpace(guildID)
+			if guildID == "global" {
+				guildID = owbot.GlobalScope
+			}
+			filter.GuildIDs = append(filter.GuildIDs, guildID)
+		}
+	}
+
+	db, err := openBoltDB(logger, dbFile)
+	if err != nil {
+		return errors.Wrap(err, "Could not open db")
+	}
+	userSource, err := createUserSource(logger, db)
+	if err != nil {
+		return errors.Wrap(err, "Could not create user source")
+	}
+	defer userSource.Close()
+	out := io.Writer(os.Stdout)
+	if outFile != "" {
+		f, err := os.Create(outFile)
 		if err != nil {
-			return nil, errors.Wrap(err, "Could not determine absolute dbFile path")
+			return errors.Wrap(err, "Could not create out file")
+		}
+		defer f.Close()
+		out = f
+	}
+	n, err := owbot.ExportUsers(out, userSource, filter, owbot.TransferFormat(format))
+	if err != nil {
+		return err
+	}
+	logger.Infof("Exported %d users", n)
+	return nil
+}
+
+// runImport reads users from a file, or from stdin, and stores them to
+// a bolt db.
+func runImport(logger *logrus.Logger, args []string) error {
+	var (
+		dbFile       string
+		format       string
+		mode         string
+		keepVerified bool
+	)
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&dbFile, "dbfile", "", "Path to the bolt database to import the users to.")
+	flags.StringVar(&format, "format", "", "Optional. Format to import from, json or csv. "+
+		"Defaults to the extension of the file, or json.")
+	flags.StringVar(&mode, "mode", string(owbot.ImportMerge), "Optional. How to import users that already exist. "+
+		"\"merge\" only adds new accounts, \"overwrite\" replaces the existing users.")
+	flags.BoolVar(&keepVerified, "keepverified", false, "Optional. Keeps the imported accounts verified, "+
+		"only use for files exported by a trusted bot.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [flags] <file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if dbFile == "" {
+		return errors.New("The dbfile argument is required.")
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("Exactly one file to import is required.")
+	}
+	inFile := flags.Arg(0)
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(inFile), ".")
+		if format != string(owbot.TransferCSV) {
+			format = string(owbot.TransferJSON)
+		}
+	}
+
+	in, err := os.Open(inFile)
+	if err != nil {
+		return errors.Wrap(err, "Could not open file to import")
+	}
+	defer in.Close()
+	db, err := openBoltDB(logger, dbFile)
+	if err != nil {
+		return errors.Wrap(err, "Could not open db")
+	}
+	userSource, err := createUserSource(logger, db)
+	if err != nil {
+		return errors.Wrap(err, "Could not create user source")
+	}
+	defer userSource.Close()
+	historySource, err := createHistorySource(logger, db)
+	if err != nil {
+		return errors.Wrap(err, "Could not create history source")
+	}
+	defer historySource.Close()
+	report, err := owbot.ImportUsers(in, userSource, historySource, owbot.TransferFormat(format), owbot.ImportMode(mode),
+		keepVerified)
+	if report != nil {
+		action := "kept the stored account"
+		if owbot.ImportMode(mode) == owbot.ImportOverwrite {
+			action = "overwrote the stored account"
+		}
+		for _, conflict := range report.Conflicts {
+			logger.Warnf("Conflict, %s: %s", action, conflict)
+		}
+		logger.Infof("Imported users: %d created, %d updated, %d unchanged, %d conflicts",
+			report.Created, report.Updated, report.Unchanged, len(report.Conflicts))
+	}
+	return err
+}
+
+// runRestore replaces a bolt db with a snapshot taken by the backups.
+func runRestore(logger *logrus.Logger, args []string) error {
+	var dbFile string
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.StringVar(&dbFile, "dbfile", "", "Path to the bolt database to replace with the snapshot.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s restore [flags] <snapshot>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if dbFile == "" {
+		return errors.New("The dbfile argument is required.")
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("Exactly one snapshot to restore is required.")
+	}
+	snapshot := flags.Arg(0)
+
+	replaced, err := owbot.RestoreSnapshot(snapshot, dbFile)
+	if err != nil {
+		return err
+	}
+	if replaced != "" {
+		logger.Infof("Restored %s, the replaced db was kept as %s", snapshot, replaced)
+	} else {
+		logger.Infof("Restored %s", snapshot)
+	}
+	return nil
+}
+
+// createStatsProvider creates the stats provider from a comma separated
+// list of provider names. If more than one provider is given, the
+// providers are tried in order until one succeeds. The owapi provider
+// is created with owAPIOpts.
+func createStatsProvider(logger *logrus.Logger, providerNames string, owAPIOpts owapi.ClientOptions) (owbot.StatsProvider, error) {
+	var providers []owbot.StatsProvider
+	for _, name := range strings.Split(providerNames, ",") {
+		var provider owbot.StatsProvider
+		var err error
+		switch strings.TrimSpace(name) {
+		case "owapi":
+			provider, err = owapi.NewClient(logger, owAPIOpts)
+		case "playoverwatch":
+			provider, err = playoverwatch.NewClient(logger, nil, "")
+		default:
+			return nil, errors.Errorf("Unknown stats provider: '%s'", name)
 		}
-		logger.Infof("Using Bolt db user source: %s", path)
-		db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: 5 * time.Second})
 		if err != nil {
-			return nil, errors.Wrap(err, "Could not open bolt db")
+			return nil, errors.Wrapf(err, "Could not create stats provider '%s'", name)
 		}
+		providers = append(providers, provider)
+	}
+	if len(providers) == 1 {
+		return providers[0], nil
+	}
+	logger.Infof("Using stats providers in order: %s", providerNames)
+	return owbot.NewFallbackStatsProvider(logger, providers...)
+}
+
+// readVerifyIcons reads the icons used for verification from the JSON
+// file. Returns no icons if verifyIconsFile is empty.
+func readVerifyIcons(verifyIconsFile string) ([]owbot.VerifyIcon, error) {
+	if verifyIconsFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(verifyIconsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return owbot.ReadVerifyIcons(f)
+}
+
+// openBoltDB opens the bolt db at dbFile, and migrates it to the
+// current schema version. Returns a nil db if dbFile is empty.
+func openBoltDB(logger *logrus.Logger, dbFile string) (*bolt.DB, error) {
+	if dbFile == "" {
+		return nil, nil
+	}
+	path, err := filepath.Abs(dbFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not determine absolute dbFile path")
+	}
+	logger.Infof("Using Bolt db: %s", path)
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open bolt db")
+	}
+	// Bring the data up to date before any source uses it
+	if err := owbot.MigrateBoltDB(logger, db); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "Could not migrate bolt db")
+	}
+	return db, nil
+}
+
+func createUserSource(logger *logrus.Logger, db *bolt.DB) (owbot.UserSource, error) {
+	if db != nil {
 		return owbot.NewBoltUserSource(logger, db)
 	} else {
 		return owbot.NewMemoryUserSource(), nil
 	}
 }
 
+func createAchievementSource(logger *logrus.Logger, db *bolt.DB) (owbot.AchievementSource, error) {
+	if db != nil {
+		return owbot.NewBoltAchievementSource(logger, db)
+	} else {
+		return owbot.NewMemoryAchievementSource(), nil
+	}
+}
+
+func createPreferenceSource(logger *logrus.Logger, db *bolt.DB) (owbot.PreferenceSource, error) {
+	if db != nil {
+		return owbot.NewBoltPreferenceSource(logger, db)
+	} else {
+		return owbot.NewMemoryPreferenceSource(), nil
+	}
+}
+
+func createHistorySource(logger *logrus.Logger, db *bolt.DB) (owbot.HistorySource, error) {
+	if db != nil {
+		return owbot.NewBoltHistorySource(logger, db)
+	} else {
+		return owbot.NewMemoryHistorySource(), nil
+	}
+}
+
 // lifetimeContext returns a context that is cancelled on the first SIGINT or
 // SIGKILL signal received. The application is force closed if more than
 // one signal is received.
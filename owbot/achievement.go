@@ -0,0 +1,126 @@
+package owbot
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"sync"
+)
+
+// A simple interface for a data source of previously seen
+// unlocked achievements, keyed by BattleTag
+type AchievementSource interface {
+	io.Closer
+	// Returns the names of the unlocked achievements last seen for the
+	// BattleTag, or nil if no achievements have been stored.
+	GetUnlocked(battleTag string) ([]string, error)
+
+	// Stores the names of the unlocked achievements for the BattleTag
+	SaveUnlocked(battleTag string, names []string) error
+}
+
+// An in memory implementation of an achievement source
+type MemoryAchievementSource struct {
+	mu   sync.Mutex
+	data map[string][]string
+}
+
+func NewMemoryAchievementSource() *MemoryAchievementSource {
+	return &MemoryAchievementSource{
+		data: make(map[string][]string),
+	}
+}
+
+func (s *MemoryAchievementSource) GetUnlocked(battleTag string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, ok := s.data[battleTag]
+	if !ok {
+		return nil, nil
+	}
+	return append([]string{}, names...), nil
+}
+
+func (s *MemoryAchievementSource) SaveUnlocked(battleTag string, names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[battleTag] = append([]string{}, names...)
+	return nil
+}
+
+func (s *MemoryAchievementSource) Close() error {
+	return nil
+}
+
+var bucketAchievements = []byte("achievements")
+
+type BoltAchievementSource struct {
+	logger *logrus.Entry
+	db     *bolt.DB
+}
+
+func createAchievementsBucket(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketAchievements)
+		return err
+	})
+}
+
+func NewBoltAchievementSource(logger *logrus.Logger, db *bolt.DB) (*BoltAchievementSource, error) {
+	// Make sure the achievements bucket exist
+	if err := createAchievementsBucket(db); err != nil {
+		return nil, err
+	}
+
+	// Store the logger as an Entry, adding the module to all log calls
+	loggerEntry := logger.WithField("module", "boltAchievementSource")
+
+	return &BoltAchievementSource{
+		db:     db,
+		logger: loggerEntry,
+	}, nil
+}
+
+func (s *BoltAchievementSource) mustGetBucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		s.logger.WithField("name", name).Panic("Bucket not found")
+	}
+	return bucket
+}
+
+func (s *BoltAchievementSource) GetUnlocked(battleTag string) ([]string, error) {
+	var names []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := s.mustGetBucket(tx, bucketAchievements)
+		v := bucket.Get([]byte(battleTag))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &names)
+	})
+	return names, err
+}
+
+func (s *BoltAchievementSource) SaveUnlocked(battleTag string, names []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := s.mustGetBucket(tx, bucketAchievements)
+		// Make sure an empty list is not stored as null, so that it
+		// is not confused with no list being stored
+		if names == nil {
+			names = []string{}
+		}
+		data, err := json.Marshal(names)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(battleTag), data)
+	})
+}
+
+// Close closes the underlying bolt db. The db is shared with the other
+// bolt sources, closing it more than once is safe.
+func (s *BoltAchievementSource) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,303 @@
+package owbot
+
+import (
+	"context"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Snapshots are named backupPrefix + the UTC time of the
+	// snapshot + backupSuffix, so that they sort by time. The time has
+	// a fixed number of fractional seconds, so that snapshots taken in
+	// the same second get names of their own that still sort by time
+	backupPrefix     = "owbot-"
+	backupSuffix     = ".boltdb"
+	backupTimeFormat = "20060102T150405.000000000Z"
+
+	// How long a restore waits for the lock of the live db. The bot
+	// holds the lock for as long as it runs
+	restoreLockTimeout = 1 * time.Second
+)
+
+// BoltBackup takes snapshots of a bolt db, while it is in use, to a
+// directory. Only the most recent snapshots are kept.
+type BoltBackup struct {
+	logger *logrus.Entry
+	db     *bolt.DB
+	dir    string
+	// The number of snapshots to keep
+	retain int
+}
+
+// NewBoltBackup returns a BoltBackup taking snapshots of the db to dir,
+// keeping the retain most recent snapshots. The dir is created if it
+// does not exist.
+func NewBoltBackup(logger *logrus.Logger, db *bolt.DB, dir string, retain int) (*BoltBackup, error) {
+	if retain < 1 {
+		return nil, errors.Errorf("At least one snapshot must be retained, not %d", retain)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "Could not create backup dir")
+	}
+
+	// Store the logger as an Entry, adding the module to all log calls
+	loggerEntry := logger.WithField("module", "boltBackup")
+
+	return &BoltBackup{
+		logger: loggerEntry,
+		db:     db,
+		dir:    dir,
+		retain: retain,
+	}, nil
+}
+
+// Snapshot writes a consistent snapshot of the db to the backup dir, and
+// removes the snapshots that are no longer retained. Returns the path of
+// the snapshot.
+func (b *BoltBackup) Snapshot() (string, error) {
+	name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+	path := filepath.Join(b.dir, name)
+
+	// The snapshot is written to a temp file first, so that a partly
+	// written snapshot is never mistaken for a complete one
+	f, err := ioutil.TempFile(b.dir, name+".tmp")
+	if err != nil {
+		return "", errors.Wrap(err, "Could not create snapshot file")
+	}
+	defer os.Remove(f.Name())
+	err = b.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Could not write snapshot")
+	}
+	// Renaming would silently replace an existing snapshot
+	if _, err := os.Lstat(path); err == nil {
+		return "", errors.Errorf("Snapshot '%s' already exists", path)
+	} else if !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "Could not stat snapshot")
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", errors.Wrap(err, "Could not rename snapshot")
+	}
+
+	if err := b.prune(); err != nil {
+		return path, err
+	}
+	return path, nil
+}
+
+// snapshots returns the paths of the snapshots in the backup dir, oldest
+// first.
+func (b *BoltBackup) snapshots() ([]string, error) {
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, file := range files {
+		name := file.Name()
+		if file.Mode().IsRegular() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			paths = append(paths, filepath.Join(b.dir, name))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// prune removes all but the retain most recent snapshots
+func (b *BoltBackup) prune() error {
+	paths, err := b.snapshots()
+	if err != nil {
+		return errors.Wrap(err, "Could not list snapshots")
+	}
+	for len(paths) > b.retain {
+		if err := os.Remove(paths[0]); err != nil {
+			return errors.Wrap(err, "Could not remove old snapshot")
+		}
+		b.logger.WithField("path", paths[0]).Debug("Removed old snapshot")
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// Run takes a snapshot every interval, until the context is done.
+// Always returns a non-nil error.
+func (b *BoltBackup) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		path, err := b.Snapshot()
+		if err != nil {
+			b.logger.WithError(err).Error("Could not take snapshot")
+		} else {
+			b.logger.WithField("path", path).Info("Took snapshot")
+		}
+	}
+}
+
+// CheckSnapshot returns an error if the bolt db at path is not intact, or
+// has a newer schema version than SchemaVersion.
+func CheckSnapshot(path string) (err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, "Could not stat snapshot")
+	}
+	// Bolt maps the file into memory, and faults rather than returns an
+	// error when a corrupt file makes it read past the end of the file.
+	// The faults are turned into panics, which are recovered along with
+	// those of pages that are corrupt beyond what bolt expects
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("Snapshot is corrupt: %v", r)
+		}
+	}()
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: restoreLockTimeout})
+	if err != nil {
+		return errors.Wrap(err, "Could not open snapshot")
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		// The consistency check reads all pages of the db, from
+		// another goroutine, so they must all be in the file
+		if tx.Size() > info.Size() {
+			return errors.Errorf("Snapshot is truncated, %d bytes of %d", info.Size(), tx.Size())
+		}
+		var problems []string
+		for err := range tx.Check() {
+			problems = append(problems, err.Error())
+		}
+		if len(problems) > 0 {
+			return errors.Errorf("Snapshot is corrupt:\n%s", strings.Join(problems, "\n"))
+		}
+		version, err := getSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > SchemaVersion() {
+			return errors.Wrapf(ErrSchemaTooNew, "Snapshot schema version %d, supported up to %d",
+				version, SchemaVersion())
+		}
+		return nil
+	})
+}
+
+// RestoreSnapshot replaces the bolt db at dbFile with the snapshot, after
+// checking that the snapshot is intact. The db must not be in use. The
+// replaced db is kept next to dbFile, and its path is returned, empty if
+// there was no db at dbFile.
+func RestoreSnapshot(snapshot, dbFile string) (string, error) {
+	if err := CheckSnapshot(snapshot); err != nil {
+		return "", err
+	}
+
+	_, err := os.Stat(dbFile)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "Could not stat the db")
+	}
+	if exists {
+		// Holding the lock of the live db makes sure the bot is not
+		// running, and that it is not started while the db is replaced
+		live, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: restoreLockTimeout})
+		if err != nil {
+			return "", errors.Wrap(err, "Could not open the db, make sure the bot is not running")
+		}
+		defer live.Close()
+	}
+
+	// Copy the snapshot next to the db, so that it can be renamed
+	// over the db
+	dst, err := ioutil.TempFile(filepath.Dir(dbFile), filepath.Base(dbFile)+".restore")
+	if err != nil {
+		return "", errors.Wrap(err, "Could not create restore file")
+	}
+	defer os.Remove(dst.Name())
+	if err := copyToFile(dst, snapshot); err != nil {
+		return "", errors.Wrap(err, "Could not copy snapshot")
+	}
+	// The copy is checked too, in case the snapshot changed since it
+	// was checked
+	if err := CheckSnapshot(dst.Name()); err != nil {
+		return "", err
+	}
+
+	replaced := ""
+	if exists {
+		replaced = fmt.Sprintf("%s.replaced-%s", dbFile, time.Now().UTC().Format(backupTimeFormat))
+		if err := keepReplacedDB(dbFile, replaced); err != nil {
+			return "", errors.Wrap(err, "Could not keep the replaced db")
+		}
+	}
+	if err := os.Rename(dst.Name(), dbFile); err != nil {
+		if replaced != "" {
+			os.Remove(replaced)
+		}
+		return "", errors.Wrap(err, "Could not replace the db")
+	}
+	return replaced, nil
+}
+
+// linkFile creates newname as a hard link to oldname. A variable, so that
+// the tests can act as a filesystem without hard links.
+var linkFile = os.Link
+
+// keepReplacedDB keeps the db at dbFile as replaced, while leaving dbFile
+// in place until it is replaced. A hard link is used if the filesystem
+// supports it, otherwise the db is copied.
+func keepReplacedDB(dbFile, replaced string) error {
+	if err := linkFile(dbFile, replaced); err == nil {
+		return nil
+	}
+	dst, err := os.OpenFile(replaced, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := copyToFile(dst, dbFile); err != nil {
+		os.Remove(replaced)
+		return err
+	}
+	return nil
+}
+
+// copyToFile copies the file at src to dst, syncs and closes dst.
+func copyToFile(dst *os.File, src string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	defer srcFile.Close()
+	_, err = io.Copy(dst, srcFile)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
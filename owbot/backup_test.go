@@ -0,0 +1,267 @@
+package owbot_test
+
+import (
+	"encoding/binary"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/verath/owbot-bot/owbot"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newBackupTestDB returns a migrated bolt db in a temp dir, with a user.
+// The returned func closes the db and removes the dir.
+func newBackupTestDB(t *testing.T) (*bolt.DB, string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "owbot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFile := filepath.Join(dir, "owbot.boltdb")
+	db, err := bolt.Open(dbFile, 0600, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+	if err := owbot.MigrateBoltDB(newTestLogger(), db); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	source, err := owbot.NewBoltUserSource(newTestLogger(), db)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err := source.Save(backupTestUser("player#1234")); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return db, dbFile, cleanup
+}
+
+func backupTestUser(battleTag string) *owbot.User {
+	return &owbot.User{
+		ID:        "1",
+		Accounts:  []owbot.Account{{Label: "main", BattleTag: battleTag}},
+		Primary:   "main",
+		CreatedBy: "1",
+	}
+}
+
+// getBackupTestUser returns the user stored by newBackupTestDB in the db
+// at dbFile
+func getBackupTestUser(t *testing.T, dbFile string) *owbot.User {
+	t.Helper()
+	db, err := bolt.Open(dbFile, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	source, err := owbot.NewBoltUserSource(newTestLogger(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := source.Get(owbot.GlobalScope, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestBoltBackupRetain(t *testing.T) {
+	db, dbFile, cleanup := newBackupTestDB(t)
+	defer cleanup()
+	backupDir := filepath.Join(filepath.Dir(dbFile), "backups")
+	backup, err := owbot.NewBoltBackup(newTestLogger(), db, backupDir, 2)
+	if err != nil {
+		t.Fatalf("NewBoltBackup returned error: %+v", err)
+	}
+
+	// Old snapshots, and a file that is not a snapshot
+	for _, name := range []string{"owbot-20000101T000000Z.boltdb", "owbot-20000102T000000Z.boltdb", "other.boltdb"} {
+		if err := ioutil.WriteFile(filepath.Join(backupDir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, err := backup.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %+v", err)
+	}
+	if err := owbot.CheckSnapshot(path); err != nil {
+		t.Errorf("CheckSnapshot of snapshot returned error: %+v", err)
+	}
+	files, err := filepath.Glob(filepath.Join(backupDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(backupDir, "other.boltdb"),
+		filepath.Join(backupDir, "owbot-20000102T000000Z.boltdb"),
+		path,
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("files after snapshot = %v, want %v", files, want)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	db, dbFile, cleanup := newBackupTestDB(t)
+	defer cleanup()
+	backup, err := owbot.NewBoltBackup(newTestLogger(), db, filepath.Dir(dbFile), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := backup.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %+v", err)
+	}
+
+	// The db can not be restored while it is in use
+	if _, err := owbot.RestoreSnapshot(snapshot, dbFile); err == nil {
+		t.Error("RestoreSnapshot of db in use returned no error")
+	}
+
+	// Change the user after the snapshot, then restore the snapshot
+	source, err := owbot.NewBoltUserSource(newTestLogger(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Save(backupTestUser("changed#1234")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	replaced, err := owbot.RestoreSnapshot(snapshot, dbFile)
+	if err != nil {
+		t.Fatalf("RestoreSnapshot returned error: %+v", err)
+	}
+	if got, want := getBackupTestUser(t, dbFile), backupTestUser("player#1234"); !reflect.DeepEqual(got, want) {
+		t.Errorf("user after restore = %+v, want %+v", got, want)
+	}
+	if got, want := getBackupTestUser(t, replaced), backupTestUser("changed#1234"); !reflect.DeepEqual(got, want) {
+		t.Errorf("user of replaced db = %+v, want %+v", got, want)
+	}
+}
+
+func TestRestoreSnapshotCorrupt(t *testing.T) {
+	db, dbFile, cleanup := newBackupTestDB(t)
+	defer cleanup()
+	backup, err := owbot.NewBoltBackup(newTestLogger(), db, filepath.Dir(dbFile), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := backup.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %+v", err)
+	}
+	db.Close()
+	data, err := ioutil.ReadFile(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageSize := os.Getpagesize()
+	// Change the transaction id of both meta pages, which no longer
+	// match their checksums
+	badChecksum := append([]byte{}, data...)
+	badChecksum[64]++
+	badChecksum[pageSize+64]++
+	// A freelist with more elements than fit in the file
+	badFreelist := append([]byte{}, data...)
+	freelist := int(binary.LittleEndian.Uint64(data[48:])) * pageSize
+	binary.LittleEndian.PutUint16(badFreelist[freelist+10:], 0xFFFF)
+	binary.LittleEndian.PutUint64(badFreelist[freelist+16:], 1<<40)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Empty", []byte{}},
+		{"Garbage", []byte("not a bolt db, not a bolt db, not a bolt db")},
+		{"Truncated", data[:len(data)/2]},
+		{"BadChecksum", badChecksum},
+		{"BadFreelist", badFreelist},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			corrupt := filepath.Join(filepath.Dir(dbFile), test.name+".boltdb")
+			if err := ioutil.WriteFile(corrupt, test.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := owbot.RestoreSnapshot(corrupt, dbFile); err == nil {
+				t.Error("RestoreSnapshot of corrupt snapshot returned no error")
+			}
+			// The db must be left as it was
+			if got, want := getBackupTestUser(t, dbFile), backupTestUser("player#1234"); !reflect.DeepEqual(got, want) {
+				t.Errorf("user after failed restore = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotWithoutHardLinks(t *testing.T) {
+	db, dbFile, cleanup := newBackupTestDB(t)
+	defer cleanup()
+	backup, err := owbot.NewBoltBackup(newTestLogger(), db, filepath.Dir(dbFile), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := backup.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %+v", err)
+	}
+	source, err := owbot.NewBoltUserSource(newTestLogger(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Save(backupTestUser("changed#1234")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	defer owbot.SetLinkFile(func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.New("operation not permitted")}
+	})()
+	replaced, err := owbot.RestoreSnapshot(snapshot, dbFile)
+	if err != nil {
+		t.Fatalf("RestoreSnapshot returned error: %+v", err)
+	}
+	if got, want := getBackupTestUser(t, dbFile), backupTestUser("player#1234"); !reflect.DeepEqual(got, want) {
+		t.Errorf("user after restore = %+v, want %+v", got, want)
+	}
+	// The replaced db is copied instead
+	if got, want := getBackupTestUser(t, replaced), backupTestUser("changed#1234"); !reflect.DeepEqual(got, want) {
+		t.Errorf("user of replaced db = %+v, want %+v", got, want)
+	}
+}
+
+func TestBoltBackupSnapshotsInSameSecond(t *testing.T) {
+	db, dbFile, cleanup := newBackupTestDB(t)
+	defer cleanup()
+	backupDir := filepath.Join(filepath.Dir(dbFile), "backups")
+	backup, err := owbot.NewBoltBackup(newTestLogger(), db, backupDir, 3)
+	if err != nil {
+		t.Fatalf("NewBoltBackup returned error: %+v", err)
+	}
+	// No snapshot may replace one taken right before it
+	var want []string
+	for i := 0; i < 3; i++ {
+		path, err := backup.Snapshot()
+		if err != nil {
+			t.Fatalf("Snapshot returned error: %+v", err)
+		}
+		want = append(want, path)
+	}
+	files, err := filepath.Glob(filepath.Join(backupDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("files after snapshots = %v, want %v", files, want)
+	}
+}
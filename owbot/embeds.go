@@ -0,0 +1,91 @@
+package owbot
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"strings"
+	"time"
+)
+
+// formatRank formats a skill rating together with its tier, e.g.
+// "2734 (💠 Platinum)".
+func formatRank(rank int) string {
+	if tier := tierForRank(rank); tier != nil {
+		return fmt.Sprintf("%d (%s %s)", rank, tier.Emoji, tier.Name)
+	}
+	return fmt.Sprintf("%d", rank)
+}
+
+// profileEmbed returns the profile as an embed, the rich alternative
+// to tmplOverwatchProfile.
+func profileEmbed(data overwatchProfileData) *discordgo.MessageEmbed {
+	stats := data.UserStats
+	embed := &discordgo.MessageEmbed{
+		Title: fmt.Sprintf("%s (%s)", stats.BattleTag, stats.Mode),
+	}
+	if data.Verified {
+		embed.Title = fmt.Sprintf("%s ✅ (%s)", stats.BattleTag, stats.Mode)
+	}
+	if data.CompetitiveFallback {
+		embed.Description = "*No competitive stats found, showing Quick Play stats instead*"
+	}
+
+	addField := func(name, value string, inline bool) {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: name, Value: value, Inline: inline})
+	}
+	if data.Account != "" {
+		addField("Account", data.Account, true)
+	}
+	addField("Level", fmt.Sprintf("%d", levelPrestige(stats.OverallStats.Prestige, stats.OverallStats.Level)), true)
+
+	// The embed is colored by the highest tier of the player
+	highestRank := 0
+	if stats.Mode == owapi.ModeCompetitive {
+		if stats.OverallStats.CompRank > 0 && stats.PlacedRoles() == 0 {
+			addField("Rank", formatRank(stats.OverallStats.CompRank), true)
+			highestRank = stats.OverallStats.CompRank
+		} else {
+			for _, rr := range stats.Roles() {
+				value := "Not placed"
+				if rr.Placed() {
+					value = formatRank(rr.Rank)
+				}
+				addField(rr.Role.String(), value, true)
+				if rr.Rank > highestRank {
+					highestRank = rr.Rank
+				}
+			}
+		}
+	}
+	if tier := tierForRank(highestRank); tier != nil {
+		embed.Color = tier.Color
+	}
+
+	addField("K/D", fmt.Sprintf("%v/%v (%v KPD)",
+		stats.GameStats.Eliminations, stats.GameStats.Deaths, stats.GameStats.KPD), true)
+	addField("Win Rate", fmt.Sprintf("%.2f%%", stats.OverallStats.WinRate), true)
+	addField("Matches W/L", fmt.Sprintf("%d/%d (%d total)",
+		stats.OverallStats.Wins, stats.OverallStats.Losses, stats.OverallStats.Games), true)
+	addField("Time Played", fmt.Sprintf("%v hours", stats.GameStats.TimePlayed), true)
+	if len(data.TopHeroes) > 0 {
+		var heroes []string
+		for _, hero := range data.TopHeroes {
+			heroes = append(heroes, fmt.Sprintf("**%s** - %.1f hours, %.2f%% win rate",
+				hero.Name(), hero.TimePlayed, hero.WinRate))
+		}
+		addField("Top Heroes", strings.Join(heroes, "\n"), false)
+	}
+
+	var footer []string
+	if stats.Region != "" {
+		footer = append(footer, "Region: "+stats.Region)
+	}
+	if !stats.FetchedAt.IsZero() {
+		footer = append(footer, fmt.Sprintf("Data from %s ago", formatAge(time.Since(stats.FetchedAt))))
+	}
+	if len(footer) > 0 {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: strings.Join(footer, " • ")}
+	}
+	return embed
+}
@@ -0,0 +1,44 @@
+package owbot
+
+import (
+	"bytes"
+	"github.com/verath/owbot-bot/owbot/owapi"
+)
+
+// Exports of unexported identifiers, for the tests of the owbot_test
+// package.
+
+// FetchErrorTemplateName returns the name of the template explaining err,
+// an error fetching stats, to the user.
+func FetchErrorTemplateName(err error) string {
+	return fetchErrorTemplate(err, tmplFetchError).Name()
+}
+
+// ExecuteFetchErrorTemplate returns the default message for errors fetching
+// stats of the player for the mode.
+func ExecuteFetchErrorTemplate(player owapi.Player, mode owapi.Mode) (string, error) {
+	var buf bytes.Buffer
+	err := tmplFetchError.Execute(&buf, newFetchErrorData(&player, mode))
+	return buf.String(), err
+}
+
+// CanSetUser returns true if the author is allowed to set accounts of the
+// user in the guild.
+func CanSetUser(source UserSource, guildID, userID, authorID string) (bool, error) {
+	_, allowed, err := modifiableUser(source, guildID, userID, authorID)
+	return allowed, err
+}
+
+// StoreChanges appends the changes to the history and stores them by
+// calling store, removing them from the history if store fails.
+func StoreChanges(history HistorySource, changes []*HistoryEntry, store func() error) error {
+	return storeChanges(history, changes, store)
+}
+
+// SetLinkFile replaces the function creating hard links, returning a
+// func restoring it.
+func SetLinkFile(link func(oldname, newname string) error) func() {
+	prev := linkFile
+	linkFile = link
+	return func() { linkFile = prev }
+}
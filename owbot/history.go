@@ -0,0 +1,305 @@
+package owbot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"sync"
+	"time"
+)
+
+// A HistoryEntry records a change of the BattleTag of an account of a
+// user.
+type HistoryEntry struct {
+	// The guild of the changed user, GlobalScope for global users
+	GuildID string
+	// The Discord id (snowflake) of the changed user
+	UserID string
+	// The label of the changed account
+	Label string
+	// The BattleTag before the change, empty if the account was added
+	OldBattleTag string
+	// The BattleTag after the change, empty if the account was removed
+	NewBattleTag string
+	// The Discord id (snowflake) of the user that made the change
+	ChangedBy string
+	// When the change was made
+	Time time.Time
+}
+
+// ChangedByImport is the ChangedBy of changes made by importing users,
+// see ImportUsers
+const ChangedByImport = "import"
+
+// Imported returns true if the change was made by importing users
+func (e *HistoryEntry) Imported() bool {
+	return e.ChangedBy == ChangedByImport
+}
+
+// accountChanges returns the changes of the BattleTags of the accounts of
+// the user from prev to next, made by changedBy at t. prev is nil if the
+// user is new. Accounts of prev missing from next are removed.
+func accountChanges(prev, next *User, changedBy string, t time.Time) []*HistoryEntry {
+	var changes []*HistoryEntry
+	change := func(label, oldBattleTag, newBattleTag string) {
+		changes = append(changes, &HistoryEntry{
+			GuildID:      next.GuildID,
+			UserID:       next.ID,
+			Label:        label,
+			OldBattleTag: oldBattleTag,
+			NewBattleTag: newBattleTag,
+			ChangedBy:    changedBy,
+			Time:         t,
+		})
+	}
+	for _, account := range next.Accounts {
+		var oldBattleTag string
+		if prev != nil {
+			if prevAccount := prev.Account(account.Label); prevAccount != nil {
+				oldBattleTag = prevAccount.BattleTag
+			}
+		}
+		if oldBattleTag != account.BattleTag {
+			change(account.Label, oldBattleTag, account.BattleTag)
+		}
+	}
+	if prev != nil {
+		for _, account := range prev.Accounts {
+			if next.Account(account.Label) == nil {
+				change(account.Label, account.BattleTag, "")
+			}
+		}
+	}
+	return changes
+}
+
+// equal returns true if the entries record the same change
+func (e *HistoryEntry) equal(other *HistoryEntry) bool {
+	a, b := *e, *other
+	a.Time, b.Time = time.Time{}, time.Time{}
+	return a == b && e.Time.Equal(other.Time)
+}
+
+// storeChanges appends the changes to the history, then stores them by
+// calling store. Changes are appended before they are stored, so that no
+// stored change is missing from the history, and are removed from the
+// history again if they could not be stored.
+func storeChanges(history HistorySource, changes []*HistoryEntry, store func() error) error {
+	var err error
+	appended := 0
+	for _, change := range changes {
+		if err = history.Append(change); err != nil {
+			err = errors.Wrapf(err, "Failed appending change (%+v) to history source", change)
+			break
+		}
+		appended++
+	}
+	if err == nil {
+		err = store()
+	}
+	if err == nil {
+		return nil
+	}
+	for _, change := range changes[:appended] {
+		if removeErr := history.Remove(change); removeErr != nil {
+			return errors.Wrapf(err, "Failed removing change (%+v) from history source: %v", change, removeErr)
+		}
+	}
+	return err
+}
+
+// A simple interface for an append-only data source of the change
+// history of users
+type HistorySource interface {
+	io.Closer
+	// Appends the entry to the history of the user of the entry
+	Append(entry *HistoryEntry) error
+
+	// Returns the history of the user in the guild, oldest entry first,
+	// or an empty history if the user has no history.
+	Get(guildID, userID string) ([]*HistoryEntry, error)
+
+	// Removes the most recent entry equal to entry from the history of
+	// the user of the entry, if any. Only used to roll back entries of
+	// changes that could not be stored.
+	Remove(entry *HistoryEntry) error
+}
+
+// An in memory implementation of a history source
+type MemoryHistorySource struct {
+	mu   sync.Mutex
+	data map[userKey][]HistoryEntry
+}
+
+func NewMemoryHistorySource() *MemoryHistorySource {
+	return &MemoryHistorySource{
+		data: make(map[userKey][]HistoryEntry),
+	}
+}
+
+func (s *MemoryHistorySource) Append(entry *HistoryEntry) error {
+	if entry == nil {
+		return errors.New("Entry can not be nil")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := userKey{entry.GuildID, entry.UserID}
+	s.data[key] = append(s.data[key], *entry)
+	return nil
+}
+
+func (s *MemoryHistorySource) Get(guildID, userID string) ([]*HistoryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := s.data[userKey{guildID, userID}]
+	history := make([]*HistoryEntry, len(entries))
+	for i := range entries {
+		entry := entries[i]
+		history[i] = &entry
+	}
+	return history, nil
+}
+
+func (s *MemoryHistorySource) Remove(entry *HistoryEntry) error {
+	if entry == nil {
+		return errors.New("Entry can not be nil")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := userKey{entry.GuildID, entry.UserID}
+	entries := s.data[key]
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].equal(entry) {
+			s.data[key] = append(entries[:i:i], entries[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *MemoryHistorySource) Close() error {
+	return nil
+}
+
+// The history bucket has a nested bucket for the history of each user,
+// holding the entries keyed by their sequence number
+var bucketHistory = []byte("history")
+
+// historyBucketName returns the name of the nested bucket of the history
+// of the user in the guild
+func historyBucketName(guildID, userID string) []byte {
+	return []byte(string(userScopeBucketName(guildID)) + ":" + userID)
+}
+
+type BoltHistorySource struct {
+	logger *logrus.Entry
+	db     *bolt.DB
+}
+
+func createHistoryBucket(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketHistory)
+		return err
+	})
+}
+
+func NewBoltHistorySource(logger *logrus.Logger, db *bolt.DB) (*BoltHistorySource, error) {
+	// Make sure the history bucket exist
+	if err := createHistoryBucket(db); err != nil {
+		return nil, err
+	}
+
+	// Store the logger as an Entry, adding the module to all log calls
+	loggerEntry := logger.WithField("module", "boltHistorySource")
+
+	return &BoltHistorySource{
+		db:     db,
+		logger: loggerEntry,
+	}, nil
+}
+
+func (s *BoltHistorySource) mustGetBucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		s.logger.WithField("name", name).Panic("Bucket not found")
+	}
+	return bucket
+}
+
+func (s *BoltHistorySource) Append(entry *HistoryEntry) error {
+	if entry == nil {
+		return errors.New("Entry can not be nil")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		name := historyBucketName(entry.GuildID, entry.UserID)
+		bucket, err := s.mustGetBucket(tx, bucketHistory).CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		// Big endian sequence numbers keep the entries in the order
+		// they were appended
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, data)
+	})
+}
+
+func (s *BoltHistorySource) Get(guildID, userID string) ([]*HistoryEntry, error) {
+	history := make([]*HistoryEntry, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := s.mustGetBucket(tx, bucketHistory).Bucket(historyBucketName(guildID, userID))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			entry := &HistoryEntry{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+			history = append(history, entry)
+			return nil
+		})
+	})
+	return history, err
+}
+
+func (s *BoltHistorySource) Remove(entry *HistoryEntry) error {
+	if entry == nil {
+		return errors.New("Entry can not be nil")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		name := historyBucketName(entry.GuildID, entry.UserID)
+		bucket := s.mustGetBucket(tx, bucketHistory).Bucket(name)
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			stored := &HistoryEntry{}
+			if err := json.Unmarshal(v, stored); err != nil {
+				return err
+			}
+			if stored.equal(entry) {
+				return cursor.Delete()
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the underlying bolt db. The db is shared with the other
+// bolt sources, closing it more than once is safe.
+func (s *BoltHistorySource) Close() error {
+	return s.db.Close()
+}
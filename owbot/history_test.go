@@ -0,0 +1,119 @@
+package owbot_test
+
+import (
+	"github.com/pkg/errors"
+	"github.com/verath/owbot-bot/owbot"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testHistorySource(t *testing.T, source owbot.HistorySource) {
+	defer source.Close()
+
+	history, err := source.Get("guild", "1")
+	if err != nil {
+		t.Fatalf("Get returned error: %+v", err)
+	}
+	if history == nil || len(history) != 0 {
+		t.Errorf("Get of missing history = %+v, want empty", history)
+	}
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	entries := []*owbot.HistoryEntry{
+		{GuildID: "guild", UserID: "1", Label: "main", NewBattleTag: "first#1234", ChangedBy: "2", Time: now},
+		{GuildID: "guild", UserID: "1", Label: "main", OldBattleTag: "first#1234", NewBattleTag: "second#1234",
+			ChangedBy: "1", Time: now.Add(time.Minute)},
+		{GuildID: "guild", UserID: "1", Label: "main", OldBattleTag: "second#1234", ChangedBy: "1",
+			Time: now.Add(2 * time.Minute)},
+	}
+	// Entries of other users and scopes must not be mixed in
+	others := []*owbot.HistoryEntry{
+		{GuildID: owbot.GlobalScope, UserID: "1", Label: "main", NewBattleTag: "global#1234", ChangedBy: "1", Time: now},
+		{GuildID: "guild", UserID: "2", Label: "main", NewBattleTag: "other#1234", ChangedBy: "2", Time: now},
+	}
+	for i, entry := range entries {
+		if err := source.Append(entry); err != nil {
+			t.Fatalf("Append returned error: %+v", err)
+		}
+		if i < len(others) {
+			if err := source.Append(others[i]); err != nil {
+				t.Fatalf("Append returned error: %+v", err)
+			}
+		}
+	}
+	history, err = source.Get("guild", "1")
+	if err != nil {
+		t.Fatalf("Get returned error: %+v", err)
+	}
+	if !reflect.DeepEqual(history, entries) {
+		t.Errorf("Get = %+v, want %+v", history, entries)
+	}
+	history, err = source.Get(owbot.GlobalScope, "1")
+	if err != nil {
+		t.Fatalf("Get returned error: %+v", err)
+	}
+	if !reflect.DeepEqual(history, others[:1]) {
+		t.Errorf("Get of global history = %+v, want %+v", history, others[:1])
+	}
+
+	// Entries are removed by their value, not by their identity
+	removed := *entries[1]
+	removed.Time = removed.Time.In(time.FixedZone("test", 3600))
+	if err := source.Remove(&removed); err != nil {
+		t.Fatalf("Remove returned error: %+v", err)
+	}
+	missing := *entries[1]
+	missing.ChangedBy = "3"
+	if err := source.Remove(&missing); err != nil {
+		t.Fatalf("Remove of missing entry returned error: %+v", err)
+	}
+	history, err = source.Get("guild", "1")
+	if err != nil {
+		t.Fatalf("Get returned error: %+v", err)
+	}
+	want := []*owbot.HistoryEntry{entries[0], entries[2]}
+	if !reflect.DeepEqual(history, want) {
+		t.Errorf("Get after Remove = %+v, want %+v", history, want)
+	}
+}
+
+func TestStoreChangesRollback(t *testing.T) {
+	source := owbot.NewMemoryHistorySource()
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	kept := &owbot.HistoryEntry{GuildID: "guild", UserID: "1", Label: "main", NewBattleTag: "first#1234",
+		ChangedBy: "1", Time: now}
+	if err := owbot.StoreChanges(source, []*owbot.HistoryEntry{kept}, func() error { return nil }); err != nil {
+		t.Fatalf("StoreChanges returned error: %+v", err)
+	}
+	changes := []*owbot.HistoryEntry{
+		{GuildID: "guild", UserID: "1", Label: "main", OldBattleTag: "first#1234", NewBattleTag: "second#1234",
+			ChangedBy: "1", Time: now.Add(time.Minute)},
+		{GuildID: "guild", UserID: "1", Label: "alt", NewBattleTag: "alt#1234", ChangedBy: "1", Time: now.Add(time.Minute)},
+	}
+	storeErr := errors.New("store failed")
+	if err := owbot.StoreChanges(source, changes, func() error { return storeErr }); err != storeErr {
+		t.Errorf("StoreChanges returned %v, want %v", err, storeErr)
+	}
+	history, err := source.Get("guild", "1")
+	if err != nil {
+		t.Fatalf("Get returned error: %+v", err)
+	}
+	if want := []*owbot.HistoryEntry{kept}; !reflect.DeepEqual(history, want) {
+		t.Errorf("Get after failed store = %+v, want %+v", history, want)
+	}
+}
+
+func TestMemoryHistorySource(t *testing.T) {
+	testHistorySource(t, owbot.NewMemoryHistorySource())
+}
+
+func TestBoltHistorySource(t *testing.T) {
+	db, closeDB := openTestDB(t)
+	defer closeDB()
+	source, err := owbot.NewBoltHistorySource(newTestLogger(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHistorySource(t, source)
+}
@@ -7,7 +7,10 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -16,15 +19,27 @@ import (
 const (
 	// Longest amount of time a command is processed until given up on
 	commandTimeout = 15 * time.Second
+
+	// The number of most played heroes to include in the profile
+	profileTopHeroes = 3
+
+	// Stats older than this are shown with a notice of their age
+	staleStatsNoticeAge = 10 * time.Minute
+
+	// The number of most recent changes shown by the history command
+	historyShownEntries = 10
 )
 
 type invalidBattleTagData struct {
 	MentionID string
 	BattleTag string
+	// The console platform of the BattleTag, empty for PC
+	Platform owapi.Platform
 }
 
 var tmplInvalidBattleTag = template.Must(template.New("InvalidBattleTag").
-	Parse(`<@{{ .MentionID }}>: "{{ .BattleTag }}" is not a valid BattleTag`))
+	Parse(`<@{{ .MentionID }}>: "{{ .BattleTag }}" is not a valid ` +
+		`{{ if .Platform }}{{ .Platform }} name{{ else }}BattleTag{{ end }}`))
 
 type cannotOverrideOwnerData struct {
 	MentionID string
@@ -40,52 +55,418 @@ type unknownDiscordUserData struct {
 var tmplUnknownDiscordUser = template.Must(template.New("UnknownDiscordUser").
 	Parse(`No BattleTag for <@{{ .MentionID }}>, use "!ow set <@{{ .MentionID }}> <BattleTag>" to set one`))
 
+type unknownAccountData struct {
+	MentionID string
+	Label     string
+}
+
+var tmplUnknownAccount = template.Must(template.New("UnknownAccount").
+	Parse(`<@{{ .MentionID }}> has no account "{{ .Label }}", use "!ow accounts <@{{ .MentionID }}>" to list the accounts`))
+
+type invalidLabelData struct {
+	MentionID string
+	Label     string
+}
+
+var tmplInvalidLabel = template.Must(template.New("InvalidLabel").
+	Parse(`<@{{ .MentionID }}>: "{{ .Label }}" is not a valid account label, ` +
+		`use up to 16 letters, digits, "-" or "_" that are not a region, platform or mode`))
+
 type fetchErrorData struct {
 	BattleTag string
+	// The mode stats were requested for, empty if no mode (or
+	// any mode) was requested
+	Mode   owapi.Mode
+	Region owapi.Region
+	// The console platform of the player, empty for PC
+	Platform owapi.Platform
+}
+
+// newFetchErrorData returns the data of the templates for errors
+// fetching stats of the player.
+func newFetchErrorData(player *owapi.Player, mode owapi.Mode) fetchErrorData {
+	data := fetchErrorData{BattleTag: player.BattleTag, Mode: mode, Region: player.Region}
+	if player.Platform != owapi.PlatformPC {
+		data.Platform = player.Platform
+	}
+	return data
 }
 
 var tmplFetchError = template.Must(template.New("FetchError").
-	Parse(`Unable to fetch competitive stats for "{{ .BattleTag }}"`))
+	Parse(`Unable to fetch {{ with .Mode }}{{ . }} {{ end }}stats for "{{ .BattleTag }}"`))
+
+var tmplPlayerNotFound = template.Must(template.New("PlayerNotFound").
+	Parse(`Could not find "{{ .BattleTag }}"{{ with .Platform }} on {{ . }}{{ end }}. ` +
+		`{{ if .Platform }}Check the spelling of the name` +
+		`{{ else }}BattleTags are case sensitive, check the spelling and the number after the "#". ` +
+		`For console players, add the platform (psn or xbl){{ end }}`))
+
+var tmplPrivateProfile = template.Must(template.New("PrivateProfile").
+	Parse(`The career profile of "{{ .BattleTag }}" is private. Stats can be shown once the profile ` +
+		`is made public, in the Overwatch options under Social > Career Profile Visibility`))
+
+var tmplNoStats = template.Must(template.New("NoStats").
+	Parse(`No {{ with .Mode }}{{ . }} {{ end }}stats found for "{{ .BattleTag }}"{{ with .Region }} in {{ . }}{{ end }}. ` +
+		`{{ if .Region }}Try without a region, to use the region with the most games played` +
+		`{{ else }}Stats show up after the player has finished a few games{{ end }}`))
+
+var tmplRateLimited = template.Must(template.New("RateLimited").
+	Parse(`Too many stats lookups right now, please try again in a minute`))
+
+var tmplUpstreamUnavailable = template.Must(template.New("UpstreamUnavailable").
+	Parse(`The Overwatch stats service is not responding right now, please try again in a few minutes`))
+
+type battleTagRemovedData struct {
+	MentionID string
+	// The BattleTags of all the accounts removed
+	BattleTags []string
+	// True if the global BattleTags were removed
+	Global bool
+	// The account that became the primary account, if the primary
+	// account was removed
+	NewPrimary *Account
+}
+
+var tmplBattleTagRemoved = template.Must(template.New("BattleTagRemoved").
+	Parse(`{{ if .Global }}Global {{ end }}BattleTag{{ if gt (len .BattleTags) 1 }}s{{ end }} ` +
+		`{{ range $i, $t := .BattleTags }}{{ if $i }}, {{ end }}"{{ $t }}"{{ end }} removed for <@{{ .MentionID }}>` +
+		`{{ with .NewPrimary }}. Primary account is now "{{ .Label }}" ({{ .BattleTag }}){{ end }}`))
 
 type battleTagUpdatedData struct {
 	MentionID string
-	BattleTag string
+	Account
+	// True if the BattleTag was set globally, rather than for a server
+	Global bool
 }
 
 var tmplBattleTagUpdated = template.Must(template.New("BattleTagUpdated").
-	Parse(`BattleTag for <@{{ .MentionID }}> is now "{{ .BattleTag }}"`))
+	Parse(`{{ if .Global }}Global {{ end }}BattleTag for <@{{ .MentionID }}> is now "{{ .BattleTag }}"` +
+		`{{ with .Platform }} ({{ . }}){{ end }} on account "{{ .Label }}"` +
+		`{{ with .Region }}, preferring region {{ . }}{{ end }}`))
+
+type primaryUpdatedData struct {
+	MentionID string
+	Account
+}
+
+var tmplPrimaryUpdated = template.Must(template.New("PrimaryUpdated").
+	Parse(`Primary account of <@{{ .MentionID }}> is now "{{ .Label }}" ({{ .BattleTag }})`))
+
+type userAccountsData struct {
+	MentionID string
+	*User
+}
+
+var tmplUserAccounts = template.Must(template.
+	New("UserAccounts").
+	Parse(strings.TrimSpace(`
+Accounts of <@{{ .MentionID }}>{{ if not .GuildID }} (global){{ end }}:
+{{- range .Accounts }}
+- **{{ .Label }}:** {{ .BattleTag }}{{ if .Verified }} ✅{{ end }}{{ with .Platform }} ({{ . }}){{ end }}{{ with .Region }}, {{ . }}{{ end }}
+{{- if eq .Label $.Primary }} *(primary)*{{ end }}
+{{- end }}
+`)))
 
 var tmplOverwatchProfileFuncs = template.FuncMap{
-	"LevelPrestige": func(prestige, level int) int {
-		return prestige*100 + level
-	},
+	"LevelPrestige": levelPrestige,
+	"Tier":          tierForRank,
+	"FormatAge":     formatAge,
+}
+
+// levelPrestige returns the level of a player, including the levels
+// of the prestige.
+func levelPrestige(prestige, level int) int {
+	return prestige*100 + level
+}
+
+// formatAge formats a duration coarsely, as the largest whole unit of
+// days, hours, minutes or seconds. E.g. "2h" or "15m".
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
+
+type outputUpdatedData struct {
+	MentionID string
+	Format    OutputFormat
+	// Set if the output of the guild, rather than of the user, was updated
+	Guild bool
+}
+
+var tmplOutputUpdated = template.Must(template.New("OutputUpdated").
+	Parse(`{{ if .Guild }}Default output of this server{{ else }}Output for <@{{ .MentionID }}>{{ end }} ` +
+		`is now {{ if eq .Format "text" }}plain text{{ else }}embeds{{ end }}`))
+
+// tmplChange is the shared template describing a HistoryEntry
+const tmplChange = `{{ define "Change" -}}
+{{ if .Imported }}An import{{ else }}<@{{ .ChangedBy }}>{{ end }} {{ if not .OldBattleTag }}set account "{{ .Label }}" of <@{{ .UserID }}> to "{{ .NewBattleTag }}"` +
+	`{{ else if not .NewBattleTag }}removed account "{{ .Label }}" ("{{ .OldBattleTag }}") of <@{{ .UserID }}>` +
+	`{{ else }}changed account "{{ .Label }}" of <@{{ .UserID }}> from "{{ .OldBattleTag }}" to "{{ .NewBattleTag }}"{{ end }}` +
+	`{{ if not .GuildID }} (global){{ end }}
+{{- end }}`
+
+var tmplModLogChange = template.Must(template.New("ModLogChange").
+	Parse(`{{ template "Change" . }}` + tmplChange))
+
+type userHistoryData struct {
+	MentionID string
+	// The most recent entries, oldest first
+	Entries []*HistoryEntry
+	// The number of older entries not included
+	Omitted int
+}
+
+var tmplUserHistory = template.Must(template.
+	New("UserHistory").
+	Parse(strings.TrimSpace(`
+{{ if .Entries -}}
+BattleTag history of <@{{ .MentionID }}>:
+{{- with .Omitted }}
+*{{ . }} older changes not shown*
+{{- end }}
+{{- range .Entries }}
+- {{ .Time.UTC.Format "2006-01-02 15:04 MST" }}: {{ template "Change" . }}
+{{- end }}
+{{- else -}}
+No BattleTag changes recorded for <@{{ .MentionID }}>
+{{- end }}
+`) + tmplChange))
+
+type modLogUpdatedData struct {
+	// The moderation log channel, empty if it was disabled
+	ChannelID string
+}
+
+var tmplModLogUpdated = template.Must(template.New("ModLogUpdated").
+	Parse(`{{ with .ChannelID }}Changes of BattleTags in this server are now posted to <#{{ . }}>` +
+		`{{ else }}Changes of BattleTags in this server are no longer posted{{ end }}`))
+
+type whoisMatch struct {
+	UserID string
+	// The label of the account with the BattleTag
+	Label string
+	// Set if the account is of the global user
+	Global bool
+}
+
+type whoisData struct {
+	BattleTag string
+	Matches   []whoisMatch
+}
+
+var tmplWhois = template.Must(template.
+	New("Whois").
+	Parse(strings.TrimSpace(`
+{{ if .Matches -}}
+"{{ .BattleTag }}" is linked to:
+{{- range .Matches }}
+- <@{{ .UserID }}>, account "{{ .Label }}"{{ if .Global }} (global){{ end }}
+{{- end }}
+{{- else -}}
+"{{ .BattleTag }}" is not linked to anyone in this server
+{{- end }}
+`)))
+
+type privacyUpdatedData struct {
+	MentionID     string
+	HideFromWhois bool
+}
+
+var tmplPrivacyUpdated = template.Must(template.New("PrivacyUpdated").
+	Parse(`<@{{ .MentionID }}>: Your BattleTags are now {{ if .HideFromWhois }}hidden from{{ else }}shown by{{ end }} "!ow whois"`))
+
+type verifyChallengeData struct {
+	MentionID string
+	*VerifyChallenge
+	// The number of minutes the challenge can be completed for
+	Minutes int
+}
+
+var tmplVerifyChallenge = template.Must(template.New("VerifyChallenge").
+	Parse(`<@{{ .MentionID }}>: To verify that "{{ .Account.BattleTag }}" is yours, change its profile icon ` +
+		`in Overwatch to "{{ .Target.Name }}", then type "!ow verify" again within {{ .Minutes }} minutes. ` +
+		`It can take a few minutes, and leaving the game, before the new icon shows up`))
+
+type verifyData struct {
+	MentionID string
+	Account
+	// The name of the target icon of the challenge, if any
+	TargetName string
+}
+
+var tmplAccountVerified = template.Must(template.New("AccountVerified").
+	Parse(`<@{{ .MentionID }}>: Account "{{ .Label }}" ({{ .BattleTag }}) is now verified ✅, ` +
+		`and can only be changed by you`))
+
+var tmplAlreadyVerified = template.Must(template.New("AlreadyVerified").
+	Parse(`<@{{ .MentionID }}>: Account "{{ .Label }}" ({{ .BattleTag }}) is already verified ✅`))
+
+var tmplVerifyNotUpdated = template.Must(template.New("VerifyNotUpdated").
+	Parse(`<@{{ .MentionID }}>: The profile of "{{ .BattleTag }}" has not been updated yet, ` +
+		`type "!ow verify" again in a few minutes`))
+
+var tmplVerifyNotCompleted = template.Must(template.New("VerifyNotCompleted").
+	Parse(`<@{{ .MentionID }}>: The profile icon of "{{ .BattleTag }}" is not "{{ .TargetName }}" yet, ` +
+		`change it to "{{ .TargetName }}", then type "!ow verify" again`))
+
+var tmplVerifyExpired = template.Must(template.New("VerifyExpired").
+	Parse(`<@{{ .MentionID }}>: The verification of "{{ .BattleTag }}" has expired, ` +
+		`type "!ow verify" to start over`))
+
+var tmplVerifyNoAvatar = template.Must(template.New("VerifyNoAvatar").
+	Parse(`Sorry, but the profile icon of "{{ .BattleTag }}" could not be found, so it can not be verified`))
+
+type missingPermissionData struct {
+	MentionID string
+	// The name of the permission that is missing
+	Permission string
+}
+
+var tmplMissingPermission = template.Must(template.New("MissingPermission").
+	Parse(`<@{{ .MentionID }}>: This requires the {{ .Permission }} permission`))
+
+type noHeroStatsData struct {
+	BattleTag string
+	Hero      string
+	Mode      owapi.Mode
+}
+
+var tmplNoHeroStats = template.Must(template.New("NoHeroStats").
+	Parse(`No {{ .Mode }} stats for hero "{{ .Hero }}" found for "{{ .BattleTag }}"`))
+
+type overwatchProfileData struct {
+	*owapi.UserStats
+	// The label of the linked account the stats are for, empty if
+	// the player was given by BattleTag
+	Account string
+	// Set if the linked account is verified
+	Verified bool
+	// Set if competitive stats were requested, but the player had
+	// none so quick play stats are shown instead
+	CompetitiveFallback bool
+	// The most played heroes, may be empty
+	TopHeroes []*owapi.HeroStats
+	// The age of the stats if they are old enough that the user
+	// should be told, otherwise 0
+	StatsAge time.Duration
 }
 
 var tmplOverwatchProfile = template.Must(template.
 	New("OverwatchProfile").
 	Funcs(tmplOverwatchProfileFuncs).
 	Parse(strings.TrimSpace(`
-__**{{ .BattleTag }} (Competitive)**__
+{{ if .CompetitiveFallback -}}
+*No competitive stats found, showing Quick Play stats instead*
+{{ end -}}
+__**{{ .BattleTag }}{{ if .Verified }} ✅{{ end }} ({{ .Mode }}{{ with .Region }}, {{ . }}{{ end }})**__
+{{ with .Account }}**Account:** {{ . }}
+{{ end -}}
 **Level:** {{ LevelPrestige .OverallStats.Prestige .OverallStats.Level }}
-**Rank:** {{ .OverallStats.CompRank }}
+{{ if eq .Mode "competitive" -}}
+{{ if and .OverallStats.CompRank (not .PlacedRoles) -}}
+**Rank:** {{ template "Rank" .OverallStats.CompRank }}
+{{ else -}}
+{{ range .Roles -}}
+**{{ .Role }}:** {{ if .Placed }}{{ template "Rank" .Rank }}{{ else }}Not placed{{ end }}
+{{ end -}}
+{{ end -}}
+{{ end -}}
 **K/D:** {{ .GameStats.Eliminations -}} / {{- .GameStats.Deaths }}  ({{ .GameStats.KPD }} KPD)
 **Win Rate:** {{ printf "%.2f" .OverallStats.WinRate }}%
 **Matches W/L:** {{ .OverallStats.Wins -}} / {{- .OverallStats.Losses }} ({{ .OverallStats.Games }} total)
 **Medals G/S/B:** {{ .GameStats.MedalsGold -}} / {{- .GameStats.MedalsSilver -}} / {{- .GameStats.MedalsBronze }} ({{ .GameStats.Medals }} total)
 **Time Played:** {{ .GameStats.TimePlayed }} hours
+{{- with .TopHeroes }}
+**Top Heroes:**
+{{- range . }}
+- **{{ .Name }}** - {{ printf "%.1f" .TimePlayed }} hours, {{ printf "%.2f" .WinRate }}% win rate
+{{- end }}
+{{- end }}
+{{- with .StatsAge }}
+*Data from {{ FormatAge . }} ago*
+{{- end }}
+{{- define "Rank" }}{{ . }}{{ with Tier . }} ({{ .Emoji }} {{ .Name }}){{ end }}{{ end }}
 `)))
 
+var tmplAchievementsFetchError = template.Must(template.New("AchievementsFetchError").
+	Parse(`Unable to fetch achievements for "{{ .BattleTag }}"`))
+
+type overwatchAchievementsData struct {
+	*owapi.UserAchievements
+	// Achievements unlocked since the achievements were last shown
+	NewlyUnlocked []*owapi.Achievement
+}
+
+var tmplOverwatchAchievements = template.Must(template.
+	New("OverwatchAchievements").
+	Parse(strings.TrimSpace(`
+__**{{ .BattleTag }} (Achievements)**__
+{{- range .Categories }}
+**{{ .Title }}:** {{ .Unlocked -}} / {{- .Total }} ({{ printf "%.0f" .Completion }}%)
+{{- end }}
+{{- with .NewlyUnlocked }}
+**Newly Unlocked:** {{ range $i, $a := . }}{{ if $i }}, {{ end }}{{ $a.Title }}{{ end }}
+{{- end }}
+`)))
+
+type overwatchHeroData struct {
+	BattleTag string
+	Mode      owapi.Mode
+	*owapi.HeroStats
+}
+
+var tmplOverwatchHero = template.Must(template.
+	New("OverwatchHero").
+	Parse(strings.TrimSpace(`
+__**{{ .BattleTag }}: {{ .Name }} ({{ .Mode }})**__
+**Time Played:** {{ printf "%.1f" .TimePlayed }} hours
+**Win Rate:** {{ printf "%.2f" .WinRate }}%
+**Eliminations / 10 min:** {{ printf "%.2f" .EliminationsPer10Min }}
+`)))
+
+var msgServerOnly = `Sorry, but that only works in a server channel.`
+
+var msgVerifyDisabled = `Sorry, but verifying accounts is not enabled for this bot.`
+
+var msgMembersUnavailable = `Sorry, but I could not look up the members of this server right now, please try again in a minute.`
+
 // Not using template here as the strings do not update
 var msgUsage = fmt.Sprintf(strings.TrimSpace(`
 __**ow-bot (%s)**__
-- **!ow profile <DiscordUser>** - Shows Overwatch profile summary
-- **!ow profile <BattleTag>** - Shows Overwatch profile summary
-- **!ow set <BattleTag>** - Sets your BattleTag
-- **!ow set <DiscordUser> <BattleTag>** - Sets the BattleTag of a user
+- **!ow profile [<DiscordUser>] [<Label>] [<Mode>] [<Region>]** - Shows Overwatch profile summary
+- **!ow profile <BattleTag> [<Mode>] [<Region>] [<Platform>]** - Shows Overwatch profile summary
+- **!ow hero <Hero> [<DiscordUser>|<BattleTag>] [<Mode>] [<Region>]** - Shows stats for a hero
+- **!ow achievements [<DiscordUser>|<BattleTag>] [<Region>]** - Shows achievement completion
+- **!ow set <BattleTag> [as <Label>] [<Region>] [<Platform>] [global]** - Sets your BattleTag in this server, or your default for all servers
+- **!ow set <DiscordUser> <BattleTag> [as <Label>] [<Region>] [<Platform>]** - Sets the BattleTag of a user in this server
+- **!ow accounts [<DiscordUser>] [global]** - Lists your accounts, or the accounts of a user
+- **!ow primary <Label> [global]** - Sets the account used when no account is given
+- **!ow unset [<DiscordUser>] [<Label>] [global]** - Removes your BattleTags, the BattleTags of a user, or only the account with the label
+- **!ow output <Output> [server]** - Sets your output format, or the default of the server
+- **!ow history [<DiscordUser>]** - Shows the changes of your BattleTags, or the BattleTags of a user
+- **!ow modlog <#Channel>|off** - Posts all changes of BattleTags in the server to a channel
+- **!ow whois <BattleTag>** - Shows the users of this server the BattleTag is linked to
+- **!ow privacy <Privacy>** - Sets whether your BattleTags are shown by whois
+- **!ow verify [<Label>] [global]** - Verifies that an account is yours, so that only you can change it
 - **!ow help** - Shows this message
 
 **<DiscordUser>**: A Discord user mention (@username)
-**<BattleTag>**: A Battle.net BattleTag (username#12345)`),
+**<BattleTag>**: A Battle.net BattleTag (username#12345), or a PSN/XBL name
+**<Mode>**: Either "comp" (default) or "qp"
+**<Region>**: One of "us", "eu" or "kr". Defaults to the region with the most games played
+**<Platform>**: One of "pc" (default), "psn" or "xbl"
+**<Hero>**: A hero name (e.g. soldier76)
+**<Label>**: The label of one of the accounts of a user (e.g. alt). Defaults to the primary account
+**<Output>**: Either "embed" (default) or "text"
+**<Privacy>**: Either "public" (default) or "private"`),
 	gitHubURL)
 
 var msgVersion = fmt.Sprintf(strings.TrimSpace(`
@@ -97,10 +478,79 @@ var msgUnknownCommand = `Sorry, but I don't know what you want. Type "!ow help"
 // A BattleTag is 3-12 characters, followed by "#", followed by digits
 var regexBattleTag = regexp.MustCompile(`^\w{3,12}#\d+$`)
 
+// A PSN or XBL name is 3-16 characters, letters, digits, "-" or "_"
+var regexConsoleName = regexp.MustCompile(`^[\w-]{3,16}$`)
+
+// An account label is 1-16 characters, letters, digits, "-" or "_"
+var regexLabel = regexp.MustCompile(`^[\w-]{1,16}$`)
+
+// A discord channel mention is "<#CHANNEL_SNOWFLAKE_ID>"
+var regexChannelMention = regexp.MustCompile(`^<#(\d+)>$`)
+
 // A discord mention is either "<@USER_SNOWFLAKE_ID>" or "<@!USER_SNOWFLAKE_ID>"
 // https://discordapp.com/developers/docs/resources/channel#message-formatting
 var regexMention = regexp.MustCompile(`^<@!?(\d+)>$`)
 
+// argGlobal is the argument for using the global BattleTag of a user,
+// rather than the one of the server
+const argGlobal = "global"
+
+// argModes maps the mode arguments of the profile command to their
+// owapi mode
+var argModes = map[string]owapi.Mode{
+	"comp":        owapi.ModeCompetitive,
+	"competitive": owapi.ModeCompetitive,
+	"qp":          owapi.ModeQuickplay,
+	"quickplay":   owapi.ModeQuickplay,
+}
+
+// argRegions maps the region arguments to their owapi region
+var argRegions = map[string]owapi.Region{
+	"us": owapi.RegionUS,
+	"eu": owapi.RegionEU,
+	"kr": owapi.RegionKR,
+}
+
+// argOutputFormats maps the output arguments to their output format
+var argOutputFormats = map[string]OutputFormat{
+	"embed": OutputEmbed,
+	"text":  OutputText,
+}
+
+// argPrivacy maps the privacy arguments to whether the user is hidden
+// from the whois command
+var argPrivacy = map[string]bool{
+	"public":  false,
+	"private": true,
+}
+
+// argPlatforms maps the platform arguments to their owapi platform
+var argPlatforms = map[string]owapi.Platform{
+	"pc":  owapi.PlatformPC,
+	"psn": owapi.PlatformPSN,
+	"xbl": owapi.PlatformXBL,
+}
+
+// fetchErrorTemplate returns the template explaining err, an error fetching
+// stats, to the user. Returns defaultTmpl if there is no template for the
+// specific error.
+func fetchErrorTemplate(err error, defaultTmpl *template.Template) *template.Template {
+	switch errors.Cause(err) {
+	case owapi.ErrPlayerNotFound:
+		return tmplPlayerNotFound
+	case owapi.ErrPrivateProfile:
+		return tmplPrivateProfile
+	case owapi.ErrNoCompetitiveData, owapi.ErrNoStatsForMode:
+		return tmplNoStats
+	case owapi.ErrRateLimited:
+		return tmplRateLimited
+	case owapi.ErrUpstreamUnavailable, context.DeadlineExceeded:
+		return tmplUpstreamUnavailable
+	default:
+		return defaultTmpl
+	}
+}
+
 func (bot *Bot) sendMessage(ctx context.Context, channelID string, msg string) error {
 	_, err := bot.discordSession.ChannelMessageSend(channelID, msg)
 	if err != nil {
@@ -110,11 +560,20 @@ func (bot *Bot) sendMessage(ctx context.Context, channelID string, msg string) e
 	return nil
 }
 
+func (bot *Bot) sendEmbed(ctx context.Context, channelID string, embed *discordgo.MessageEmbed) error {
+	_, err := bot.discordSession.ChannelMessageSendEmbed(channelID, embed)
+	if err != nil {
+		return errors.Wrapf(err, "Failed sending embed '%s' to channelID '%s'", embed.Title, channelID)
+	}
+	bot.logger.WithFields(logrus.Fields{"channelID": channelID, "embed": embed.Title}).Debug("Sent embed")
+	return nil
+}
+
 func (bot *Bot) sendTemplateMessage(ctx context.Context, channelID string, template *template.Template, data interface{}) error {
 	var msg bytes.Buffer
 	err := template.Execute(&msg, data)
 	if err != nil {
-		return errors.Wrapf(err, "Failed executing template: %s", template.Name)
+		return errors.Wrapf(err, "Failed executing template: %s", template.Name())
 	}
 	return bot.sendMessage(ctx, channelID, msg.String())
 }
@@ -138,10 +597,32 @@ func (bot *Bot) handleDiscordMessage(chanMessage *discordgo.Message) error {
 	switch args[1] {
 	case "set":
 		return bot.setBattleTag(ctx, args[2:], chanMessage)
+	case "unset":
+		return bot.unsetBattleTag(ctx, args[2:], chanMessage)
+	case "accounts":
+		return bot.showAccounts(ctx, args[2:], chanMessage)
+	case "primary":
+		return bot.setPrimary(ctx, args[2:], chanMessage)
 	case "help":
 		return bot.showUsage(ctx, args[2:], chanMessage)
 	case "profile":
 		return bot.showProfile(ctx, args[2:], chanMessage)
+	case "hero":
+		return bot.showHero(ctx, args[2:], chanMessage)
+	case "achievements":
+		return bot.showAchievements(ctx, args[2:], chanMessage)
+	case "output":
+		return bot.setOutput(ctx, args[2:], chanMessage)
+	case "history":
+		return bot.showHistory(ctx, args[2:], chanMessage)
+	case "modlog":
+		return bot.setModLog(ctx, args[2:], chanMessage)
+	case "whois":
+		return bot.showWhois(ctx, args[2:], chanMessage)
+	case "privacy":
+		return bot.setPrivacy(ctx, args[2:], chanMessage)
+	case "verify":
+		return bot.verifyAccount(ctx, args[2:], chanMessage)
 	case "version":
 		return bot.showVersion(ctx, args[2:], chanMessage)
 	default:
@@ -158,66 +639,303 @@ func (bot *Bot) showProfile(ctx context.Context, args []string, chanMessage *dis
 		return errors.Wrap(err, "failed sending typing status to channel")
 	}
 
-	var battleTag string
-	if len(args) == 1 && regexBattleTag.MatchString(args[0]) {
-		// !ow profile <BattleTag>
-		battleTag = args[0]
+	opts, args := parseLookupOptions(args)
+	player, account, err := bot.lookupPlayer(ctx, args, opts, chanMessage)
+	if err != nil || player == nil {
+		return err
+	}
+
+	mode := opts.mode
+	battleTagFields := bot.logger.WithFields(logrus.Fields{"player": player, "mode": mode})
+	stats, err := bot.statsProvider.GetStats(ctx, *player, mode)
+	fallback := false
+	if errors.Cause(err) == owapi.ErrNoCompetitiveData {
+		// Players that have not played competitive this season are still
+		// likely to have quick play stats, show those instead
+		battleTagFields.Debug("No competitive stats, falling back to quick play")
+		stats, err = bot.statsProvider.GetStats(ctx, *player, owapi.ModeQuickplay)
+		fallback = true
+	}
+	if err != nil {
+		battleTagFields.WithError(err).Warn("Could not get Overwatch stats")
+		data := newFetchErrorData(player, mode)
+		if fallback {
+			// Neither of the modes had stats
+			data.Mode = ""
+		}
+		return bot.sendTemplateMessage(ctx, channelID, fetchErrorTemplate(err, tmplFetchError), data)
+	}
+	battleTagFields.Debug("Successfully got Overwatch stats")
+	data := overwatchProfileData{UserStats: stats, CompetitiveFallback: fallback}
+	if account != nil {
+		data.Account = account.Label
+		// A platform option may look up another player of the same name
+		data.Verified = account.Verified && player.Platform == account.Platform
+	}
+	if age := time.Since(stats.FetchedAt); !stats.FetchedAt.IsZero() && age > staleStatsNoticeAge {
+		data.StatsAge = age
+	}
+
+	// The top heroes are a nice to have, so we show the profile even if
+	// they could not be fetched
+	heroes, err := bot.statsProvider.GetHeroes(ctx, *player, stats.Mode)
+	if err != nil {
+		battleTagFields.WithError(err).Warn("Could not get Overwatch hero stats")
 	} else {
-		var discordID string
-		if len(args) == 0 {
-			// !ow profile
-			discordID = chanMessage.Author.ID
-		} else if len(args) == 1 && regexMention.MatchString(args[0]) {
-			// !ow profile @username
-			matches := regexMention.FindStringSubmatch(args[0])
-			discordID = matches[1]
-		} else {
-			return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+		data.TopHeroes = heroes.Top(profileTopHeroes)
+	}
+	format, err := bot.outputFormat(chanMessage)
+	if err != nil {
+		return err
+	}
+	if format == OutputText {
+		return bot.sendTemplateMessage(ctx, channelID, tmplOverwatchProfile, data)
+	}
+	return bot.sendEmbed(ctx, channelID, profileEmbed(data))
+}
+
+func (bot *Bot) showHero(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	channelID := chanMessage.ChannelID
+	if len(args) == 0 {
+		return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+	}
+
+	if err := bot.discordSession.ChannelTyping(channelID); err != nil {
+		return errors.Wrap(err, "failed sending typing status to channel")
+	}
+
+	hero := args[0]
+	opts, args := parseLookupOptions(args[1:])
+	player, _, err := bot.lookupPlayer(ctx, args, opts, chanMessage)
+	if err != nil || player == nil {
+		return err
+	}
+
+	battleTag := player.BattleTag
+	mode := opts.mode
+	battleTagFields := bot.logger.WithFields(logrus.Fields{"player": player, "mode": mode, "hero": hero})
+	heroes, err := bot.statsProvider.GetHeroes(ctx, *player, mode)
+	fallback := false
+	if errors.Cause(err) == owapi.ErrNoCompetitiveData {
+		battleTagFields.Debug("No competitive hero stats, falling back to quick play")
+		heroes, err = bot.statsProvider.GetHeroes(ctx, *player, owapi.ModeQuickplay)
+		fallback = true
+	}
+	if err != nil {
+		battleTagFields.WithError(err).Warn("Could not get Overwatch hero stats")
+		data := newFetchErrorData(player, mode)
+		if fallback {
+			data.Mode = ""
 		}
+		return bot.sendTemplateMessage(ctx, channelID, fetchErrorTemplate(err, tmplFetchError), data)
+	}
+	heroStats := heroes.Hero(hero)
+	if heroStats == nil {
+		data := noHeroStatsData{BattleTag: battleTag, Hero: hero, Mode: heroes.Mode}
+		return bot.sendTemplateMessage(ctx, channelID, tmplNoHeroStats, data)
+	}
+	battleTagFields.Debug("Successfully got Overwatch hero stats")
+	data := overwatchHeroData{BattleTag: heroes.BattleTag, Mode: heroes.Mode, HeroStats: heroStats}
+	return bot.sendTemplateMessage(ctx, channelID, tmplOverwatchHero, data)
+}
 
-		user, err := bot.userSource.Get(discordID)
-		if err != nil {
-			return errors.Wrapf(err, "Could not get user '%s' from data source", discordID)
+func (bot *Bot) showAchievements(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	channelID := chanMessage.ChannelID
+
+	if err := bot.discordSession.ChannelTyping(channelID); err != nil {
+		return errors.Wrap(err, "failed sending typing status to channel")
+	}
+
+	opts, args := parseLookupOptions(args)
+	player, _, err := bot.lookupPlayer(ctx, args, opts, chanMessage)
+	if err != nil || player == nil {
+		return err
+	}
+
+	battleTag := player.BattleTag
+	battleTagFields := bot.logger.WithField("player", player)
+	achievements, err := bot.statsProvider.GetAchievements(ctx, *player)
+	if err != nil {
+		battleTagFields.WithError(err).Warn("Could not get Overwatch achievements")
+		data := newFetchErrorData(player, "")
+		return bot.sendTemplateMessage(ctx, channelID, fetchErrorTemplate(err, tmplAchievementsFetchError), data)
+	}
+	battleTagFields.Debug("Successfully got Overwatch achievements")
+
+	// Compare the unlocked achievements to the ones we saw the last time,
+	// so that we can show which achievements are newly unlocked
+	prevUnlocked, err := bot.achievementSource.GetUnlocked(battleTag)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get achievements for '%s' from achievement source", battleTag)
+	}
+	seen := make(map[string]bool, len(prevUnlocked))
+	for _, name := range prevUnlocked {
+		seen[name] = true
+	}
+	data := overwatchAchievementsData{UserAchievements: achievements}
+	unlocked := make([]string, 0)
+	for _, achievement := range achievements.Unlocked() {
+		unlocked = append(unlocked, achievement.Name)
+		// Without previously stored achievements, everything would be new
+		if prevUnlocked != nil && !seen[achievement.Name] {
+			data.NewlyUnlocked = append(data.NewlyUnlocked, achievement)
+		}
+	}
+	if err := bot.achievementSource.SaveUnlocked(battleTag, unlocked); err != nil {
+		return errors.Wrapf(err, "Failed saving achievements for '%s' to achievement source", battleTag)
+	}
+	return bot.sendTemplateMessage(ctx, channelID, tmplOverwatchAchievements, data)
+}
+
+// lookupOptions are the optional arguments of the commands looking
+// up stats for a player
+type lookupOptions struct {
+	mode     owapi.Mode
+	region   owapi.Region
+	platform owapi.Platform
+	// Use the global BattleTag of a user, rather than the one of
+	// the server
+	global bool
+}
+
+// parseLookupOptions parses the optional mode, region, platform and
+// global arguments, given in any order at the end of the args. Returns
+// the options and the args with the options removed. The mode defaults
+// to competitive.
+func parseLookupOptions(args []string) (lookupOptions, []string) {
+	opts := lookupOptions{mode: owapi.ModeCompetitive}
+	for len(args) > 0 {
+		arg := strings.ToLower(args[len(args)-1])
+		if arg == argGlobal {
+			opts.global = true
+		} else if mode, ok := argModes[arg]; ok {
+			opts.mode = mode
+		} else if region, ok := argRegions[arg]; ok {
+			opts.region = region
+		} else if platform, ok := argPlatforms[arg]; ok {
+			opts.platform = platform
+		} else {
+			break
 		}
-		if user == nil {
-			data := unknownDiscordUserData{MentionID: discordID}
-			return bot.sendTemplateMessage(ctx, channelID, tmplUnknownDiscordUser, data)
+		args = args[:len(args)-1]
+	}
+	return opts, args
+}
+
+// isValidBattleTag returns true if battleTag is a valid BattleTag, or
+// PSN/XBL name, for the platform.
+func isValidBattleTag(battleTag string, platform owapi.Platform) bool {
+	if platform == owapi.PlatformPSN || platform == owapi.PlatformXBL {
+		return regexConsoleName.MatchString(battleTag)
+	}
+	return regexBattleTag.MatchString(battleTag)
+}
+
+// isValidLabel returns true if label is a valid account label. Labels
+// that could be mistaken for an option are not valid.
+func isValidLabel(label string) bool {
+	if _, ok := argModes[label]; ok {
+		return false
+	}
+	if _, ok := argRegions[label]; ok {
+		return false
+	}
+	if _, ok := argPlatforms[label]; ok {
+		return false
+	}
+	return label != argGlobal && regexLabel.MatchString(label)
+}
+
+// parseAccountLabel parses the optional "as <Label>" arguments of the set
+// command. Returns the lower cased label, or an empty string if no label
+// was given, and the args with the label arguments removed.
+func parseAccountLabel(args []string) (string, []string) {
+	for i := 0; i < len(args)-1; i++ {
+		if strings.ToLower(args[i]) == "as" {
+			label := strings.ToLower(args[i+1])
+			return label, append(args[:i:i], args[i+2:]...)
 		}
-		battleTag = user.BattleTag
+	}
+	return "", args
+}
+
+// lookupPlayer returns the player referred to by the args, which is either
+// empty (the message author), a user mention or a BattleTag. The mention,
+// or the author, may be followed by the label of one of their accounts,
+// otherwise their primary account is used. The region and platform of the
+// options override the ones stored for an account. Also returns the
+// account, nil if a BattleTag was given. If no player could be found, a
+// message is sent to the channel and nil is returned.
+func (bot *Bot) lookupPlayer(ctx context.Context, args []string, opts lookupOptions, chanMessage *discordgo.Message) (*owapi.Player, *Account, error) {
+	channelID := chanMessage.ChannelID
+	if len(args) == 1 && isValidBattleTag(args[0], opts.platform) {
+		// <BattleTag>
+		return &owapi.Player{BattleTag: args[0], Region: opts.region, Platform: opts.platform}, nil, nil
 	}
 
-	battleTagFields := bot.logger.WithField("battleTag", battleTag)
-	stats, err := bot.owAPIClient.GetStats(ctx, battleTag)
+	// No user argument means the author
+	discordID := chanMessage.Author.ID
+	if len(args) > 0 && regexMention.MatchString(args[0]) {
+		// @username
+		matches := regexMention.FindStringSubmatch(args[0])
+		discordID = matches[1]
+		args = args[1:]
+	}
+	var label string
+	if len(args) == 1 && isValidLabel(strings.ToLower(args[0])) {
+		label = strings.ToLower(args[0])
+	} else if len(args) > 0 {
+		return nil, nil, bot.sendMessage(ctx, channelID, msgUnknownCommand)
+	}
+
+	guildID, err := bot.userScope(chanMessage, opts.global)
 	if err != nil {
-		battleTagFields.WithError(err).Warn("Could not get Overwatch stats")
-		data := fetchErrorData{BattleTag: battleTag}
-		return bot.sendTemplateMessage(ctx, channelID, tmplFetchError, data)
-	} else {
-		battleTagFields.Debug("Successfully got Overwatch stats")
-		return bot.sendTemplateMessage(ctx, channelID, tmplOverwatchProfile, stats)
+		return nil, nil, err
+	}
+	user, err := bot.getUser(guildID, discordID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil {
+		data := unknownDiscordUserData{MentionID: discordID}
+		return nil, nil, bot.sendTemplateMessage(ctx, channelID, tmplUnknownDiscordUser, data)
 	}
+	account := user.PrimaryAccount()
+	if label != "" {
+		account = user.Account(label)
+	}
+	if account == nil {
+		data := unknownAccountData{MentionID: discordID, Label: label}
+		return nil, nil, bot.sendTemplateMessage(ctx, channelID, tmplUnknownAccount, data)
+	}
+	player := account.Player()
+	if opts.region != "" {
+		player.Region = opts.region
+	}
+	if opts.platform != "" {
+		player.Platform = opts.platform
+	}
+	return &player, account, nil
 }
 
 func (bot *Bot) setBattleTag(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	// The label, region and platform are optional, and stored with the
+	// account
+	label, args := parseAccountLabel(args)
+	opts, args := parseLookupOptions(args)
 	if len(args) == 0 {
 		return bot.sendMessage(ctx, chanMessage.ChannelID, msgUnknownCommand)
 	}
+	if label != "" && !isValidLabel(label) {
+		data := invalidLabelData{MentionID: chanMessage.Author.ID, Label: label}
+		return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplInvalidLabel, data)
+	}
 
 	var userID string
 	if len(args) >= 2 {
 		// !ow <@user> tag#123
-		userMention := args[0]
+		userID = mentionedUserID(args[0], chanMessage)
 		args = args[1:]
-		if matches := regexMention.FindStringSubmatch(userMention); matches != nil {
-			// To validate the userID, we make sure the id we extracted is
-			// also included in the Mentioned users of the discord message
-			for _, user := range chanMessage.Mentions {
-				if user.ID == matches[1] {
-					userID = matches[1]
-					break
-				}
-			}
-		}
 		if userID == "" {
 			return bot.sendMessage(ctx, chanMessage.ChannelID, msgUnknownCommand)
 		}
@@ -226,39 +944,809 @@ func (bot *Bot) setBattleTag(ctx context.Context, args []string, chanMessage *di
 	}
 
 	// If we get here, we should only have to handle !ow battleTag#123
-	// as the optional user mention is handled above
-	if len(args) > 1 {
+	// as the optional user mention is handled above. Only the user
+	// themselves can set their global BattleTag
+	if len(args) > 1 || (opts.global && userID != chanMessage.Author.ID) {
 		return bot.sendMessage(ctx, chanMessage.ChannelID, msgUnknownCommand)
 	}
 
 	// Make sure the argument is a "valid" battleTag
 	battleTag := args[0]
-	if !regexBattleTag.MatchString(battleTag) {
+	if !isValidBattleTag(battleTag, opts.platform) {
 		data := invalidBattleTagData{MentionID: chanMessage.Author.ID, BattleTag: battleTag}
+		if opts.platform != owapi.PlatformPC {
+			data.Platform = opts.platform
+		}
 		return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplInvalidBattleTag, data)
 	}
 
-	// Only allowed to update a user object if the author of the message
-	// is the owner, or if the user has not been set by the owner yet
-	currUser, err := bot.userSource.Get(userID)
+	guildID, err := bot.userScope(chanMessage, opts.global)
+	if err != nil {
+		return err
+	}
+	currUser, allowed, err := modifiableUser(bot.userSource, guildID, userID, chanMessage.Author.ID)
 	if err != nil {
-		return errors.Wrapf(err, "Could not get userID '%s' from user source", userID)
+		return err
 	}
-	if currUser != nil && currUser.ID != chanMessage.Author.ID && currUser.CreatedBy == currUser.ID {
+	if !allowed {
 		bot.logger.WithFields(logrus.Fields{
-			"currUser": currUser,
+			"userID":   userID,
+			"guildID":  guildID,
 			"authorID": chanMessage.Author.ID,
 		}).Debug("Not allowed to change data set by owner")
 		data := cannotOverrideOwnerData{MentionID: chanMessage.Author.ID}
 		return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplCannotOverrideOwner, data)
 	}
 	// Update the user object and store it
-	user := &User{ID: userID, BattleTag: battleTag, CreatedBy: chanMessage.Author.ID}
+	user := currUser
+	if user == nil {
+		user = &User{ID: userID, GuildID: guildID}
+	}
+	user.CreatedBy = chanMessage.Author.ID
+	if label == "" {
+		// Without a label, the primary account is replaced
+		label = defaultAccountLabel
+		if primary := user.PrimaryAccount(); primary != nil {
+			label = primary.Label
+		}
+	}
+	account := Account{
+		Label:     label,
+		BattleTag: battleTag,
+		Region:    opts.region,
+		Platform:  opts.platform,
+	}
+	change := &HistoryEntry{
+		GuildID:      guildID,
+		UserID:       userID,
+		Label:        label,
+		NewBattleTag: battleTag,
+		ChangedBy:    chanMessage.Author.ID,
+		Time:         time.Now(),
+	}
+	unchanged := false
+	if prev := user.Account(label); prev != nil {
+		change.OldBattleTag = prev.BattleTag
+		// The account is still verified if it is the same player
+		account.Verified = prev.Verified && prev.BattleTag == battleTag && prev.Platform == account.Platform
+		unchanged = *prev == account
+	}
+	user.SetAccount(account)
+	// Setting the same account again changes nothing worth recording,
+	// but the user is still saved as it may now be created by the author
+	var changes []*HistoryEntry
+	if !unchanged {
+		changes = append(changes, change)
+	}
+	err = storeChanges(bot.historySource, changes, func() error {
+		if err := bot.userSource.Save(user); err != nil {
+			return errors.Wrapf(err, "Failed saving user (%+v) to data source", user)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bot.postModLog(ctx, chanMessage, changes)
+	data := battleTagUpdatedData{
+		MentionID: userID,
+		Account:   account,
+		Global:    guildID == GlobalScope,
+	}
+	return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplBattleTagUpdated, data)
+}
+
+func (bot *Bot) showAccounts(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	global := len(args) > 0 && strings.ToLower(args[len(args)-1]) == argGlobal
+	if global {
+		args = args[:len(args)-1]
+	}
+	var userID string
+	switch len(args) {
+	case 0:
+		// !ow accounts
+		userID = chanMessage.Author.ID
+	case 1:
+		// !ow accounts <@user>
+		userID = mentionedUserID(args[0], chanMessage)
+		if userID == "" {
+			return bot.sendMessage(ctx, chanMessage.ChannelID, msgUnknownCommand)
+		}
+	default:
+		return bot.sendMessage(ctx, chanMessage.ChannelID, msgUnknownCommand)
+	}
+
+	guildID, err := bot.userScope(chanMessage, global)
+	if err != nil {
+		return err
+	}
+	user, err := bot.getUser(guildID, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		data := unknownDiscordUserData{MentionID: userID}
+		return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplUnknownDiscordUser, data)
+	}
+	data := userAccountsData{MentionID: userID, User: user}
+	return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplUserAccounts, data)
+}
+
+func (bot *Bot) setPrimary(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	authorID := chanMessage.Author.ID
+	global := len(args) == 2 && strings.ToLower(args[1]) == argGlobal
+	if len(args) != 1 && !global {
+		return bot.sendMessage(ctx, chanMessage.ChannelID, msgUnknownCommand)
+	}
+	label := strings.ToLower(args[0])
+
+	// Only the user themselves can change their primary account, and
+	// only for the scope the accounts are set in
+	guildID, err := bot.userScope(chanMessage, global)
+	if err != nil {
+		return err
+	}
+	user, err := bot.userSource.Get(guildID, authorID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get userID '%s' in guild '%s' from user source", authorID, guildID)
+	}
+	if user == nil {
+		data := unknownDiscordUserData{MentionID: authorID}
+		return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplUnknownDiscordUser, data)
+	}
+	account := user.Account(label)
+	if account == nil {
+		data := unknownAccountData{MentionID: authorID, Label: label}
+		return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplUnknownAccount, data)
+	}
+	user.Primary = account.Label
 	if err := bot.userSource.Save(user); err != nil {
 		return errors.Wrapf(err, "Failed saving user (%+v) to data source", user)
 	}
-	data := battleTagUpdatedData{MentionID: userID, BattleTag: battleTag}
-	return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplBattleTagUpdated, data)
+	data := primaryUpdatedData{MentionID: authorID, Account: *account}
+	return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplPrimaryUpdated, data)
+}
+
+func (bot *Bot) unsetBattleTag(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	// Only the user themselves can remove their global BattleTags
+	global := len(args) > 0 && strings.ToLower(args[len(args)-1]) == argGlobal
+	if global {
+		args = args[:len(args)-1]
+	}
+	userID := chanMessage.Author.ID
+	if len(args) > 0 && !global && regexMention.MatchString(args[0]) {
+		// !ow unset <@user> [<label>]
+		userID = mentionedUserID(args[0], chanMessage)
+		args = args[1:]
+		if userID == "" {
+			return bot.sendMessage(ctx, chanMessage.ChannelID, msgUnknownCommand)
+		}
+	}
+	// Without a label, all accounts of the user are removed
+	var label string
+	switch {
+	case len(args) == 1 && isValidLabel(strings.ToLower(args[0])):
+		label = strings.ToLower(args[0])
+	case len(args) > 0:
+		return bot.sendMessage(ctx, chanMessage.ChannelID, msgUnknownCommand)
+	}
+
+	guildID, err := bot.userScope(chanMessage, global)
+	if err != nil {
+		return err
+	}
+	currUser, err := bot.userSource.Get(guildID, userID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get userID '%s' in guild '%s' from user source", userID, guildID)
+	}
+	if currUser == nil {
+		data := unknownDiscordUserData{MentionID: userID}
+		return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplUnknownDiscordUser, data)
+	}
+	if !canModifyUser(currUser, chanMessage.Author.ID) {
+		bot.logger.WithFields(logrus.Fields{
+			"currUser": currUser,
+			"authorID": chanMessage.Author.ID,
+		}).Debug("Not allowed to remove data set by owner")
+		data := cannotOverrideOwnerData{MentionID: chanMessage.Author.ID}
+		return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplCannotOverrideOwner, data)
+	}
+	removed := currUser.Accounts
+	user := currUser.copy()
+	if label != "" {
+		account := currUser.Account(label)
+		if account == nil {
+			data := unknownAccountData{MentionID: userID, Label: label}
+			return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplUnknownAccount, data)
+		}
+		removed = []Account{*account}
+		user.RemoveAccount(label)
+	}
+	var changes []*HistoryEntry
+	for _, account := range removed {
+		changes = append(changes, &HistoryEntry{
+			GuildID:      guildID,
+			UserID:       userID,
+			Label:        account.Label,
+			OldBattleTag: account.BattleTag,
+			ChangedBy:    chanMessage.Author.ID,
+			Time:         time.Now(),
+		})
+	}
+	err = storeChanges(bot.historySource, changes, func() error {
+		if len(user.Accounts) > 0 {
+			user.CreatedBy = chanMessage.Author.ID
+			if err := bot.userSource.Save(user); err != nil {
+				return errors.Wrapf(err, "Failed saving user (%+v) to data source", user)
+			}
+		} else if err := bot.userSource.Delete(guildID, userID); err != nil {
+			return errors.Wrapf(err, "Failed deleting userID '%s' in guild '%s' from data source", userID, guildID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bot.postModLog(ctx, chanMessage, changes)
+	data := battleTagRemovedData{MentionID: userID, Global: guildID == GlobalScope}
+	for _, account := range removed {
+		data.BattleTags = append(data.BattleTags, account.BattleTag)
+	}
+	if label != "" && len(user.Accounts) > 0 && currUser.Primary == label {
+		data.NewPrimary = user.PrimaryAccount()
+	}
+	return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplBattleTagRemoved, data)
+}
+
+// userScope returns the guild id that users should be stored in, or
+// looked up in, for the message. That is the GlobalScope if global is
+// set or the message was sent in a private channel, otherwise the guild
+// of the channel.
+func (bot *Bot) userScope(chanMessage *discordgo.Message, global bool) (string, error) {
+	if global {
+		return GlobalScope, nil
+	}
+	// Private channels have no guild id, and so use the GlobalScope
+	return bot.channelGuildID(chanMessage.ChannelID)
+}
+
+// getUser returns the user for the guild, falling back to the global
+// user if the user has not been set for the guild. Returns nil if the
+// user is not set for either.
+func (bot *Bot) getUser(guildID, userID string) (*User, error) {
+	user, err := bot.userSource.Get(guildID, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get user '%s' in guild '%s' from data source", userID, guildID)
+	}
+	if user != nil || guildID == GlobalScope {
+		return user, nil
+	}
+	user, err = bot.userSource.Get(GlobalScope, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get global user '%s' from data source", userID)
+	}
+	return user, nil
+}
+
+// mentionedUserID returns the user id of the mention, or an empty string
+// if arg is not a mention of a user mentioned in the message.
+func mentionedUserID(arg string, chanMessage *discordgo.Message) string {
+	matches := regexMention.FindStringSubmatch(arg)
+	if matches == nil {
+		return ""
+	}
+	// To validate the userID, we make sure the id we extracted is
+	// also included in the Mentioned users of the discord message
+	for _, user := range chanMessage.Mentions {
+		if user.ID == matches[1] {
+			return matches[1]
+		}
+	}
+	return ""
+}
+
+// canModifyUser returns true if the author is allowed to change or remove
+// the user. Only allowed if the author is the user, or if the user has not
+// been set by the user themselves and has no verified account.
+func canModifyUser(user *User, authorID string) bool {
+	return user.ID == authorID || (user.CreatedBy != user.ID && !user.hasVerifiedAccount())
+}
+
+// modifiableUser returns the user in the guild, or nil if the user is not
+// set in the guild, and true if the author is allowed to set accounts of
+// the user there. A new entry in a guild shadows the global entry of the
+// user, so only authors allowed to modify the global entry may create it.
+func modifiableUser(source UserSource, guildID, userID, authorID string) (*User, bool, error) {
+	user, err := source.Get(guildID, userID)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "Could not get userID '%s' in guild '%s' from user source", userID, guildID)
+	}
+	if user != nil {
+		return user, canModifyUser(user, authorID), nil
+	}
+	if guildID == GlobalScope || userID == authorID {
+		return nil, true, nil
+	}
+	globalUser, err := source.Get(GlobalScope, userID)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "Could not get global userID '%s' from user source", userID)
+	}
+	return nil, globalUser == nil || canModifyUser(globalUser, authorID), nil
+}
+
+// channelGuildID returns the id of the guild the channel belongs to, or
+// an empty string if the channel is a private channel.
+func (bot *Bot) channelGuildID(channelID string) (string, error) {
+	channel, err := bot.discordSession.State.Channel(channelID)
+	if err != nil {
+		// Not in the state, fall back to asking Discord
+		channel, err = bot.discordSession.Channel(channelID)
+		if err != nil {
+			return "", errors.Wrapf(err, "Could not get channel '%s'", channelID)
+		}
+	}
+	return channel.GuildID, nil
+}
+
+// outputFormat returns the format that the response to the message should
+// be sent in. The preference of the author is used if set, otherwise the
+// preference of the guild.
+func (bot *Bot) outputFormat(chanMessage *discordgo.Message) (OutputFormat, error) {
+	keys := []string{userPreferencesKey(chanMessage.Author.ID)}
+	guildID, err := bot.channelGuildID(chanMessage.ChannelID)
+	if err != nil {
+		return "", err
+	}
+	if guildID != "" {
+		keys = append(keys, guildPreferencesKey(guildID))
+	}
+	for _, key := range keys {
+		prefs, err := bot.preferenceSource.Get(key)
+		if err != nil {
+			return "", errors.Wrapf(err, "Could not get preferences '%s' from preference source", key)
+		}
+		if prefs != nil && prefs.Output != "" {
+			return prefs.Output, nil
+		}
+	}
+	return defaultOutputFormat, nil
+}
+
+func (bot *Bot) setOutput(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	channelID := chanMessage.ChannelID
+	authorID := chanMessage.Author.ID
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "server") {
+		return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+	}
+	format, ok := argOutputFormats[strings.ToLower(args[0])]
+	if !ok {
+		return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+	}
+
+	key := userPreferencesKey(authorID)
+	forGuild := len(args) == 2
+	if forGuild {
+		guildID, err := bot.channelGuildID(channelID)
+		if err != nil {
+			return err
+		}
+		if guildID == "" {
+			return bot.sendMessage(ctx, channelID, msgServerOnly)
+		}
+		// Changing the output of everyone in the server is restricted
+		// to those managing the server
+		if ok, err := bot.checkManageServer(ctx, chanMessage); !ok || err != nil {
+			return err
+		}
+		key = guildPreferencesKey(guildID)
+	}
+
+	prefs, err := bot.preferenceSource.Get(key)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get preferences '%s' from preference source", key)
+	}
+	if prefs == nil {
+		prefs = &Preferences{}
+	}
+	prefs.Output = format
+	if err := bot.preferenceSource.Save(key, prefs); err != nil {
+		return errors.Wrapf(err, "Failed saving preferences '%s' to preference source", key)
+	}
+	bot.logger.WithFields(logrus.Fields{"key": key, "output": format}).Debug("Output format updated")
+	data := outputUpdatedData{MentionID: authorID, Format: format, Guild: forGuild}
+	return bot.sendTemplateMessage(ctx, channelID, tmplOutputUpdated, data)
+}
+
+// checkManageServer returns true if the author of the message has the
+// Manage Server permission. If not, a message is sent to the channel
+// and false is returned.
+func (bot *Bot) checkManageServer(ctx context.Context, chanMessage *discordgo.Message) (bool, error) {
+	channelID := chanMessage.ChannelID
+	authorID := chanMessage.Author.ID
+	perms, err := bot.discordSession.UserChannelPermissions(authorID, channelID)
+	if err != nil {
+		return false, errors.Wrapf(err, "Could not get permissions of '%s' in channel '%s'", authorID, channelID)
+	}
+	if perms&discordgo.PermissionManageServer == 0 {
+		data := missingPermissionData{MentionID: authorID, Permission: "Manage Server"}
+		return false, bot.sendTemplateMessage(ctx, channelID, tmplMissingPermission, data)
+	}
+	return true, nil
+}
+
+// postModLog posts the changes to the moderation log channel of the guild
+// the message was sent in, if any. The changes have been made, so the
+// command does not fail if they can not be posted, e.g. because the log
+// channel is no longer accessible.
+func (bot *Bot) postModLog(ctx context.Context, chanMessage *discordgo.Message, changes []*HistoryEntry) {
+	guildID, err := bot.channelGuildID(chanMessage.ChannelID)
+	if err != nil || guildID == "" {
+		return
+	}
+	guildLogger := bot.logger.WithField("guildID", guildID)
+	key := guildPreferencesKey(guildID)
+	prefs, err := bot.preferenceSource.Get(key)
+	if err != nil {
+		guildLogger.WithError(err).Warn("Could not get preferences for moderation log")
+		return
+	}
+	if prefs == nil || prefs.ModLogChannel == "" {
+		return
+	}
+	for _, change := range changes {
+		if err := bot.sendTemplateMessage(ctx, prefs.ModLogChannel, tmplModLogChange, change); err != nil {
+			guildLogger.WithError(err).Warn("Could not post change to moderation log")
+			return
+		}
+	}
+}
+
+func (bot *Bot) showHistory(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	var userID string
+	switch len(args) {
+	case 0:
+		// !ow history
+		userID = chanMessage.Author.ID
+	case 1:
+		// !ow history <@user>
+		userID = mentionedUserID(args[0], chanMessage)
+		if userID == "" {
+			return bot.sendMessage(ctx, chanMessage.ChannelID, msgUnknownCommand)
+		}
+	default:
+		return bot.sendMessage(ctx, chanMessage.ChannelID, msgUnknownCommand)
+	}
+
+	// The history of the global user is shown together with the history
+	// of the guild, as both are used in the guild
+	guildID, err := bot.channelGuildID(chanMessage.ChannelID)
+	if err != nil {
+		return err
+	}
+	scopes := []string{GlobalScope}
+	if guildID != GlobalScope {
+		scopes = append(scopes, guildID)
+	}
+	var entries []*HistoryEntry
+	for _, scope := range scopes {
+		history, err := bot.historySource.Get(scope, userID)
+		if err != nil {
+			return errors.Wrapf(err, "Could not get history of '%s' in guild '%s' from history source", userID, scope)
+		}
+		entries = append(entries, history...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	data := userHistoryData{MentionID: userID, Entries: entries}
+	if len(entries) > historyShownEntries {
+		data.Omitted = len(entries) - historyShownEntries
+		data.Entries = entries[data.Omitted:]
+	}
+	return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmplUserHistory, data)
+}
+
+func (bot *Bot) setModLog(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	channelID := chanMessage.ChannelID
+	if len(args) != 1 {
+		return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+	}
+	var logChannelID string
+	if strings.ToLower(args[0]) != "off" {
+		matches := regexChannelMention.FindStringSubmatch(args[0])
+		if matches == nil {
+			return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+		}
+		logChannelID = matches[1]
+	}
+
+	guildID, err := bot.channelGuildID(channelID)
+	if err != nil {
+		return err
+	}
+	if guildID == "" {
+		return bot.sendMessage(ctx, channelID, msgServerOnly)
+	}
+	if ok, err := bot.checkManageServer(ctx, chanMessage); !ok || err != nil {
+		return err
+	}
+	if logChannelID != "" {
+		// Only channels of the same server can be used, so that the
+		// changes are not posted somewhere else
+		logGuildID, err := bot.channelGuildID(logChannelID)
+		if err != nil {
+			return err
+		}
+		if logGuildID != guildID {
+			return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+		}
+	}
+
+	key := guildPreferencesKey(guildID)
+	prefs, err := bot.preferenceSource.Get(key)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get preferences '%s' from preference source", key)
+	}
+	if prefs == nil {
+		prefs = &Preferences{}
+	}
+	prefs.ModLogChannel = logChannelID
+	if err := bot.preferenceSource.Save(key, prefs); err != nil {
+		return errors.Wrapf(err, "Failed saving preferences '%s' to preference source", key)
+	}
+	bot.logger.WithFields(logrus.Fields{"key": key, "modLogChannel": logChannelID}).Debug("Moderation log updated")
+	return bot.sendTemplateMessage(ctx, channelID, tmplModLogUpdated, modLogUpdatedData{ChannelID: logChannelID})
+}
+
+// isGuildMember returns true if the user is a member of the guild. Discord
+// is only asked if the member is not in the state. Users that Discord does
+// not know as members are not members.
+func (bot *Bot) isGuildMember(guildID, userID string) (bool, error) {
+	_, err := bot.discordSession.State.Member(guildID, userID)
+	if err == nil {
+		return true, nil
+	}
+	if err != discordgo.ErrStateNotFound && err != discordgo.ErrNilState {
+		return false, errors.Wrapf(err, "Could not get member '%s' of guild '%s' from state", userID, guildID)
+	}
+	_, err = bot.discordSession.GuildMember(guildID, userID)
+	if err == nil {
+		return true, nil
+	}
+	if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Response != nil &&
+		restErr.Response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return false, errors.Wrapf(err, "Could not get member '%s' of guild '%s'", userID, guildID)
+}
+
+func (bot *Bot) showWhois(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	channelID := chanMessage.ChannelID
+	if len(args) != 1 || !(regexBattleTag.MatchString(args[0]) || regexConsoleName.MatchString(args[0])) {
+		return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+	}
+	battleTag := args[0]
+
+	// Only the users of the server are shown, so that whois can not be
+	// used to find users of other servers
+	guildID, err := bot.channelGuildID(channelID)
+	if err != nil {
+		return err
+	}
+	if guildID == "" {
+		return bot.sendMessage(ctx, channelID, msgServerOnly)
+	}
+	users, err := bot.userSource.FindByBattleTag(battleTag)
+	if err != nil {
+		return errors.Wrapf(err, "Could not find BattleTag '%s' in user source", battleTag)
+	}
+	data := whoisData{BattleTag: battleTag}
+	for _, user := range users {
+		if user.GuildID != guildID && user.GuildID != GlobalScope {
+			continue
+		}
+		if user.GuildID == GlobalScope {
+			// The global user is not used in the server if the user
+			// has a user of the server
+			guildUser, err := bot.userSource.Get(guildID, user.ID)
+			if err != nil {
+				return errors.Wrapf(err, "Could not get user '%s' in guild '%s' from user source", user.ID, guildID)
+			}
+			if guildUser != nil {
+				continue
+			}
+		}
+		member, err := bot.isGuildMember(guildID, user.ID)
+		if err != nil {
+			// Leaving out the users we could not check would show a
+			// partial answer as if it was complete
+			if sendErr := bot.sendMessage(ctx, channelID, msgMembersUnavailable); sendErr != nil {
+				bot.logger.WithError(sendErr).Warn("Could not send members unavailable message")
+			}
+			return err
+		}
+		if !member {
+			continue
+		}
+		key := userPreferencesKey(user.ID)
+		prefs, err := bot.preferenceSource.Get(key)
+		if err != nil {
+			return errors.Wrapf(err, "Could not get preferences '%s' from preference source", key)
+		}
+		if prefs != nil && prefs.HideFromWhois {
+			continue
+		}
+		for _, account := range user.Accounts {
+			if normalizeBattleTag(account.BattleTag) == normalizeBattleTag(battleTag) {
+				data.Matches = append(data.Matches, whoisMatch{
+					UserID: user.ID,
+					Label:  account.Label,
+					Global: user.GuildID == GlobalScope,
+				})
+			}
+		}
+	}
+	return bot.sendTemplateMessage(ctx, channelID, tmplWhois, data)
+}
+
+func (bot *Bot) setPrivacy(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	channelID := chanMessage.ChannelID
+	authorID := chanMessage.Author.ID
+	if len(args) != 1 {
+		return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+	}
+	hide, ok := argPrivacy[strings.ToLower(args[0])]
+	if !ok {
+		return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+	}
+
+	key := userPreferencesKey(authorID)
+	prefs, err := bot.preferenceSource.Get(key)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get preferences '%s' from preference source", key)
+	}
+	if prefs == nil {
+		prefs = &Preferences{}
+	}
+	prefs.HideFromWhois = hide
+	if err := bot.preferenceSource.Save(key, prefs); err != nil {
+		return errors.Wrapf(err, "Failed saving preferences '%s' to preference source", key)
+	}
+	bot.logger.WithFields(logrus.Fields{"key": key, "hideFromWhois": hide}).Debug("Privacy updated")
+	data := privacyUpdatedData{MentionID: authorID, HideFromWhois: hide}
+	return bot.sendTemplateMessage(ctx, channelID, tmplPrivacyUpdated, data)
+}
+
+func (bot *Bot) verifyAccount(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
+	channelID := chanMessage.ChannelID
+	authorID := chanMessage.Author.ID
+	global := len(args) > 0 && strings.ToLower(args[len(args)-1]) == argGlobal
+	if global {
+		args = args[:len(args)-1]
+	}
+	if len(args) > 1 {
+		return bot.sendMessage(ctx, channelID, msgUnknownCommand)
+	}
+	var label string
+	if len(args) == 1 {
+		label = strings.ToLower(args[0])
+	}
+	if bot.verifier == nil {
+		return bot.sendMessage(ctx, channelID, msgVerifyDisabled)
+	}
+
+	// Only the user themselves can verify their accounts. The global
+	// user is verified if the user has no user of the server
+	guildID, err := bot.userScope(chanMessage, global)
+	if err != nil {
+		return err
+	}
+	user, err := bot.getUser(guildID, authorID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		data := unknownDiscordUserData{MentionID: authorID}
+		return bot.sendTemplateMessage(ctx, channelID, tmplUnknownDiscordUser, data)
+	}
+	account := user.PrimaryAccount()
+	if label != "" {
+		account = user.Account(label)
+	}
+	if account == nil {
+		data := unknownAccountData{MentionID: authorID, Label: label}
+		return bot.sendTemplateMessage(ctx, channelID, tmplUnknownAccount, data)
+	}
+	if account.Verified {
+		data := verifyData{MentionID: authorID, Account: *account}
+		return bot.sendTemplateMessage(ctx, channelID, tmplAlreadyVerified, data)
+	}
+
+	// Looking up the profile icon may take some time
+	if err := bot.discordSession.ChannelTyping(channelID); err != nil {
+		return errors.Wrap(err, "failed sending typing status to channel")
+	}
+	// A pending challenge for the account is checked, a new challenge
+	// is issued otherwise, or if the account has changed since
+	if pending := bot.verifier.Pending(user.GuildID, authorID); pending != nil && pending.Account == *account {
+		return bot.completeVerifyChallenge(ctx, chanMessage, pending)
+	}
+	challenge, err := bot.verifier.Challenge(ctx, user.GuildID, authorID, *account)
+	if err != nil {
+		return bot.sendVerifyError(ctx, chanMessage, account, nil, err)
+	}
+	bot.logger.WithFields(logrus.Fields{"guildID": user.GuildID, "userID": authorID, "account": account}).
+		Debug("Issued verification challenge")
+	data := verifyChallengeData{
+		MentionID:       authorID,
+		VerifyChallenge: challenge,
+		Minutes:         int(challenge.ExpiresAt.Sub(challenge.IssuedAt) / time.Minute),
+	}
+	return bot.sendTemplateMessage(ctx, channelID, tmplVerifyChallenge, data)
+}
+
+// completeVerifyChallenge marks the account of the challenge as verified,
+// if the challenge has been completed.
+func (bot *Bot) completeVerifyChallenge(ctx context.Context, chanMessage *discordgo.Message, pending *VerifyChallenge) error {
+	channelID := chanMessage.ChannelID
+	authorID := chanMessage.Author.ID
+	challenge, err := bot.verifier.Verify(ctx, pending.GuildID, authorID)
+	if err != nil {
+		return bot.sendVerifyError(ctx, chanMessage, &pending.Account, &pending.Target, err)
+	}
+
+	// The user is read again, as it may have changed while the stats
+	// were fetched
+	user, err := bot.userSource.Get(challenge.GuildID, authorID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get userID '%s' in guild '%s' from user source", authorID, challenge.GuildID)
+	}
+	var account *Account
+	if user != nil {
+		account = user.Account(challenge.Account.Label)
+	}
+	if account == nil || account.BattleTag != challenge.Account.BattleTag || account.Platform != challenge.Account.Platform {
+		data := verifyData{MentionID: authorID, Account: challenge.Account}
+		return bot.sendTemplateMessage(ctx, channelID, tmplVerifyExpired, data)
+	}
+	account.Verified = true
+	// The user now owns the user entry, whoever created it
+	user.CreatedBy = authorID
+	if err := bot.userSource.Save(user); err != nil {
+		return errors.Wrapf(err, "Failed saving user (%+v) to data source", user)
+	}
+	bot.logger.WithFields(logrus.Fields{"guildID": user.GuildID, "userID": authorID, "account": account}).
+		Info("Account verified")
+	data := verifyData{MentionID: authorID, Account: *account}
+	return bot.sendTemplateMessage(ctx, channelID, tmplAccountVerified, data)
+}
+
+// sendVerifyError sends the message explaining err, an error issuing or
+// checking a challenge for the account, to the channel. target is the
+// target icon of the checked challenge, nil when issuing a challenge.
+func (bot *Bot) sendVerifyError(ctx context.Context, chanMessage *discordgo.Message, account *Account, target *VerifyIcon, err error) error {
+	data := verifyData{MentionID: chanMessage.Author.ID, Account: *account}
+	if target != nil {
+		data.TargetName = target.Name
+	}
+	var tmpl *template.Template
+	switch errors.Cause(err) {
+	case ErrProfileNotUpdated:
+		tmpl = tmplVerifyNotUpdated
+	case ErrChallengeNotCompleted:
+		tmpl = tmplVerifyNotCompleted
+	case ErrNoChallenge:
+		tmpl = tmplVerifyExpired
+	case ErrNoAvatar:
+		tmpl = tmplVerifyNoAvatar
+	}
+	if tmpl != nil {
+		return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, tmpl, data)
+	}
+	player := account.Player()
+	bot.logger.WithError(err).WithField("player", player).Warn("Could not get Overwatch stats for verification")
+	fetchData := newFetchErrorData(&player, "")
+	return bot.sendTemplateMessage(ctx, chanMessage.ChannelID, fetchErrorTemplate(err, tmplFetchError), fetchData)
 }
 
 func (bot *Bot) showVersion(ctx context.Context, args []string, chanMessage *discordgo.Message) error {
@@ -0,0 +1,128 @@
+package owbot_test
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/verath/owbot-bot/owbot"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"github.com/verath/owbot-bot/owbot/owapi/owapitest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFetchErrorTemplate(t *testing.T) {
+	stats := &owapi.UserStats{}
+	stats.GameStats.TimePlayed = 10
+	tests := []struct {
+		name string
+		// The responses to the stats request, none for a 404
+		responses []*owapitest.Response
+		mode      owapi.Mode
+		wantErr   error
+		wantTmpl  string
+	}{
+		{"NotFound", nil, owapi.ModeCompetitive, owapi.ErrPlayerNotFound, "PlayerNotFound"},
+		{"PrivateProfile", []*owapitest.Response{owapitest.StatusResponse(http.StatusForbidden)},
+			owapi.ModeCompetitive, owapi.ErrPrivateProfile, "PrivateProfile"},
+		{"NoCompetitiveData", []*owapitest.Response{owapitest.StatsResponse(owapi.RegionEU, nil, stats)},
+			owapi.ModeCompetitive, owapi.ErrNoCompetitiveData, "NoStats"},
+		{"NoQuickplayData", []*owapitest.Response{owapitest.StatsResponse(owapi.RegionEU, stats, nil)},
+			owapi.ModeQuickplay, owapi.ErrNoStatsForMode, "NoStats"},
+		{"ServerError", []*owapitest.Response{owapitest.StatusResponse(http.StatusBadGateway)},
+			owapi.ModeCompetitive, owapi.ErrUpstreamUnavailable, "UpstreamUnavailable"},
+		{"MalformedJSON", []*owapitest.Response{owapitest.MalformedJSONResponse()},
+			owapi.ModeCompetitive, owapi.ErrUpstreamUnavailable, "UpstreamUnavailable"},
+		{"RateLimited", []*owapitest.Response{owapitest.RateLimitedResponse(time.Minute)},
+			owapi.ModeCompetitive, owapi.ErrRateLimited, "RateLimited"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := owapitest.NewServer()
+			defer server.Close()
+			if tt.responses != nil {
+				server.Handle(owapitest.StatsPath("player#1234"), tt.responses...)
+			}
+			client, err := owapi.NewClient(newTestLogger(), owapi.ClientOptions{BaseURL: server.BaseURL()})
+			if err != nil {
+				t.Fatalf("NewClient returned error: %+v", err)
+			}
+
+			_, err = client.GetStats(context.Background(), owapi.NewPlayer("player#1234"), tt.mode)
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("GetStats returned %v, want %v", err, tt.wantErr)
+			}
+			if name := owbot.FetchErrorTemplateName(err); name != tt.wantTmpl {
+				t.Errorf("Template for %v = %s, want %s", err, name, tt.wantTmpl)
+			}
+		})
+	}
+	// Errors not from fetching stats get the default template
+	if name := owbot.FetchErrorTemplateName(errors.New("other")); name != "FetchError" {
+		t.Errorf("Template for other error = %s, want FetchError", name)
+	}
+}
+
+func TestFetchErrorTemplateMode(t *testing.T) {
+	player := owapi.NewPlayer("player#1234")
+	tests := []struct {
+		mode owapi.Mode
+		want string
+	}{
+		{owapi.ModeCompetitive, `Unable to fetch Competitive stats for "player#1234"`},
+		// Achievements and verification have no mode
+		{"", `Unable to fetch stats for "player#1234"`},
+	}
+	for _, tt := range tests {
+		got, err := owbot.ExecuteFetchErrorTemplate(player, tt.mode)
+		if err != nil {
+			t.Fatalf("Executing FetchError returned error: %+v", err)
+		}
+		if got != tt.want {
+			t.Errorf("FetchError for mode %q = %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestCanSetUserGlobalShadow(t *testing.T) {
+	source := owbot.NewMemoryUserSource()
+	globalUsers := []*owbot.User{
+		// Set by the user themselves
+		{ID: "1", Accounts: []owbot.Account{{Label: "main", BattleTag: "owner#1234"}}, Primary: "main", CreatedBy: "1"},
+		// Set by someone else
+		{ID: "2", Accounts: []owbot.Account{{Label: "main", BattleTag: "other#1234"}}, Primary: "main", CreatedBy: "3"},
+		// Set by someone else, but verified
+		{ID: "4", Accounts: []owbot.Account{{Label: "main", BattleTag: "owner#1234", Verified: true}}, Primary: "main",
+			CreatedBy: "3"},
+	}
+	for _, user := range globalUsers {
+		if err := source.Save(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		guildID  string
+		userID   string
+		authorID string
+		want     bool
+	}{
+		// A guild entry would shadow the global entry of the owner
+		{"guild", "1", "5", false},
+		{"guild", "4", "5", false},
+		{"guild", "2", "5", true},
+		{"guild", "1", "1", true},
+		// Users without a global entry can be set by anyone
+		{"guild", "6", "5", true},
+		{owbot.GlobalScope, "1", "5", false},
+		{owbot.GlobalScope, "6", "5", true},
+	}
+	for _, tt := range tests {
+		got, err := owbot.CanSetUser(source, tt.guildID, tt.userID, tt.authorID)
+		if err != nil {
+			t.Fatalf("CanSetUser returned error: %+v", err)
+		}
+		if got != tt.want {
+			t.Errorf("CanSetUser(%q, %q, %q) = %v, want %v", tt.guildID, tt.userID, tt.authorID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package owapi
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Top level response to a u/<battle-tag>/achievements request
+type achievementsResponse struct {
+	KR  *regionAchievements `json:"kr"`
+	EU  *regionAchievements `json:"eu"`
+	US  *regionAchievements `json:"us"`
+	Any *regionAchievements `json:"any"`
+}
+
+// region returns the achievements for the region, or nil if the
+// response has no achievements for the region.
+func (res *achievementsResponse) region(region Region) *regionAchievements {
+	switch region {
+	case RegionKR:
+		return res.KR
+	case RegionEU:
+		return res.EU
+	case RegionUS:
+		return res.US
+	case RegionAny:
+		return res.Any
+	default:
+		return nil
+	}
+}
+
+// Region sub-level part of the achievements response. Achievements
+// are grouped by category, and map an achievement name to whether
+// the achievement has been unlocked.
+type regionAchievements struct {
+	Achievements map[string]map[string]bool `json:"achievements"`
+}
+
+// numUnlocked returns the number of unlocked achievements in the region.
+func (ra *regionAchievements) numUnlocked() int {
+	if ra == nil {
+		return 0
+	}
+	unlocked := 0
+	for _, achievements := range ra.Achievements {
+		for _, isUnlocked := range achievements {
+			if isUnlocked {
+				unlocked++
+			}
+		}
+	}
+	return unlocked
+}
+
+// Achievement is a single achievement for a user.
+type Achievement struct {
+	// The owapi name of the achievement, e.g. "level_10"
+	Name string
+	// The category of the achievement, e.g. "general"
+	Category string
+	// True if the user has unlocked the achievement
+	Unlocked bool
+}
+
+// Title returns the human readable name of the achievement.
+func (a *Achievement) Title() string {
+	return strings.Title(strings.Replace(a.Name, "_", " ", -1))
+}
+
+// AchievementCategory is a summary of the achievements in a category.
+type AchievementCategory struct {
+	Name     string
+	Unlocked int
+	Total    int
+}
+
+// Title returns the human readable name of the category.
+func (ac *AchievementCategory) Title() string {
+	return strings.Title(ac.Name)
+}
+
+// Completion returns the percentage of achievements unlocked in the category.
+func (ac *AchievementCategory) Completion() float32 {
+	if ac.Total == 0 {
+		return 0
+	}
+	return float32(ac.Unlocked) / float32(ac.Total) * 100
+}
+
+// UserAchievements holds the achievements of a specific user.
+type UserAchievements struct {
+	BattleTag string
+	Region    string
+	// The time the achievements were fetched from the api
+	FetchedAt time.Time
+	// The achievements, sorted by category and name
+	Achievements []*Achievement
+}
+
+// Categories returns a summary of each achievement category, sorted by
+// category name.
+func (ua *UserAchievements) Categories() []*AchievementCategory {
+	var categories []*AchievementCategory
+	for _, achievement := range ua.Achievements {
+		if len(categories) == 0 || categories[len(categories)-1].Name != achievement.Category {
+			categories = append(categories, &AchievementCategory{Name: achievement.Category})
+		}
+		category := categories[len(categories)-1]
+		category.Total++
+		if achievement.Unlocked {
+			category.Unlocked++
+		}
+	}
+	return categories
+}
+
+// Unlocked returns the unlocked achievements.
+func (ua *UserAchievements) Unlocked() []*Achievement {
+	var unlocked []*Achievement
+	for _, achievement := range ua.Achievements {
+		if achievement.Unlocked {
+			unlocked = append(unlocked, achievement)
+		}
+	}
+	return unlocked
+}
+
+// Returns a UserAchievements object for the provided player.
+func (ow *Client) GetAchievements(ctx context.Context, player Player) (*UserAchievements, error) {
+	res, fetchedAt, err := ow.getCachedResponse(ctx, ow.achievementsCache, player.path("achievements"), func() interface{} {
+		return &achievementsResponse{}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	regionAchievements, region := ow.getBestAchievementsRegion(res.(*achievementsResponse), player)
+	if regionAchievements == nil {
+		return nil, errors.Wrap(ErrPlayerNotFound, "Could not find a region with achievements for player")
+	}
+
+	userAchievements := &UserAchievements{
+		BattleTag: player.BattleTag,
+		Region:    region.String(),
+		FetchedAt: fetchedAt,
+	}
+	for category, achievements := range regionAchievements.Achievements {
+		for name, unlocked := range achievements {
+			userAchievements.Achievements = append(userAchievements.Achievements, &Achievement{
+				Name:     name,
+				Category: category,
+				Unlocked: unlocked,
+			})
+		}
+	}
+	sort.Slice(userAchievements.Achievements, func(i, j int) bool {
+		a, b := userAchievements.Achievements[i], userAchievements.Achievements[j]
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		return a.Name < b.Name
+	})
+	return userAchievements, nil
+}
+
+// getBestAchievementsRegion takes an achievements response and returns the
+// "best matching" region for the player. If the player has a region set, that
+// region is used. Otherwise, the best match is the region with the most
+// unlocked achievements. May return nil if all regions are nil.
+func (ow *Client) getBestAchievementsRegion(res *achievementsResponse, player Player) (*regionAchievements, Region) {
+	var bestMatch *regionAchievements
+	var bestRegion Region
+	mostUnlocked := -1
+
+	for _, region := range player.regions() {
+		regionAchievements := res.region(region)
+		if regionAchievements == nil {
+			continue
+		}
+		regionUnlocked := regionAchievements.numUnlocked()
+		if regionUnlocked > mostUnlocked {
+			mostUnlocked = regionUnlocked
+			bestMatch = regionAchievements
+			bestRegion = region
+		}
+	}
+	return bestMatch, bestRegion
+}
@@ -0,0 +1,148 @@
+package owapi
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// PersistentCache is a cache of encoded api responses, used by the Client
+// as a second level cache below its in-memory caches.
+type PersistentCache interface {
+	// Get returns the response data stored for the key, and the time it
+	// was stored. ok is false if there is no (unexpired) entry for the key.
+	Get(key string) (data []byte, storedAt time.Time, ok bool, err error)
+
+	// Put stores the response data for the key, fetched at storedAt.
+	// The entry expires ttl after storedAt.
+	Put(key string, data []byte, storedAt time.Time, ttl time.Duration) error
+}
+
+var bucketResponseCache = []byte("owapiResponseCache")
+
+// boltCacheEntry is the format entries are stored in, in the bolt bucket
+type boltCacheEntry struct {
+	StoredAt  time.Time       `json:"storedAt"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func (e *boltCacheEntry) expired(now time.Time) bool {
+	return now.After(e.ExpiresAt)
+}
+
+// BoltCache is a PersistentCache storing entries in a bucket of a
+// bolt db. Expired entries are not returned, but are only removed
+// from the db by RunCompaction.
+type BoltCache struct {
+	logger *logrus.Entry
+	db     *bolt.DB
+}
+
+func createResponseCacheBucket(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketResponseCache)
+		return err
+	})
+}
+
+// NewBoltCache creates a new BoltCache, using its own bucket in the db.
+// The db is not closed by the BoltCache.
+func NewBoltCache(logger *logrus.Logger, db *bolt.DB) (*BoltCache, error) {
+	// Make sure the cache bucket exist
+	if err := createResponseCacheBucket(db); err != nil {
+		return nil, err
+	}
+	return &BoltCache{
+		logger: logger.WithField("module", "boltCache"),
+		db:     db,
+	}, nil
+}
+
+func (c *BoltCache) mustGetBucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		c.logger.WithField("name", name).Panic("Bucket not found")
+	}
+	return bucket
+}
+
+func (c *BoltCache) Get(key string) ([]byte, time.Time, bool, error) {
+	var entry *boltCacheEntry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		bucket := c.mustGetBucket(tx, bucketResponseCache)
+		v := bucket.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		entry = &boltCacheEntry{}
+		return json.Unmarshal(v, entry)
+	})
+	if err != nil {
+		return nil, time.Time{}, false, errors.Wrapf(err, "Could not get cache entry '%s'", key)
+	}
+	if entry == nil || entry.expired(time.Now()) {
+		return nil, time.Time{}, false, nil
+	}
+	return entry.Data, entry.StoredAt, true, nil
+}
+
+func (c *BoltCache) Put(key string, data []byte, storedAt time.Time, ttl time.Duration) error {
+	entry := &boltCacheEntry{StoredAt: storedAt, ExpiresAt: storedAt.Add(ttl), Data: data}
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "Could not encode cache entry")
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := c.mustGetBucket(tx, bucketResponseCache)
+		return bucket.Put([]byte(key), v)
+	})
+}
+
+// Compact removes all expired entries. Returns the number of entries removed.
+func (c *BoltCache) Compact() (int, error) {
+	removed := 0
+	now := time.Now()
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		cursor := c.mustGetBucket(tx, bucketResponseCache).Cursor()
+		for k, v := cursor.First(); k != nil; {
+			entry := &boltCacheEntry{}
+			// Entries we can not decode are as useless as expired ones
+			if err := json.Unmarshal(v, entry); err == nil && !entry.expired(now) {
+				k, v = cursor.Next()
+				continue
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			removed++
+			// Deleting moves the cursor to the next entry
+			k, v = cursor.Seek(k)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// RunCompaction compacts the cache every interval, until the context
+// is done. Always returns a non-nil error.
+func (c *BoltCache) RunCompaction(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		removed, err := c.Compact()
+		if err != nil {
+			c.logger.WithError(err).Error("Could not compact cache")
+		} else {
+			c.logger.WithField("removed", removed).Debug("Compacted cache")
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package owapi_test
+
+import (
+	"context"
+	"github.com/boltdb/bolt"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"github.com/verath/owbot-bot/owbot/owapi/owapitest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The bucket the BoltCache stores its entries in
+var bucketResponseCache = []byte("owapiResponseCache")
+
+// newTestDBFile returns the path of a bolt db file in a new temp dir. The
+// returned func removes the dir.
+func newTestDBFile(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "owapi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "owbot.boltdb"), func() { os.RemoveAll(dir) }
+}
+
+func openTestDB(t *testing.T, dbFile string) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newTestBoltCache(t *testing.T, db *bolt.DB) *owapi.BoltCache {
+	t.Helper()
+	cache, err := owapi.NewBoltCache(newTestLogger(), db)
+	if err != nil {
+		t.Fatalf("NewBoltCache returned error: %+v", err)
+	}
+	return cache
+}
+
+func TestBoltCacheSurvivesRestart(t *testing.T) {
+	dbFile, cleanup := newTestDBFile(t)
+	defer cleanup()
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path,
+		owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil),
+		owapitest.MalformedJSONResponse())
+
+	db := openTestDB(t, dbFile)
+	client := newTestClient(t, server, owapi.ClientOptions{PersistentCache: newTestBoltCache(t, db)})
+	stats, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if err != nil {
+		t.Fatalf("GetStats returned error: %+v", err)
+	}
+	db.Close()
+
+	// A new client, using a new cache on the same db, as after a restart
+	db = openTestDB(t, dbFile)
+	defer db.Close()
+	client = newTestClient(t, server, owapi.ClientOptions{PersistentCache: newTestBoltCache(t, db)})
+	cachedStats, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if err != nil {
+		t.Fatalf("GetStats after restart returned error: %+v", err)
+	}
+	if cachedStats.OverallStats.Level != 25 || !cachedStats.FetchedAt.Equal(stats.FetchedAt) {
+		t.Errorf("GetStats after restart = level %d fetched at %v, want level 25 fetched at %v",
+			cachedStats.OverallStats.Level, cachedStats.FetchedAt, stats.FetchedAt)
+	}
+	if n := server.RequestsTo(path); n != 1 {
+		t.Errorf("RequestsTo = %d, want 1", n)
+	}
+}
+
+func TestBoltCacheExpires(t *testing.T) {
+	dbFile, cleanup := newTestDBFile(t)
+	defer cleanup()
+	db := openTestDB(t, dbFile)
+	defer db.Close()
+	cache := newTestBoltCache(t, db)
+
+	storedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := cache.Put("fresh", []byte(`"data"`), storedAt, time.Hour); err != nil {
+		t.Fatalf("Put returned error: %+v", err)
+	}
+	data, gotStoredAt, ok, err := cache.Get("fresh")
+	if err != nil || !ok {
+		t.Fatalf("Get of fresh entry = %v, %v, want the entry", ok, err)
+	}
+	if string(data) != `"data"` || !gotStoredAt.Equal(storedAt) {
+		t.Errorf("Get of fresh entry = %s stored at %v, want %s stored at %v", data, gotStoredAt, `"data"`, storedAt)
+	}
+
+	if err := cache.Put("expired", []byte(`"data"`), time.Now().Add(-2*time.Hour), time.Hour); err != nil {
+		t.Fatalf("Put returned error: %+v", err)
+	}
+	if _, _, ok, err := cache.Get("expired"); ok || err != nil {
+		t.Errorf("Get of expired entry = %v, %v, want no entry", ok, err)
+	}
+	if _, _, ok, err := cache.Get("missing"); ok || err != nil {
+		t.Errorf("Get of missing entry = %v, %v, want no entry", ok, err)
+	}
+}
+
+func TestBoltCacheCompact(t *testing.T) {
+	dbFile, cleanup := newTestDBFile(t)
+	defer cleanup()
+	db := openTestDB(t, dbFile)
+	defer db.Close()
+	cache := newTestBoltCache(t, db)
+
+	now := time.Now()
+	entries := []struct {
+		key      string
+		storedAt time.Time
+	}{
+		{"expired-1", now.Add(-2 * time.Hour)},
+		{"fresh", now},
+		{"expired-2", now.Add(-3 * time.Hour)},
+	}
+	for _, e := range entries {
+		if err := cache.Put(e.key, []byte(`"data"`), e.storedAt, time.Hour); err != nil {
+			t.Fatalf("Put returned error: %+v", err)
+		}
+	}
+	// Entries that can not be decoded are removed as well
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketResponseCache).Put([]byte("garbage"), []byte("not json"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := cache.Compact()
+	if err != nil {
+		t.Fatalf("Compact returned error: %+v", err)
+	}
+	if removed != 3 {
+		t.Errorf("Compact removed %d entries, want 3", removed)
+	}
+	var keys []string
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketResponseCache).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"fresh"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys after Compact = %v, want %v", keys, want)
+	}
+	if _, _, ok, err := cache.Get("fresh"); !ok || err != nil {
+		t.Errorf("Get of fresh entry after Compact = %v, %v, want the entry", ok, err)
+	}
+}
@@ -0,0 +1,206 @@
+package owapi
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hashicorp/golang-lru"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+type responseCacheEntry struct {
+	response interface{}
+	addedAt  time.Time
+}
+
+// getCachedResponse returns the decoded response for the path, and the time
+// it was fetched, either from the cache or by requesting it from the api.
+// newResponse must return a new value that the response should be decoded
+// into.
+//
+// Fresh cached responses are returned directly. Recently stale responses are
+// also returned directly, but are refreshed in the background. Older stale
+// responses are only returned if requesting a new response fails.
+func (ow *Client) getCachedResponse(ctx context.Context, cache *lru.ARCCache, path string, newResponse func() interface{}) (interface{}, time.Time, error) {
+	// Try get from cache, before trying to send a request, so that we can
+	// return directly if we have a cached requests
+	cacheEntry, cached := ow.getCacheEntry(cache, path, newResponse)
+	if cached {
+		age := time.Since(cacheEntry.addedAt)
+		if age <= cacheDurationStats {
+			return cacheEntry.response, cacheEntry.addedAt, nil
+		}
+		if age <= cacheDurationRevalidate {
+			ow.refreshInBackground(cache, path, newResponse)
+			return cacheEntry.response, cacheEntry.addedAt, nil
+		}
+	}
+
+	res, addedAt, err := ow.fetchResponse(ctx, cache, path, newResponse, false)
+	if err != nil && cached && time.Since(cacheEntry.addedAt) <= cacheDurationServeStale {
+		ow.logger.WithError(err).WithFields(logrus.Fields{
+			"path": path,
+			"age":  time.Since(cacheEntry.addedAt),
+		}).Warn("Could not fetch response, serving stale response")
+		return cacheEntry.response, cacheEntry.addedAt, nil
+	}
+	return res, addedAt, err
+}
+
+// getFreshResponse returns the decoded response for the path, and the
+// time it was fetched, requested from the api after the call was made.
+// The cache is not read, but the response is stored to it.
+func (ow *Client) getFreshResponse(ctx context.Context, cache *lru.ARCCache, path string, newResponse func() interface{}) (interface{}, time.Time, error) {
+	return ow.fetchResponse(ctx, cache, path, newResponse, true)
+}
+
+// fetchResponse requests the response for the path from the api, and
+// stores it to the cache. Concurrent fetches of the same path, i.e. of
+// the same endpoint for the same BattleTag, share a single request. If
+// fresh, the response is not read from the cache, and the request is only
+// shared with other fresh fetches.
+func (ow *Client) fetchResponse(ctx context.Context, cache *lru.ARCCache, path string, newResponse func() interface{}, fresh bool) (interface{}, time.Time, error) {
+	key := path
+	if fresh {
+		key = "fresh:" + path
+	}
+	res, addedAt, err := ow.inflight.do(ctx, key, func(ctx context.Context) (interface{}, time.Time, error) {
+		return ow.requestResponse(ctx, cache, path, newResponse, fresh)
+	})
+	if err == context.DeadlineExceeded {
+		return nil, time.Time{}, errors.Wrap(ErrUpstreamUnavailable, "Timed out waiting for a response")
+	}
+	return res, addedAt, err
+}
+
+// requestResponse sends the request for the path to the api, within the
+// limits on concurrent requests and request rate, and stores the
+// response to the cache. If fresh, the request is sent even if the
+// response was cached while waiting for a request slot.
+func (ow *Client) requestResponse(ctx context.Context, cache *lru.ARCCache, path string, newResponse func() interface{}, fresh bool) (interface{}, time.Time, error) {
+	// We wait here until either we can obtain a request slot, or our
+	// context is canceled.
+	select {
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	case ow.requestSlots <- struct{}{}:
+		defer func() {
+			<-ow.requestSlots
+		}()
+	}
+
+	// We check cache again after obtaining the slot, as we might
+	// have waited during another request for the same path
+	if !fresh {
+		if cacheEntry, ok := ow.getCacheEntry(cache, path, newResponse); ok && time.Since(cacheEntry.addedAt) <= cacheDurationStats {
+			return cacheEntry.response, cacheEntry.addedAt, nil
+		}
+	}
+
+	// If the api has asked us to back off, wait until it allows
+	// requests again
+	if err := ow.waitForPause(ctx); err != nil {
+		return nil, time.Time{}, err
+	}
+	if err := ow.rateLimiter.wait(ctx); err != nil {
+		if err == context.DeadlineExceeded {
+			return nil, time.Time{}, errors.Wrap(ErrRateLimited, "Request rate limit exceeded")
+		}
+		return nil, time.Time{}, err
+	}
+
+	req, err := ow.NewRequest(ctx, path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	res := newResponse()
+	_, err = ow.Do(req, res)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// Store to cache
+	cacheEntry := responseCacheEntry{res, time.Now()}
+	cache.Add(path, cacheEntry)
+	ow.persistResponse(path, cacheEntry)
+
+	return cacheEntry.response, cacheEntry.addedAt, nil
+}
+
+// refreshInBackground fetches the response for the path in a separate
+// goroutine, unless the path is already being refreshed.
+func (ow *Client) refreshInBackground(cache *lru.ARCCache, path string, newResponse func() interface{}) {
+	ow.refreshingMu.Lock()
+	defer ow.refreshingMu.Unlock()
+	if ow.refreshing[path] {
+		return
+	}
+	ow.refreshing[path] = true
+
+	go func() {
+		defer func() {
+			ow.refreshingMu.Lock()
+			delete(ow.refreshing, path)
+			ow.refreshingMu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+		pathLogger := ow.logger.WithField("path", path)
+		if _, _, err := ow.fetchResponse(ctx, cache, path, newResponse, false); err != nil {
+			pathLogger.WithError(err).Warn("Could not refresh stale response")
+		} else {
+			pathLogger.Debug("Refreshed stale response")
+		}
+	}()
+}
+
+// getCacheEntry returns the cached response entry for the path, if
+// one exist. The entry may be stale. Entries not in the in-memory cache
+// are looked up in the persistent cache, if the client has one.
+func (ow *Client) getCacheEntry(cache *lru.ARCCache, path string, newResponse func() interface{}) (responseCacheEntry, bool) {
+	if cacheEntry, ok := cache.Get(path); ok {
+		return cacheEntry.(responseCacheEntry), true
+	}
+	if ow.persistentCache == nil {
+		return responseCacheEntry{}, false
+	}
+	pathLogger := ow.logger.WithField("path", path)
+	data, storedAt, ok, err := ow.persistentCache.Get(path)
+	if err != nil {
+		pathLogger.WithError(err).Warn("Could not get response from persistent cache")
+		return responseCacheEntry{}, false
+	}
+	if !ok {
+		return responseCacheEntry{}, false
+	}
+	res := newResponse()
+	if err := json.Unmarshal(data, res); err != nil {
+		pathLogger.WithError(err).Warn("Could not decode response from persistent cache")
+		return responseCacheEntry{}, false
+	}
+	// Keep the original time the response was fetched, so that the
+	// response is refreshed as if it had never left the memory cache
+	cacheEntry := responseCacheEntry{res, storedAt}
+	cache.Add(path, cacheEntry)
+	return cacheEntry, true
+}
+
+// persistResponse stores the response to the persistent cache, if the
+// client has one. Failing to do so is only logged, as the response is
+// still in the in-memory cache.
+func (ow *Client) persistResponse(path string, cacheEntry responseCacheEntry) {
+	if ow.persistentCache == nil {
+		return
+	}
+	pathLogger := ow.logger.WithField("path", path)
+	data, err := json.Marshal(cacheEntry.response)
+	if err != nil {
+		pathLogger.WithError(err).Warn("Could not encode response for persistent cache")
+		return
+	}
+	if err := ow.persistentCache.Put(path, data, cacheEntry.addedAt, cacheDurationServeStale); err != nil {
+		pathLogger.WithError(err).Warn("Could not store response to persistent cache")
+	}
+}
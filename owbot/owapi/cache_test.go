@@ -0,0 +1,163 @@
+package owapi_test
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"github.com/verath/owbot-bot/owbot/owapi/owapitest"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryCacheEntry struct {
+	data      []byte
+	storedAt  time.Time
+	expiresAt time.Time
+}
+
+// memoryCache is a PersistentCache keeping entries in memory. Entries can
+// be aged, to test how the Client treats responses fetched long ago.
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*memoryCacheEntry
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: make(map[string]*memoryCacheEntry)}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, time.Time, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, time.Time{}, false, nil
+	}
+	return entry.data, entry.storedAt, true, nil
+}
+
+func (c *memoryCache) Put(key string, data []byte, storedAt time.Time, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &memoryCacheEntry{data, storedAt, storedAt.Add(ttl)}
+	return nil
+}
+
+// age makes the entry for the key d older, returning the new time it was
+// stored at.
+func (c *memoryCache) age(t *testing.T, key string, d time.Duration) time.Time {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		t.Fatalf("No cache entry for %s", key)
+	}
+	entry.storedAt = entry.storedAt.Add(-d)
+	entry.expiresAt = entry.expiresAt.Add(-d)
+	return entry.storedAt
+}
+
+// fetchAndAge gets the stats of the player with a first client, which are
+// stored in the cache, and makes them d old. Returns a new client using the
+// cache, and the time the stats are now fetched at.
+func fetchAndAge(t *testing.T, server *owapitest.Server, cache *memoryCache, d time.Duration) (*owapi.Client, time.Time) {
+	t.Helper()
+	client := newTestClient(t, server, owapi.ClientOptions{PersistentCache: cache})
+	if _, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive); err != nil {
+		t.Fatalf("GetStats returned error: %+v", err)
+	}
+	fetchedAt := cache.age(t, owapitest.StatsPath(testBattleTag), d)
+	// A new client, so that the response is not in its in-memory cache
+	return newTestClient(t, server, owapi.ClientOptions{PersistentCache: cache}), fetchedAt
+}
+
+func TestCacheServeStaleOnError(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path,
+		owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil),
+		owapitest.StatusResponse(http.StatusInternalServerError))
+	client, fetchedAt := fetchAndAge(t, server, newMemoryCache(), time.Hour)
+
+	stats, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if err != nil {
+		t.Fatalf("GetStats of stale response returned error: %+v", err)
+	}
+	if stats.OverallStats.Level != 25 {
+		t.Errorf("GetStats level = %d, want 25", stats.OverallStats.Level)
+	}
+	// The age of the stale stats is kept
+	if !stats.FetchedAt.Equal(fetchedAt) {
+		t.Errorf("GetStats FetchedAt = %v, want %v", stats.FetchedAt, fetchedAt)
+	}
+	if age := time.Since(stats.FetchedAt); age < time.Hour {
+		t.Errorf("GetStats age = %v, want at least an hour", age)
+	}
+	// The first request, and the failing attempt to refresh it
+	if n := server.RequestsTo(path); n < 2 {
+		t.Errorf("RequestsTo = %d, want at least 2", n)
+	}
+}
+
+func TestCacheTooStale(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path,
+		owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil),
+		owapitest.MalformedJSONResponse())
+	client, _ := fetchAndAge(t, server, newMemoryCache(), 25*time.Hour)
+
+	_, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if errors.Cause(err) != owapi.ErrUpstreamUnavailable {
+		t.Errorf("GetStats of too stale response returned %v, want %v", err, owapi.ErrUpstreamUnavailable)
+	}
+}
+
+func TestCacheRefreshInBackground(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path,
+		owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil),
+		owapitest.StatsResponse(owapi.RegionEU, newTestStats(26, 10), nil).WithDelay(100*time.Millisecond))
+	client, fetchedAt := fetchAndAge(t, server, newMemoryCache(), 10*time.Minute)
+
+	// Recently stale stats are returned without waiting for the refresh
+	start := time.Now()
+	stats, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if err != nil {
+		t.Fatalf("GetStats of stale response returned error: %+v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("GetStats returned after %v, want without waiting for the refresh", elapsed)
+	}
+	if stats.OverallStats.Level != 25 || !stats.FetchedAt.Equal(fetchedAt) {
+		t.Errorf("GetStats = level %d fetched at %v, want level 25 fetched at %v", stats.OverallStats.Level, stats.FetchedAt, fetchedAt)
+	}
+
+	// The refreshed stats are returned once the refresh is done
+	deadline := time.Now().Add(5 * time.Second)
+	for stats.OverallStats.Level != 26 {
+		if time.Now().After(deadline) {
+			t.Fatal("Stale stats were not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+		stats, err = client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+		if err != nil {
+			t.Fatalf("GetStats returned error: %+v", err)
+		}
+	}
+	if age := time.Since(stats.FetchedAt); age > time.Minute {
+		t.Errorf("GetStats age of refreshed stats = %v, want fresh", age)
+	}
+	// A single refresh, even though the stats were asked for while
+	// being refreshed
+	if n := server.RequestsTo(path); n != 2 {
+		t.Errorf("RequestsTo = %d, want 2", n)
+	}
+}
@@ -0,0 +1,95 @@
+package owapi
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+)
+
+// The errors returned by the Client. Errors are typically wrapped with
+// additional details, use errors.Cause to get the error to compare with.
+var (
+	// ErrPlayerNotFound is returned when the api does not know of the
+	// player, e.g. because the BattleTag is misspelled.
+	ErrPlayerNotFound = errors.New("Player not found")
+
+	// ErrPrivateProfile is returned when the career profile of the
+	// player is private, and so has no stats.
+	ErrPrivateProfile = errors.New("Career profile is private")
+
+	// ErrNoCompetitiveData is returned when the player has no competitive
+	// stats in any region (or in the requested region).
+	ErrNoCompetitiveData = errors.New("Could not find a region with competitive stats")
+
+	// ErrNoStatsForMode is returned when the player has no stats in any
+	// region (or in the requested region) for a mode other than competitive.
+	ErrNoStatsForMode = errors.New("Could not find a region with stats for the requested mode")
+
+	// ErrUpstreamUnavailable is returned when the api could not be reached,
+	// responded with an error or did not respond in time.
+	ErrUpstreamUnavailable = errors.New("The api is unavailable")
+
+	// ErrRateLimited is returned when the api has asked us to back off for
+	// longer than we can wait, or when we would exceed the rate of requests
+	// we allow ourselves to make.
+	ErrRateLimited = errors.New("Rate limited by the api")
+)
+
+// NoStatsError returns the error for a player having no stats for the
+// mode, which is ErrNoCompetitiveData for competitive and
+// ErrNoStatsForMode for other modes.
+func NoStatsError(mode Mode) error {
+	if mode == ModeCompetitive {
+		return ErrNoCompetitiveData
+	}
+	return ErrNoStatsForMode
+}
+
+// requestErrorCause returns the cause of err, the error of a failed
+// request. The *url.Error returned by http.Client.Do is unwrapped, so
+// that e.g. a canceled request has the context error as its cause.
+func requestErrorCause(err error) error {
+	err = errors.Cause(err)
+	if urlErr, ok := err.(*url.Error); ok {
+		return errors.Cause(urlErr.Err)
+	}
+	return err
+}
+
+// isContextError returns true if err is the error of a request that
+// failed because its context was canceled or its deadline exceeded.
+func isContextError(err error) bool {
+	cause := requestErrorCause(err)
+	return cause == context.Canceled || cause == context.DeadlineExceeded
+}
+
+// UpstreamError returns err, the error of a failed request to an api,
+// wrapped in the matching typed error. The original error is kept as
+// the message of the returned error. Requests failing because their
+// context was canceled or its deadline exceeded are not the api's fault,
+// so context.Canceled or context.DeadlineExceeded is returned as is.
+func UpstreamError(err error) error {
+	if isContextError(err) {
+		return requestErrorCause(err)
+	}
+	var typedErr error
+	switch err := errors.Cause(err).(type) {
+	case *ErrorResponse:
+		switch err.Response.StatusCode {
+		case http.StatusNotFound:
+			typedErr = ErrPlayerNotFound
+		case http.StatusForbidden:
+			typedErr = ErrPrivateProfile
+		case http.StatusTooManyRequests:
+			typedErr = ErrRateLimited
+		default:
+			typedErr = ErrUpstreamUnavailable
+		}
+	default:
+		// Network errors, timeouts, responses that are not the JSON we
+		// expected, ...
+		typedErr = ErrUpstreamUnavailable
+	}
+	return errors.Wrap(typedErr, err.Error())
+}
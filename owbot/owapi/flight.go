@@ -0,0 +1,95 @@
+package owapi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// flightCall is an in-flight, or completed, fetch of a response.
+type flightCall struct {
+	// Closed once the fetch has completed, after which the result
+	// fields below are set
+	done    chan struct{}
+	res     interface{}
+	addedAt time.Time
+	err     error
+
+	// The number of callers waiting for the result, guarded by the
+	// mutex of the flightGroup
+	waiters int
+	// Cancels the context of the fetch
+	cancel context.CancelFunc
+}
+
+// flightGroup deduplicates concurrent fetches of the same key, so that
+// callers asking for a key that is already being fetched share the
+// result of that fetch instead of starting another.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do calls fn and returns its result, unless a call for the key is
+// already in flight, in which case the result of that call is returned.
+//
+// fn is not called with the context of the caller, as the fetch is shared
+// with other callers and must not fail just because the first caller gave
+// up. Instead, it is called with a context that times out after
+// fetchTimeout, and that is canceled if all callers give up waiting for
+// the result.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, time.Time, error)) (interface{}, time.Time, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		call = g.start(key, fn)
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.res, call.addedAt, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// No one is interested in the result anymore. The call
+			// is removed directly, so that later callers start a new
+			// call instead of joining the canceled one
+			g.forget(key, call)
+			call.cancel()
+		}
+		g.mu.Unlock()
+		return nil, time.Time{}, ctx.Err()
+	}
+}
+
+// start starts a new call to fn for the key. Must be called with
+// the mutex held.
+func (g *flightGroup) start(key string, fn func(ctx context.Context) (interface{}, time.Time, error)) *flightCall {
+	fetchCtx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	call := &flightCall{done: make(chan struct{}), cancel: cancel}
+	g.calls[key] = call
+
+	go func() {
+		defer cancel()
+		call.res, call.addedAt, call.err = fn(fetchCtx)
+		g.mu.Lock()
+		g.forget(key, call)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// forget removes the call for the key, unless it has already been
+// replaced by a newer call. Must be called with the mutex held.
+func (g *flightGroup) forget(key string, call *flightCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
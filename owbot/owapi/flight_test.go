@@ -0,0 +1,94 @@
+package owapi_test
+
+import (
+	"context"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"github.com/verath/owbot-bot/owbot/owapi/owapitest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlightSharesRequest(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path, owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil).WithDelay(200*time.Millisecond))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("GetStats returned error: %+v", err)
+		}
+	}
+	if n := server.RequestsTo(path); n != 1 {
+		t.Errorf("RequestsTo = %d, want 1", n)
+	}
+}
+
+func TestFlightOutlivesFirstCaller(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path, owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil).WithDelay(200*time.Millisecond))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	firstErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := client.GetStats(ctx, owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+		firstErr <- err
+	}()
+	waitForRequests(t, server, path, 1)
+
+	// The fetch is not canceled while another caller waits for it
+	if _, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive); err != nil {
+		t.Fatalf("GetStats returned error: %+v", err)
+	}
+	if err := <-firstErr; err == nil {
+		t.Error("GetStats of caller giving up returned no error")
+	}
+	if n := server.RequestsTo(path); n != 1 {
+		t.Errorf("RequestsTo = %d, want 1", n)
+	}
+}
+
+func TestFlightCanceledWhenAllCallersGiveUp(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	response := owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil)
+	server.Handle(path, response.WithDelay(time.Second), response)
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetStats(ctx, owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive); err == nil {
+		t.Fatal("GetStats of slow response returned no error")
+	}
+
+	// A later caller starts a new request, instead of waiting for the
+	// abandoned one
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetStats(ctx, owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive); err != nil {
+		t.Fatalf("GetStats after the first caller gave up returned error: %+v", err)
+	}
+	if n := server.RequestsTo(path); n != 2 {
+		t.Errorf("RequestsTo = %d, want 2", n)
+	}
+}
@@ -0,0 +1,250 @@
+package owapi
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// heroNames maps the hero keys used by the owapi to the in-game
+// hero names
+var heroNames = map[string]string{
+	"ana":          "Ana",
+	"ashe":         "Ashe",
+	"bastion":      "Bastion",
+	"brigitte":     "Brigitte",
+	"doomfist":     "Doomfist",
+	"dva":          "D.Va",
+	"genji":        "Genji",
+	"hanzo":        "Hanzo",
+	"junkrat":      "Junkrat",
+	"lucio":        "Lúcio",
+	"mccree":       "McCree",
+	"mei":          "Mei",
+	"mercy":        "Mercy",
+	"moira":        "Moira",
+	"orisa":        "Orisa",
+	"pharah":       "Pharah",
+	"reaper":       "Reaper",
+	"reinhardt":    "Reinhardt",
+	"roadhog":      "Roadhog",
+	"soldier76":    "Soldier: 76",
+	"sombra":       "Sombra",
+	"symmetra":     "Symmetra",
+	"torbjorn":     "Torbjörn",
+	"tracer":       "Tracer",
+	"widowmaker":   "Widowmaker",
+	"winston":      "Winston",
+	"wreckingball": "Wrecking Ball",
+	"zarya":        "Zarya",
+	"zenyatta":     "Zenyatta",
+}
+
+// HeroKey normalizes a hero name, as written by a user, to the key used
+// by the owapi. E.g. "Soldier: 76" -> "soldier76" and "Lúcio" -> "lucio".
+func HeroKey(name string) string {
+	replacer := strings.NewReplacer("ú", "u", "ö", "o")
+	name = replacer.Replace(strings.ToLower(name))
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, name)
+}
+
+// Top level response to a u/<battle-tag>/heroes request
+type heroesResponse struct {
+	KR  *regionHeroes `json:"kr"`
+	EU  *regionHeroes `json:"eu"`
+	US  *regionHeroes `json:"us"`
+	Any *regionHeroes `json:"any"`
+}
+
+// region returns the heroes for the region, or nil if the response
+// has no heroes for the region.
+func (res *heroesResponse) region(region Region) *regionHeroes {
+	switch region {
+	case RegionKR:
+		return res.KR
+	case RegionEU:
+		return res.EU
+	case RegionUS:
+		return res.US
+	case RegionAny:
+		return res.Any
+	default:
+		return nil
+	}
+}
+
+// Region sub-level part of the heroes response
+type regionHeroes struct {
+	Heroes struct {
+		Stats struct {
+			Competitive map[string]*heroStatsResponse `json:"competitive"`
+			Quickplay   map[string]*heroStatsResponse `json:"quickplay"`
+		} `json:"stats"`
+	} `json:"heroes"`
+}
+
+// modeHeroes returns the hero stats for the given mode, or nil if the
+// region has no hero stats for that mode.
+func (rh *regionHeroes) modeHeroes(mode Mode) map[string]*heroStatsResponse {
+	if rh == nil {
+		return nil
+	}
+	switch mode {
+	case ModeCompetitive:
+		return rh.Heroes.Stats.Competitive
+	case ModeQuickplay:
+		return rh.Heroes.Stats.Quickplay
+	default:
+		return nil
+	}
+}
+
+// The stats for a single hero in the heroes response
+type heroStatsResponse struct {
+	GeneralStats struct {
+		Eliminations  float32 `json:"eliminations"`
+		GamesPlayed   float32 `json:"games_played"`
+		GamesWon      float32 `json:"games_won"`
+		TimePlayed    float32 `json:"time_played"`
+		WinPercentage float32 `json:"win_percentage"`
+	} `json:"general_stats"`
+}
+
+// HeroStats holds the stats of a user for a single hero.
+type HeroStats struct {
+	// The owapi key of the hero, e.g. "soldier76"
+	Hero         string
+	Eliminations float32
+	GamesPlayed  float32
+	GamesWon     float32
+	// Time played on the hero, in hours
+	TimePlayed float32
+	// The percentage of games won on the hero
+	WinRate float32
+}
+
+// Name returns the in-game name of the hero.
+func (hs *HeroStats) Name() string {
+	if name, ok := heroNames[hs.Hero]; ok {
+		return name
+	}
+	return strings.Title(hs.Hero)
+}
+
+// EliminationsPer10Min returns the average number of eliminations per
+// 10 minutes played on the hero.
+func (hs *HeroStats) EliminationsPer10Min() float32 {
+	if hs.TimePlayed <= 0 {
+		return 0
+	}
+	return hs.Eliminations / (hs.TimePlayed * 6)
+}
+
+// UserHeroes holds the per hero stats for a specific user.
+type UserHeroes struct {
+	BattleTag string
+	Region    string
+	Mode      Mode
+	// The time the heroes were fetched from the api
+	FetchedAt time.Time
+	// The heroes played by the user, most played first
+	Heroes []*HeroStats
+}
+
+// Hero returns the stats for the named hero, or nil if the user has
+// no stats for the hero. The name is normalized using HeroKey.
+func (uh *UserHeroes) Hero(name string) *HeroStats {
+	key := HeroKey(name)
+	for _, hero := range uh.Heroes {
+		if hero.Hero == key {
+			return hero
+		}
+	}
+	return nil
+}
+
+// Top returns the (at most) n most played heroes.
+func (uh *UserHeroes) Top(n int) []*HeroStats {
+	if n > len(uh.Heroes) {
+		n = len(uh.Heroes)
+	}
+	return uh.Heroes[:n]
+}
+
+// Returns a UserHeroes object for the provided player and mode. Returns
+// ErrNoCompetitiveData, or ErrNoStatsForMode for other modes, if the
+// player has no hero stats for the mode.
+func (ow *Client) GetHeroes(ctx context.Context, player Player, mode Mode) (*UserHeroes, error) {
+	res, fetchedAt, err := ow.getCachedResponse(ctx, ow.heroesCache, player.path("heroes"), func() interface{} {
+		return &heroesResponse{}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	regionHeroes, region := ow.getBestHeroesRegion(res.(*heroesResponse), player, mode)
+	if regionHeroes == nil {
+		return nil, NoStatsError(mode)
+	}
+
+	userHeroes := &UserHeroes{
+		BattleTag: player.BattleTag,
+		Region:    region.String(),
+		FetchedAt: fetchedAt,
+		Mode:      mode,
+	}
+	for hero, stats := range regionHeroes.modeHeroes(mode) {
+		if stats == nil || stats.GeneralStats.TimePlayed <= 0 {
+			continue
+		}
+		heroStats := &HeroStats{
+			Hero:         hero,
+			Eliminations: stats.GeneralStats.Eliminations,
+			GamesPlayed:  stats.GeneralStats.GamesPlayed,
+			GamesWon:     stats.GeneralStats.GamesWon,
+			TimePlayed:   stats.GeneralStats.TimePlayed,
+			WinRate:      stats.GeneralStats.WinPercentage * 100,
+		}
+		if heroStats.GamesPlayed > 0 {
+			heroStats.WinRate = heroStats.GamesWon / heroStats.GamesPlayed * 100
+		}
+		userHeroes.Heroes = append(userHeroes.Heroes, heroStats)
+	}
+	sort.Slice(userHeroes.Heroes, func(i, j int) bool {
+		return userHeroes.Heroes[i].TimePlayed > userHeroes.Heroes[j].TimePlayed
+	})
+	return userHeroes, nil
+}
+
+// getBestHeroesRegion takes a heroes response and returns the "best matching"
+// region for the player and mode. If the player has a region set, that region
+// is used. Otherwise, the best match is the region with the most time played
+// in. May return nil if no region has hero stats for the mode.
+func (ow *Client) getBestHeroesRegion(res *heroesResponse, player Player, mode Mode) (*regionHeroes, Region) {
+	var bestMatch *regionHeroes
+	var bestRegion Region
+	var mostPlayed float32
+
+	for _, region := range player.regions() {
+		regionHeroes := res.region(region)
+		var regionPlayed float32
+		for _, stats := range regionHeroes.modeHeroes(mode) {
+			if stats != nil {
+				regionPlayed += stats.GeneralStats.TimePlayed
+			}
+		}
+		if regionPlayed > mostPlayed {
+			mostPlayed = regionPlayed
+			bestMatch = regionHeroes
+			bestRegion = region
+		}
+	}
+	return bestMatch, bestRegion
+}
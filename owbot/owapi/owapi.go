@@ -7,43 +7,134 @@ import (
 	"github.com/hashicorp/golang-lru"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	// The base url of the owapi
+	// The default base url of the owapi
 	apiBaseUrl = "https://owapi.net/api/v3/"
 
-	// The number of user stats entries to cache
+	// The number of stats responses to cache
 	cacheSizeStats = 200
 
-	// Time before user stats is considered stale and should be re-fetched
+	// The number of heroes responses to cache
+	cacheSizeHeroes = 200
+
+	// The number of achievements responses to cache
+	cacheSizeAchievements = 100
+
+	// Time before a response is considered stale and should be re-fetched
 	cacheDurationStats = 5 * time.Minute
+
+	// Stale responses younger than this are served while they are
+	// refreshed in the background
+	cacheDurationRevalidate = 15 * time.Minute
+
+	// Stale responses younger than this are served if fetching a
+	// fresh response fails
+	cacheDurationServeStale = 24 * time.Hour
+
+	// Longest time a background refresh of a response may take
+	refreshTimeout = 30 * time.Second
+
+	// Longest time a fetch of a response, shared by all callers asking
+	// for the response, may take
+	fetchTimeout = 30 * time.Second
+
+	// The default max number of concurrent requests to the api
+	defaultMaxConcurrentRequests = 4
+
+	// The default max average number of requests per second to the api
+	defaultRequestsPerSecond = 2
 )
 
 // Top level response to a u/<battle-tag>/stats request
 type statsResponse struct {
-	KR *regionStats `json:"kr"`
-	EU *regionStats `json:"eu"`
-	US *regionStats `json:"us"`
+	KR  *regionStats `json:"kr"`
+	EU  *regionStats `json:"eu"`
+	US  *regionStats `json:"us"`
+	Any *regionStats `json:"any"`
+}
+
+// region returns the stats for the region, or nil if the response
+// has no stats for the region.
+func (res *statsResponse) region(region Region) *regionStats {
+	switch region {
+	case RegionKR:
+		return res.KR
+	case RegionEU:
+		return res.EU
+	case RegionUS:
+		return res.US
+	case RegionAny:
+		return res.Any
+	default:
+		return nil
+	}
 }
 
 // Region sub-level part of the stats response
 type regionStats struct {
 	Stats struct {
 		Competitive *UserStats `json:"competitive"`
+		Quickplay   *UserStats `json:"quickplay"`
 	} `json:"stats"`
 }
 
+// modeStats returns the stats for the given mode, or nil if the
+// region has no stats for that mode.
+func (rs *regionStats) modeStats(mode Mode) *UserStats {
+	if rs == nil {
+		return nil
+	}
+	switch mode {
+	case ModeCompetitive:
+		return rs.Stats.Competitive
+	case ModeQuickplay:
+		return rs.Stats.Quickplay
+	default:
+		return nil
+	}
+}
+
+// Mode is a game mode that stats can be retrieved for.
+type Mode string
+
+const (
+	ModeCompetitive Mode = "competitive"
+	ModeQuickplay   Mode = "quickplay"
+)
+
+// String returns the human readable name of the mode.
+func (m Mode) String() string {
+	switch m {
+	case ModeCompetitive:
+		return "Competitive"
+	case ModeQuickplay:
+		return "Quick Play"
+	default:
+		return string(m)
+	}
+}
+
 // UserStats is the response we get back from the ow-api, holding
 // various data for the specific user.
 type UserStats struct {
-	BattleTag    string
-	Region       string
+	BattleTag string
+	Region    string
+	Mode      Mode
+	// The time the stats were fetched from the api. May be long
+	// ago if the api is unavailable and stale stats are served
+	FetchedAt    time.Time
 	OverallStats struct {
+		// The single skill rating of seasons before role queue, 0 if
+		// the player has role ratings instead
 		CompRank int     `json:"comprank"`
 		Games    int     `json:"games"`
 		Level    int     `json:"level"`
@@ -51,6 +142,16 @@ type UserStats struct {
 		Prestige int     `json:"prestige"`
 		Wins     int     `json:"wins"`
 		WinRate  float32 `json:"win_Rate"`
+		// The skill rating and tier of each role, 0 and empty if
+		// the player is not placed in the role
+		TankRank    int    `json:"tank_comprank"`
+		TankTier    string `json:"tank_tier"`
+		DamageRank  int    `json:"damage_comprank"`
+		DamageTier  string `json:"damage_tier"`
+		SupportRank int    `json:"support_comprank"`
+		SupportTier string `json:"support_tier"`
+		// The url of the profile icon of the player
+		Avatar string `json:"avatar"`
 	} `json:"overall_stats"`
 	GameStats struct {
 		Deaths       float32 `json:"deaths"`
@@ -65,11 +166,6 @@ type UserStats struct {
 	} `json:"game_stats"`
 }
 
-type userStatsCacheEntry struct {
-	*UserStats
-	addedAt time.Time
-}
-
 // ErrorResponse is an error that is populated with additional error
 // data for the failed request.
 type ErrorResponse struct {
@@ -82,40 +178,114 @@ func (e *ErrorResponse) Error() string {
 }
 
 type Client struct {
-	logger         *logrus.Logger
-	client         *http.Client
-	userStatsCache *lru.ARCCache
-	baseUrl        *url.URL
-	// Channel of request "tokens". A token must be obtained before
-	// making a request against the api, so that we limit the amount
-	// of requests we do to a single request at a time. (which we do
-	// to not spam the third-party OWAPI we are using)
-	nextCh chan bool
+	logger            *logrus.Logger
+	client            *http.Client
+	userStatsCache    *lru.ARCCache
+	heroesCache       *lru.ARCCache
+	achievementsCache *lru.ARCCache
+	// Second level cache, below the in-memory caches. May be nil
+	persistentCache PersistentCache
+	baseUrl         *url.URL
+	// Semaphore of request slots. A slot must be obtained before making
+	// a request against the api, so that we limit the amount of
+	// concurrent requests we do. (which we do to not spam the
+	// third-party OWAPI we are using)
+	requestSlots chan struct{}
+	// Limits the rate of requests against the api. May be nil
+	rateLimiter *rateLimiter
+	// Deduplicates concurrent fetches of the same path
+	inflight flightGroup
+
+	// pausedUntilMu guards pausedUntil
+	pausedUntilMu sync.Mutex
+	// No requests are made before pausedUntil, set when the api
+	// responds with a Retry-After header
+	pausedUntil time.Time
+
+	// refreshingMu guards refreshing
+	refreshingMu sync.Mutex
+	// The paths currently being refreshed in the background
+	refreshing map[string]bool
+}
+
+// ClientOptions are the optional settings of a Client. The zero value
+// is a valid configuration.
+type ClientOptions struct {
+	// The http client to use for requests. If nil,
+	// http.DefaultClient is used
+	HTTPClient *http.Client
+	// The base url of the api. If empty, the owapi.net url is used
+	BaseURL string
+	// A cache that responses are also stored to, and read from when
+	// they are not in the in-memory cache. Typically outlives the
+	// Client, so that responses survive restarts. May be nil
+	PersistentCache PersistentCache
+	// The max number of requests sent to the api at the same time.
+	// If zero, defaultMaxConcurrentRequests is used
+	MaxConcurrentRequests int
+	// The max average number of requests per second sent to the api,
+	// allowing bursts of MaxConcurrentRequests requests. If zero,
+	// defaultRequestsPerSecond is used. If negative, the rate of
+	// requests is not limited
+	RequestsPerSecond float64
 }
 
 // Creates a new Client, a rest client for querying a third party
 // overwatch api.
-func NewClient(logger *logrus.Logger) (*Client, error) {
+func NewClient(logger *logrus.Logger, opts ClientOptions) (*Client, error) {
 	userStatsCache, err := lru.NewARC(cacheSizeStats)
 	if err != nil {
 		return nil, err
 	}
-	client := http.DefaultClient
-	baseUrl, err := url.Parse(apiBaseUrl)
+	heroesCache, err := lru.NewARC(cacheSizeHeroes)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error parsing apiBaseUrl")
+		return nil, err
+	}
+	achievementsCache, err := lru.NewARC(cacheSizeAchievements)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	baseUrlStr := opts.BaseURL
+	if baseUrlStr == "" {
+		baseUrlStr = apiBaseUrl
+	}
+	baseUrl, err := url.Parse(baseUrlStr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing baseUrl")
+	}
+	// The base url must end with a slash, or the last path segment
+	// would be replaced when resolving request urls against it
+	if !strings.HasSuffix(baseUrl.Path, "/") {
+		baseUrl.Path += "/"
+	}
+	maxConcurrentRequests := opts.MaxConcurrentRequests
+	if maxConcurrentRequests <= 0 {
+		maxConcurrentRequests = defaultMaxConcurrentRequests
+	}
+	var limiter *rateLimiter
+	requestsPerSecond := opts.RequestsPerSecond
+	if requestsPerSecond == 0 {
+		requestsPerSecond = defaultRequestsPerSecond
+	}
+	if requestsPerSecond > 0 {
+		limiter = newRateLimiter(requestsPerSecond, maxConcurrentRequests)
 	}
-	// Create and initialize the next channel with a token. We use a buffer
-	// size of 1 so returning tokens (and the initial add) does not block
-	nextCh := make(chan bool, 1)
-	nextCh <- true
 
 	return &Client{
-		logger:         logger,
-		client:         client,
-		userStatsCache: userStatsCache,
-		baseUrl:        baseUrl,
-		nextCh:         nextCh,
+		logger:            logger,
+		client:            httpClient,
+		userStatsCache:    userStatsCache,
+		heroesCache:       heroesCache,
+		achievementsCache: achievementsCache,
+		persistentCache:   opts.PersistentCache,
+		baseUrl:           baseUrl,
+		requestSlots:      make(chan struct{}, maxConcurrentRequests),
+		rateLimiter:       limiter,
+		refreshing:        make(map[string]bool),
 	}, nil
 }
 
@@ -147,23 +317,60 @@ func (ow *Client) NewRequest(ctx context.Context, urlStr string) (*http.Request,
 
 // Do sends a request. If v is not nil, the response is treated as JSON and decoded to v.
 // This method blocks until the request is sent and the response is received and parsed.
+// Requests failing with a network error, a 5xx or a 429 response are retried with a
+// backoff, for as long as the context of the request allows. Errors of failed requests
+// are wrapped in the matching typed error, see UpstreamError.
 func (ow *Client) Do(req *http.Request, v interface{}) (*http.Response, error) {
-	resp, err := ow.client.Do(req)
+	var resp *http.Response
+	var err error
+	retries := 0
+	for {
+		resp, err = ow.client.Do(req)
+		if err == nil {
+			err = CheckResponse(resp)
+		}
+		if err == nil || retries >= maxRetries || !isRetryable(resp, err) {
+			break
+		}
+		delay, retryAfter := retryDelay(resp, retries)
+		if retryAfter {
+			// The api told us to back off, so make all requests wait
+			// and not only this one
+			ow.pauseRequests(delay)
+		}
+		if resp != nil {
+			// Make sure the connection can be reused for the retry
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		retryLogger := ow.logger.WithFields(logrus.Fields{
+			"method":  req.Method,
+			"url":     req.URL,
+			"retries": retries,
+			"delay":   delay,
+		})
+		if serr := sleepContext(req.Context(), delay); serr != nil {
+			// We would not be able to retry before the deadline, so we
+			// return the error of the last attempt instead
+			retryLogger.WithError(err).Warn("Bad response, not retrying as context is done before retry")
+			return nil, UpstreamError(err)
+		}
+		retries++
+		retryLogger.Debug("Retrying request")
+	}
+	reqLogger := ow.logger.WithFields(logrus.Fields{"method": req.Method, "url": req.URL, "retries": retries})
 	if err != nil {
-		return nil, err
+		if resp != nil {
+			resp.Body.Close()
+		}
+		reqLogger.WithError(err).Warn("Bad response")
+		return nil, UpstreamError(err)
 	}
 	defer func() {
 		if cerr := resp.Body.Close(); err == nil {
 			err = cerr
 		}
 	}()
-	reqLogger := ow.logger.WithFields(logrus.Fields{"method": req.Method, "url": req.URL})
-
-	err = CheckResponse(resp)
-	if err != nil {
-		reqLogger.WithError(err).Warn("Bad response")
-		return nil, err
-	}
 
 	if v != nil {
 		err = json.NewDecoder(resp.Body).Decode(v)
@@ -175,7 +382,7 @@ func (ow *Client) Do(req *http.Request, v interface{}) (*http.Response, error) {
 				errLogger.Warn("Ignoring type error when decoding response as JSON")
 			} else {
 				errLogger.Error("Could not decode response as JSON")
-				return nil, err
+				return nil, UpstreamError(err)
 			}
 		}
 	}
@@ -184,105 +391,70 @@ func (ow *Client) Do(req *http.Request, v interface{}) (*http.Response, error) {
 	return resp, nil
 }
 
-// Returns a UserStats object for the provided BattleTag.
-func (ow *Client) GetStats(ctx context.Context, battleTag string) (*UserStats, error) {
-	// Url friendly battleTag
-	battleTag = strings.Replace(battleTag, "#", "-", -1)
-
-	// Try get from cache, before trying to send a request, so that we can
-	// return directly if we have a cached requests
-	if userStats, ok := ow.getUserStatsFromCache(battleTag); ok {
-		return userStats, nil
-	}
-
-	// We wait here until either we can obtain a "request token" from nextCh,
-	// or our context is canceled.
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-ow.nextCh:
-		defer func() {
-			ow.nextCh <- true
-		}()
-	}
-
-	// We check cache again after obtaining the token, as we might
-	// have slept during another request for the same battleTag
-	if userStats, ok := ow.getUserStatsFromCache(battleTag); ok {
-		return userStats, nil
-	}
-
-	path := fmt.Sprintf("u/%s/stats", battleTag)
-	req, err := ow.NewRequest(ctx, path)
+// Returns a UserStats object for the provided player and mode. Returns
+// ErrNoCompetitiveData, or ErrNoStatsForMode for other modes, if the
+// player has no stats for the mode.
+func (ow *Client) GetStats(ctx context.Context, player Player, mode Mode) (*UserStats, error) {
+	res, fetchedAt, err := ow.getCachedResponse(ctx, ow.userStatsCache, player.path("stats"), newStatsResponse)
 	if err != nil {
 		return nil, err
 	}
+	return ow.userStats(res.(*statsResponse), fetchedAt, player, mode)
+}
 
-	res := &statsResponse{}
-	_, err = ow.Do(req, res)
+// GetFreshStats returns the UserStats for the provided player and mode, as
+// GetStats, but requested from the api after the call was made rather
+// than read from the cache.
+func (ow *Client) GetFreshStats(ctx context.Context, player Player, mode Mode) (*UserStats, error) {
+	res, fetchedAt, err := ow.getFreshResponse(ctx, ow.userStatsCache, player.path("stats"), newStatsResponse)
 	if err != nil {
 		return nil, err
 	}
-
-	// Determine the region to use
-	regionStats, regionName := ow.getBestRegion(res)
-	if regionStats == nil || regionStats.Stats.Competitive == nil {
-		return nil, errors.New("Could not find a region with " +
-			"competitive stats for player")
-	}
-
-	// Grab the userStats, also add the battle tag from the request
-	userStats := regionStats.Stats.Competitive
-	// BattleTag is in URL format ("-" instead of "#")
-	userStats.BattleTag = strings.Replace(battleTag, "-", "#", -1)
-	userStats.Region = regionName
-
-	// Store to cache
-	cacheEntry := userStatsCacheEntry{userStats, time.Now()}
-	ow.userStatsCache.Add(battleTag, cacheEntry)
-
-	return userStats, nil
+	return ow.userStats(res.(*statsResponse), fetchedAt, player, mode)
 }
 
-// getUserStatsFromCache returns a cached UserStats entry, if one exist and the data is
-// not considered stale
-func (ow *Client) getUserStatsFromCache(battleTag string) (*UserStats, bool) {
-	if cacheEntry, ok := ow.userStatsCache.Get(battleTag); ok {
-		userStatsCacheEntry := cacheEntry.(userStatsCacheEntry)
-		if time.Since(userStatsCacheEntry.addedAt) <= cacheDurationStats {
-			return userStatsCacheEntry.UserStats, true
-		}
-	}
-	return nil, false
+func newStatsResponse() interface{} {
+	return &statsResponse{}
 }
 
-// getBestRegion takes a stats response and returns the "best matching" region.
-// The best match is the region with most played games in. May return nil if
-// all regions are nil.
-func (ow *Client) getBestRegion(res *statsResponse) (*regionStats, string) {
-	type region struct {
-		name  string
-		stats *regionStats
-	}
-	regions := []region{
-		{"US", res.US},
-		{"EU", res.EU},
-		{"KR", res.KR},
+// userStats returns the UserStats of the player and mode in the stats
+// response, fetched at fetchedAt.
+func (ow *Client) userStats(res *statsResponse, fetchedAt time.Time, player Player, mode Mode) (*UserStats, error) {
+	// Determine the region to use
+	regionStats, region := ow.getBestRegion(res, player, mode)
+	if regionStats == nil {
+		return nil, NoStatsError(mode)
 	}
-	var bestMatch region
-	mostPlayed := 0
 
-	for _, region := range regions {
-		stats := region.stats
+	// Grab a copy of the userStats, so that we do not modify the cached
+	// response. Also add the battle tag from the request
+	userStats := new(UserStats)
+	*userStats = *regionStats.modeStats(mode)
+	userStats.BattleTag = player.BattleTag
+	userStats.Region = region.String()
+	userStats.Mode = mode
+	userStats.FetchedAt = fetchedAt
+	return userStats, nil
+}
 
-		if stats == nil || stats.Stats.Competitive == nil {
+// getBestRegion takes a stats response and returns the "best matching" region
+// for the player and mode. If the player has a region set, that region is
+// used. Otherwise, the best match is the region played the most in, see
+// UserStats.playedMoreThan. May return nil if no region has stats for the mode.
+func (ow *Client) getBestRegion(res *statsResponse, player Player, mode Mode) (*regionStats, Region) {
+	var bestMatch *regionStats
+	var bestRegion Region
+
+	for _, region := range player.regions() {
+		regionStats := res.region(region)
+		stats := regionStats.modeStats(mode)
+		if stats == nil {
 			continue
 		}
-		regionPlayed := stats.Stats.Competitive.OverallStats.Games
-		if regionPlayed > mostPlayed {
-			mostPlayed = regionPlayed
-			bestMatch = region
+		if bestMatch == nil || stats.playedMoreThan(bestMatch.modeStats(mode)) {
+			bestMatch = regionStats
+			bestRegion = region
 		}
 	}
-	return bestMatch.stats, bestMatch.name
+	return bestMatch, bestRegion
 }
@@ -0,0 +1,240 @@
+package owapi_test
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"github.com/verath/owbot-bot/owbot/owapi/owapitest"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+const testBattleTag = "player#1234"
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+// newTestClient returns a Client against the server. The rate of
+// requests is not limited, unless opts says otherwise.
+func newTestClient(t *testing.T, server *owapitest.Server, opts owapi.ClientOptions) *owapi.Client {
+	t.Helper()
+	opts.BaseURL = server.BaseURL()
+	if opts.RequestsPerSecond == 0 {
+		opts.RequestsPerSecond = -1
+	}
+	client, err := owapi.NewClient(newTestLogger(), opts)
+	if err != nil {
+		t.Fatalf("NewClient returned error: %+v", err)
+	}
+	return client
+}
+
+// newTestStats returns stats with the level, and the time played used to
+// pick the best region.
+func newTestStats(level int, timePlayed float32) *owapi.UserStats {
+	stats := &owapi.UserStats{}
+	stats.OverallStats.Level = level
+	stats.OverallStats.Avatar = "https://example.com/icon.png"
+	stats.GameStats.TimePlayed = timePlayed
+	return stats
+}
+
+func TestGetStats(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	competitive := newTestStats(25, 10)
+	competitive.OverallStats.TankRank = 2500
+	competitive.OverallStats.TankTier = "platinum"
+	server.Handle(owapitest.StatsPath(testBattleTag),
+		owapitest.StatsResponse(owapi.RegionEU, competitive, newTestStats(25, 20)))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	before := time.Now()
+	stats, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if err != nil {
+		t.Fatalf("GetStats returned error: %+v", err)
+	}
+	if stats.BattleTag != testBattleTag || stats.Region != "EU" || stats.Mode != owapi.ModeCompetitive {
+		t.Errorf("GetStats = %s %s %s, want %s EU %s", stats.BattleTag, stats.Region, stats.Mode, testBattleTag, owapi.ModeCompetitive)
+	}
+	if stats.OverallStats.Level != 25 || stats.OverallStats.TankRank != 2500 || stats.OverallStats.TankTier != "platinum" {
+		t.Errorf("GetStats decoded %+v, want level 25 and platinum tank rank 2500", stats.OverallStats)
+	}
+	if stats.OverallStats.Avatar != competitive.OverallStats.Avatar {
+		t.Errorf("GetStats avatar = %q, want %q", stats.OverallStats.Avatar, competitive.OverallStats.Avatar)
+	}
+	if stats.FetchedAt.Before(before) {
+		t.Errorf("GetStats FetchedAt = %v, want after %v", stats.FetchedAt, before)
+	}
+
+	// Both modes are in the same response, which is cached
+	if _, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeQuickplay); err != nil {
+		t.Fatalf("GetStats of quick play returned error: %+v", err)
+	}
+	if n := server.RequestsTo(owapitest.StatsPath(testBattleTag)); n != 1 {
+		t.Errorf("RequestsTo = %d, want 1", n)
+	}
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].Method != "GET" || requests[0].Path != owapitest.StatsPath(testBattleTag) {
+		t.Errorf("Requests = %+v, want a single GET of %s", requests, owapitest.StatsPath(testBattleTag))
+	}
+}
+
+func TestGetStatsBestRegion(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	// The response of StatsResponse only has a single region, so
+	// the regions are written out here
+	server.Handle(owapitest.StatsPath(testBattleTag), owapitest.JSONResponse(map[string]interface{}{
+		"us": map[string]interface{}{"stats": map[string]interface{}{"competitive": newTestStats(10, 5)}},
+		"eu": map[string]interface{}{"stats": map[string]interface{}{"competitive": newTestStats(20, 50)}},
+		"kr": nil,
+	}))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	stats, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if err != nil {
+		t.Fatalf("GetStats returned error: %+v", err)
+	}
+	if stats.Region != "EU" || stats.OverallStats.Level != 20 {
+		t.Errorf("GetStats = level %d in %s, want level 20 in EU", stats.OverallStats.Level, stats.Region)
+	}
+	player := owapi.Player{BattleTag: testBattleTag, Region: owapi.RegionUS}
+	stats, err = client.GetStats(context.Background(), player, owapi.ModeCompetitive)
+	if err != nil {
+		t.Fatalf("GetStats of US returned error: %+v", err)
+	}
+	if stats.Region != "US" || stats.OverallStats.Level != 10 {
+		t.Errorf("GetStats of US = level %d in %s, want level 10 in US", stats.OverallStats.Level, stats.Region)
+	}
+}
+
+func TestGetStatsPlatform(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	server.Handle(owapitest.StatsPath("console-name"),
+		owapitest.StatsResponse(owapi.RegionAny, nil, newTestStats(30, 10)))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	player := owapi.Player{BattleTag: "console-name", Platform: owapi.PlatformPSN}
+	stats, err := client.GetStats(context.Background(), player, owapi.ModeQuickplay)
+	if err != nil {
+		t.Fatalf("GetStats returned error: %+v", err)
+	}
+	if stats.Region != "ANY" || stats.OverallStats.Level != 30 {
+		t.Errorf("GetStats = level %d in %s, want level 30 in ANY", stats.OverallStats.Level, stats.Region)
+	}
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].Query.Get("platform") != "psn" {
+		t.Errorf("Requests = %+v, want a single request for platform psn", requests)
+	}
+}
+
+func TestGetStatsNotFound(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	_, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if errors.Cause(err) != owapi.ErrPlayerNotFound {
+		t.Errorf("GetStats of unknown player returned %v, want %v", err, owapi.ErrPlayerNotFound)
+	}
+	// A 404 is not retried
+	if n := server.RequestsTo(owapitest.StatsPath(testBattleTag)); n != 1 {
+		t.Errorf("RequestsTo = %d, want 1", n)
+	}
+}
+
+func TestGetStatsRateLimited(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	// Longer than a fetch may take, so not retried
+	server.Handle(owapitest.StatsPath(testBattleTag), owapitest.RateLimitedResponse(time.Minute))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	_, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if errors.Cause(err) != owapi.ErrRateLimited {
+		t.Errorf("GetStats when rate limited returned %v, want %v", err, owapi.ErrRateLimited)
+	}
+	if n := server.RequestsTo(owapitest.StatsPath(testBattleTag)); n != 1 {
+		t.Errorf("RequestsTo = %d, want 1", n)
+	}
+}
+
+func TestGetStatsSlowResponse(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	server.Handle(owapitest.StatsPath(testBattleTag),
+		owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil).WithDelay(time.Second))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.GetStats(ctx, owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if errors.Cause(err) != owapi.ErrUpstreamUnavailable {
+		t.Errorf("GetStats of slow response returned %v, want %v", err, owapi.ErrUpstreamUnavailable)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("GetStats returned after %v, want at the deadline", elapsed)
+	}
+}
+
+func TestGetStatsMalformedJSON(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	server.Handle(owapitest.StatsPath(testBattleTag), owapitest.MalformedJSONResponse())
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	_, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if errors.Cause(err) != owapi.ErrUpstreamUnavailable {
+		t.Errorf("GetStats of malformed response returned %v, want %v", err, owapi.ErrUpstreamUnavailable)
+	}
+	// The api answered, so retrying would get the same response
+	if n := server.RequestsTo(owapitest.StatsPath(testBattleTag)); n != 1 {
+		t.Errorf("RequestsTo = %d, want 1", n)
+	}
+}
+
+func TestGetFreshStats(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path,
+		owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil),
+		owapitest.StatsResponse(owapi.RegionEU, newTestStats(26, 10), nil))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	if _, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive); err != nil {
+		t.Fatalf("GetStats returned error: %+v", err)
+	}
+	// The cached response is fresh, but is not used
+	before := time.Now()
+	stats, err := client.GetFreshStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if err != nil {
+		t.Fatalf("GetFreshStats returned error: %+v", err)
+	}
+	if stats.OverallStats.Level != 26 || stats.FetchedAt.Before(before) {
+		t.Errorf("GetFreshStats = level %d fetched at %v, want level 26 fetched after %v",
+			stats.OverallStats.Level, stats.FetchedAt, before)
+	}
+	if n := server.RequestsTo(path); n != 2 {
+		t.Errorf("RequestsTo = %d, want 2", n)
+	}
+	// The fresh response replaces the cached response
+	stats, err = client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if err != nil {
+		t.Fatalf("GetStats returned error: %+v", err)
+	}
+	if stats.OverallStats.Level != 26 {
+		t.Errorf("GetStats after GetFreshStats level = %d, want 26", stats.OverallStats.Level)
+	}
+	if n := server.RequestsTo(path); n != 2 {
+		t.Errorf("RequestsTo = %d, want 2", n)
+	}
+}
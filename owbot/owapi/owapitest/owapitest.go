@@ -0,0 +1,239 @@
+// Package owapitest provides an in-process fake owapi server, for
+// testing code using the owapi.Client without hitting owapi.net.
+//
+// The server answers requests with canned responses registered per path,
+// and records every request it receives. Paths without a registered
+// response are answered with 404 Not Found, as the owapi does for unknown
+// players. Only the path is matched on, the query (e.g. the platform of
+// console players) is recorded but ignored.
+//
+//	server := owapitest.NewServer()
+//	defer server.Close()
+//	server.Handle(owapitest.StatsPath("player#1234"),
+//		owapitest.StatsResponse(owapi.RegionEU, competitive, quickplay))
+//	client, err := owapi.NewClient(logger, owapi.ClientOptions{BaseURL: server.BaseURL()})
+package owapitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The path the api is served under, mimicking the owapi.net url
+const apiPath = "/api/v3/"
+
+// Response is a canned response served by the Server.
+type Response struct {
+	// The status code of the response, 200 if zero
+	StatusCode int
+	// Additional headers to set on the response
+	Header http.Header
+	// The response body
+	Body string
+	// Time to wait before responding, or until the request is canceled
+	Delay time.Duration
+}
+
+// WithDelay returns a copy of the response that is delayed by d.
+func (r *Response) WithDelay(d time.Duration) *Response {
+	rCopy := new(Response)
+	*rCopy = *r
+	rCopy.Delay = d
+	return rCopy
+}
+
+// JSONResponse returns a 200 OK response with v encoded as JSON as body.
+// Panics if v can not be encoded.
+func JSONResponse(v interface{}) *Response {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("owapitest: could not encode response: %v", err))
+	}
+	return &Response{
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   string(body),
+	}
+}
+
+// StatsResponse returns a response to a stats request, with the provided
+// competitive and quick play stats in the region. Either of the stats may
+// be nil.
+func StatsResponse(region owapi.Region, competitive, quickplay *owapi.UserStats) *Response {
+	type modeStats struct {
+		Competitive *owapi.UserStats `json:"competitive"`
+		Quickplay   *owapi.UserStats `json:"quickplay"`
+	}
+	type regionStats struct {
+		Stats modeStats `json:"stats"`
+	}
+	return JSONResponse(map[string]*regionStats{
+		string(region): {Stats: modeStats{competitive, quickplay}},
+	})
+}
+
+// StatusResponse returns an empty response with the status code.
+func StatusResponse(statusCode int) *Response {
+	return &Response{StatusCode: statusCode, Body: http.StatusText(statusCode)}
+}
+
+// NotFoundResponse returns a 404 Not Found response.
+func NotFoundResponse() *Response {
+	return StatusResponse(http.StatusNotFound)
+}
+
+// RateLimitedResponse returns a 429 Too Many Requests response, with
+// a Retry-After header of retryAfter (rounded up to whole seconds).
+func RateLimitedResponse(retryAfter time.Duration) *Response {
+	resp := StatusResponse(http.StatusTooManyRequests)
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	resp.Header = http.Header{"Retry-After": {strconv.Itoa(seconds)}}
+	return resp
+}
+
+// MalformedJSONResponse returns a 200 OK response with a body that is
+// not valid JSON.
+func MalformedJSONResponse() *Response {
+	return &Response{
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   `{"eu": {"stats": `,
+	}
+}
+
+// StatsPath returns the path of the stats request for the BattleTag.
+func StatsPath(battleTag string) string {
+	return fmt.Sprintf("u/%s/stats", urlBattleTag(battleTag))
+}
+
+// HeroesPath returns the path of the heroes request for the BattleTag.
+func HeroesPath(battleTag string) string {
+	return fmt.Sprintf("u/%s/heroes", urlBattleTag(battleTag))
+}
+
+// AchievementsPath returns the path of the achievements request for
+// the BattleTag.
+func AchievementsPath(battleTag string) string {
+	return fmt.Sprintf("u/%s/achievements", urlBattleTag(battleTag))
+}
+
+func urlBattleTag(battleTag string) string {
+	return url.PathEscape(strings.Replace(battleTag, "#", "-", -1))
+}
+
+// Request is a request received by the Server.
+type Request struct {
+	Method string
+	// The path of the request, relative to the api base url
+	Path string
+	// The query parameters of the request, e.g. the platform
+	Query  url.Values
+	Header http.Header
+	// The time the request was received
+	Time time.Time
+}
+
+// Server is a fake owapi server. It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string][]*Response
+	requests  []*Request
+}
+
+// NewServer starts and returns a new Server. The caller should call
+// Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{responses: make(map[string][]*Response)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// BaseURL returns the base url of the api, to be given as the BaseURL
+// of the owapi.ClientOptions.
+func (s *Server) BaseURL() string {
+	return s.URL + apiPath
+}
+
+// Handle registers the responses for requests to the path. The responses
+// are served in order, with the last response being served for all
+// remaining requests. Replaces any responses previously registered for
+// the path.
+func (s *Server) Handle(path string, responses ...*Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[path] = responses
+}
+
+// Requests returns the requests received by the server, in the order
+// they were received.
+func (s *Server) Requests() []*Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Request{}, s.requests...)
+}
+
+// RequestsTo returns the number of requests received for the path.
+func (s *Server) RequestsTo(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, req := range s.requests {
+		if req.Path == path {
+			n++
+		}
+	}
+	return n
+}
+
+// nextResponse records the request and returns the response to serve
+// for it.
+func (s *Server) nextResponse(r *http.Request, path string) *Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, &Request{
+		Method: r.Method,
+		Path:   path,
+		Query:  r.URL.Query(),
+		Header: r.Header,
+		Time:   time.Now(),
+	})
+	responses := s.responses[path]
+	if len(responses) == 0 {
+		return NotFoundResponse()
+	}
+	if len(responses) > 1 {
+		s.responses[path] = responses[1:]
+	}
+	return responses[0]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), apiPath)
+	resp := s.nextResponse(r, path)
+	if resp.Delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(resp.Delay):
+		}
+	}
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	statusCode := resp.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	w.WriteHeader(statusCode)
+	fmt.Fprint(w, resp.Body)
+}
@@ -0,0 +1,92 @@
+package owapi
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Region is a region that stats can be retrieved for.
+type Region string
+
+const (
+	RegionUS Region = "us"
+	RegionEU Region = "eu"
+	RegionKR Region = "kr"
+	// Console players do not have per region stats, their stats are
+	// all in the "any" region
+	RegionAny Region = "any"
+)
+
+// Regions are the regions stats are reported for, in the order they
+// are preferred in if more than one region is equally good.
+var Regions = []Region{RegionUS, RegionEU, RegionKR, RegionAny}
+
+// String returns the human readable name of the region.
+func (r Region) String() string {
+	return strings.ToUpper(string(r))
+}
+
+// Platform is a platform that a player can play on.
+type Platform string
+
+const (
+	PlatformPC  Platform = "pc"
+	PlatformPSN Platform = "psn"
+	PlatformXBL Platform = "xbl"
+)
+
+// Platforms are the supported platforms.
+var Platforms = []Platform{PlatformPC, PlatformPSN, PlatformXBL}
+
+// String returns the human readable name of the platform.
+func (p Platform) String() string {
+	switch p {
+	case PlatformPC:
+		return "PC"
+	case PlatformPSN:
+		return "PSN"
+	case PlatformXBL:
+		return "XBL"
+	default:
+		return string(p)
+	}
+}
+
+// Player identifies the player, and optionally region, to retrieve
+// stats for.
+type Player struct {
+	// The Battle.net BattleTag (name#1234) for PC players, or the
+	// PSN/XBL name for console players
+	BattleTag string
+	// The platform of the player. PC if empty
+	Platform Platform
+	// The region to get stats for. If empty, the best region is used
+	Region Region
+}
+
+// NewPlayer returns a PC Player for the BattleTag, using the best region.
+func NewPlayer(battleTag string) Player {
+	return Player{BattleTag: battleTag}
+}
+
+// path returns the url path of the endpoint for the player, relative to
+// the api base url. E.g. "u/name-1234/stats?platform=psn".
+func (p Player) path(endpoint string) string {
+	// Url friendly battleTag
+	battleTag := strings.Replace(p.BattleTag, "#", "-", -1)
+	path := fmt.Sprintf("u/%s/%s", url.PathEscape(battleTag), endpoint)
+	if p.Platform != "" && p.Platform != PlatformPC {
+		path += "?platform=" + url.QueryEscape(string(p.Platform))
+	}
+	return path
+}
+
+// regions returns the regions to consider for the player, which is only
+// the player's region if one is set.
+func (p Player) regions() []Region {
+	if p.Region != "" {
+		return []Region{p.Region}
+	}
+	return Regions
+}
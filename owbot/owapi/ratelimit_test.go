@@ -0,0 +1,105 @@
+package owapi_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"github.com/verath/owbot-bot/owbot/owapi/owapitest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// getStatsOfPlayers gets the stats of n different players concurrently,
+// each player having the response. Returns the times the requests were
+// received by the server, in order.
+func getStatsOfPlayers(t *testing.T, server *owapitest.Server, client *owapi.Client, n int, response *owapitest.Response) []time.Time {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		battleTag := fmt.Sprintf("player#%d", i)
+		server.Handle(owapitest.StatsPath(battleTag), response)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.GetStats(context.Background(), owapi.NewPlayer(battleTag), owapi.ModeCompetitive)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("GetStats returned error: %+v", err)
+		}
+	}
+	var times []time.Time
+	for _, req := range server.Requests() {
+		times = append(times, req.Time)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	client := newTestClient(t, server, owapi.ClientOptions{MaxConcurrentRequests: 2})
+
+	const delay = 100 * time.Millisecond
+	response := owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil).WithDelay(delay)
+	start := time.Now()
+	times := getStatsOfPlayers(t, server, client, 6, response)
+	if len(times) != 6 {
+		t.Fatalf("Got %d requests, want 6", len(times))
+	}
+	// Each request is answered delay after it is received, so the
+	// requests received within delay of each other overlapped
+	for i, received := range times {
+		concurrent := 0
+		for _, other := range times[:i+1] {
+			if received.Sub(other) < delay {
+				concurrent++
+			}
+		}
+		if concurrent > 2 {
+			t.Errorf("Request %d was sent with %d requests in flight, want at most 2", i, concurrent)
+		}
+	}
+	// Three rounds of two requests
+	if elapsed := time.Since(start); elapsed < 3*delay {
+		t.Errorf("Requests took %v, want at least %v", elapsed, 3*delay)
+	}
+}
+
+func TestRequestsPerSecond(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	// Allows bursts of two requests, then one request every 100ms
+	client := newTestClient(t, server, owapi.ClientOptions{MaxConcurrentRequests: 2, RequestsPerSecond: 10})
+
+	response := owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil)
+	times := getStatsOfPlayers(t, server, client, 6, response)
+	if len(times) != 6 {
+		t.Fatalf("Got %d requests, want 6", len(times))
+	}
+	// Between any two requests, no more requests than the burst and
+	// the tokens added in between may have been sent. Some slack is
+	// given for the time between taking a token and the request being
+	// received
+	for i := range times {
+		for j := i + 1; j < len(times); j++ {
+			allowed := 2 + 10*times[j].Sub(times[i]).Seconds() + 0.5
+			if sent := float64(j - i + 1); sent > allowed {
+				t.Errorf("%v requests sent in %v, want at most %.1f", sent, times[j].Sub(times[i]), allowed)
+			}
+		}
+	}
+	// The two first requests are sent directly, the other four 100ms
+	// apart
+	if elapsed := times[len(times)-1].Sub(times[0]); elapsed < 350*time.Millisecond {
+		t.Errorf("Requests sent over %v, want at least 400ms", elapsed)
+	}
+}
@@ -0,0 +1,121 @@
+package owapi
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// The max number of times a failed request is retried
+	maxRetries = 3
+
+	// The delay before the first retry, doubled for each retry after
+	retryBaseDelay = 500 * time.Millisecond
+
+	// The longest delay between two retries
+	retryMaxDelay = 8 * time.Second
+)
+
+// isRetryable returns true if a request resulting in resp and err
+// should be retried.
+func isRetryable(resp *http.Response, err error) bool {
+	if resp == nil {
+		// A network error, or similar. Retrying is useless if the
+		// error is due to the context being done
+		return !isContextError(err)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// retryDelay returns the time to wait before retrying a request that
+// resulted in resp, after the given number of retries. If the response
+// has a Retry-After header, that delay is returned and retryAfter is
+// true. Otherwise the delay is an exponential backoff with jitter.
+func retryDelay(resp *http.Response, retries int) (delay time.Duration, retryAfter bool) {
+	if resp != nil {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return delay, true
+		}
+	}
+	delay = retryBaseDelay << uint(retries)
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	// Wait between half of and the full delay, so that concurrent
+	// retries are spread out
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	return delay, false
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is
+// either a number of seconds or a http date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// sleepContext sleeps for d, or until the context is done. An error is
+// returned, without sleeping, if the context deadline is before d has
+// passed.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return context.DeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pauseRequests makes sure no request is sent for d.
+func (ow *Client) pauseRequests(d time.Duration) {
+	ow.pausedUntilMu.Lock()
+	defer ow.pausedUntilMu.Unlock()
+	pausedUntil := time.Now().Add(d)
+	if pausedUntil.After(ow.pausedUntil) {
+		ow.pausedUntil = pausedUntil
+	}
+}
+
+// waitForPause waits until requests are no longer paused. Returns
+// ErrRateLimited if the context does not allow waiting that long.
+func (ow *Client) waitForPause(ctx context.Context) error {
+	ow.pausedUntilMu.Lock()
+	pausedUntil := ow.pausedUntil
+	ow.pausedUntilMu.Unlock()
+
+	delay := time.Until(pausedUntil)
+	if delay <= 0 {
+		return nil
+	}
+	if err := sleepContext(ctx, delay); err != nil {
+		if err == context.DeadlineExceeded {
+			return errors.Wrap(ErrRateLimited, "Requests are paused, as requested by the api")
+		}
+		return err
+	}
+	return nil
+}
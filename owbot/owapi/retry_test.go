@@ -0,0 +1,259 @@
+package owapi_test
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"github.com/verath/owbot-bot/owbot/owapi/owapitest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// waitForRequests waits until the server has received n requests to
+// the path, failing the test if it takes too long.
+func waitForRequests(t *testing.T, server *owapitest.Server, path string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.RequestsTo(path) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("RequestsTo(%s) = %d, want %d", path, server.RequestsTo(path), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// requestTimes returns the times of the requests to the path.
+func requestTimes(server *owapitest.Server, path string) []time.Time {
+	var times []time.Time
+	for _, req := range server.Requests() {
+		if req.Path == path {
+			times = append(times, req.Time)
+		}
+	}
+	return times
+}
+
+func TestRetryRecovers(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path,
+		owapitest.StatusResponse(http.StatusServiceUnavailable),
+		owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	if _, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive); err != nil {
+		t.Fatalf("GetStats returned error: %+v", err)
+	}
+	if n := server.RequestsTo(path); n != 2 {
+		t.Errorf("RequestsTo = %d, want 2", n)
+	}
+}
+
+func TestRetryBounded(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path, owapitest.StatusResponse(http.StatusInternalServerError))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	_, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+	if errors.Cause(err) != owapi.ErrUpstreamUnavailable {
+		t.Errorf("GetStats of failing api returned %v, want %v", err, owapi.ErrUpstreamUnavailable)
+	}
+	// The first attempt and three retries
+	if n := server.RequestsTo(path); n != 4 {
+		t.Errorf("RequestsTo = %d, want 4", n)
+	}
+}
+
+func TestRetryContextDeadline(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path, owapitest.StatusResponse(http.StatusInternalServerError))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	// The first retry is at least 250ms after the first attempt, so
+	// there is no time to retry before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := client.NewRequest(ctx, path)
+	if err != nil {
+		t.Fatalf("NewRequest returned error: %+v", err)
+	}
+	start := time.Now()
+	_, err = client.Do(req, nil)
+	if errors.Cause(err) != owapi.ErrUpstreamUnavailable {
+		t.Errorf("Do returned %v, want %v", err, owapi.ErrUpstreamUnavailable)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Do returned after %v, want without waiting for the deadline", elapsed)
+	}
+	if n := server.RequestsTo(path); n != 1 {
+		t.Errorf("RequestsTo = %d, want 1", n)
+	}
+}
+
+func TestRetryStopsWhenCallerGivesUp(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path, owapitest.StatusResponse(http.StatusInternalServerError))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetStats(ctx, owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive); err == nil {
+		t.Fatal("GetStats of failing api returned no error")
+	}
+	// The fetch is canceled with the only caller gone, so it is not
+	// retried even though the fetch itself has a longer timeout
+	n := server.RequestsTo(path)
+	time.Sleep(1500 * time.Millisecond)
+	if m := server.RequestsTo(path); m != n {
+		t.Errorf("RequestsTo after the caller gave up = %d, want %d", m, n)
+	}
+}
+
+func TestRetryNotForClientErrors(t *testing.T) {
+	for _, statusCode := range []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound} {
+		t.Run(http.StatusText(statusCode), func(t *testing.T) {
+			server := owapitest.NewServer()
+			defer server.Close()
+			path := owapitest.StatsPath(testBattleTag)
+			server.Handle(path,
+				owapitest.StatusResponse(statusCode),
+				owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil))
+			client := newTestClient(t, server, owapi.ClientOptions{})
+
+			if _, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive); err == nil {
+				t.Errorf("GetStats of %d response returned no error", statusCode)
+			}
+			if n := server.RequestsTo(path); n != 1 {
+				t.Errorf("RequestsTo = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter func() string
+		// The least time requests must be paused for
+		minPause time.Duration
+	}{
+		{"Seconds", func() string { return "1" }, time.Second},
+		{"Date", func() string {
+			// The date only has second precision, so the pause
+			// is between one and two seconds from now
+			return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat)
+		}, 900 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := owapitest.NewServer()
+			defer server.Close()
+			limitedPath := owapitest.StatsPath(testBattleTag)
+			otherPath := owapitest.StatsPath("other#1234")
+			response := owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil)
+			rateLimited := owapitest.StatusResponse(http.StatusTooManyRequests)
+			rateLimited.Header = http.Header{"Retry-After": {tt.retryAfter()}}
+			server.Handle(limitedPath, rateLimited, response)
+			server.Handle(otherPath, response)
+			client := newTestClient(t, server, owapi.ClientOptions{})
+
+			limitedErr := make(chan error, 1)
+			go func() {
+				_, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive)
+				limitedErr <- err
+			}()
+			waitForRequests(t, server, limitedPath, 1)
+			// Give the client time to handle the 429
+			time.Sleep(50 * time.Millisecond)
+
+			// Requests for other players are paused as well
+			if _, err := client.GetStats(context.Background(), owapi.NewPlayer("other#1234"), owapi.ModeCompetitive); err != nil {
+				t.Fatalf("GetStats of other player returned error: %+v", err)
+			}
+			if err := <-limitedErr; err != nil {
+				t.Fatalf("GetStats of rate limited player returned error: %+v", err)
+			}
+			limitedTimes := requestTimes(server, limitedPath)
+			otherTimes := requestTimes(server, otherPath)
+			if len(limitedTimes) != 2 || len(otherTimes) != 1 {
+				t.Fatalf("Got %d and %d requests, want 2 and 1", len(limitedTimes), len(otherTimes))
+			}
+			if pause := limitedTimes[1].Sub(limitedTimes[0]); pause < tt.minPause {
+				t.Errorf("Rate limited request retried after %v, want at least %v", pause, tt.minPause)
+			}
+			if pause := otherTimes[0].Sub(limitedTimes[0]); pause < tt.minPause {
+				t.Errorf("Other request sent after %v, want at least %v", pause, tt.minPause)
+			}
+		})
+	}
+}
+
+func TestRetryAfterTooLong(t *testing.T) {
+	server := owapitest.NewServer()
+	defer server.Close()
+	path := owapitest.StatsPath(testBattleTag)
+	server.Handle(path, owapitest.RateLimitedResponse(time.Minute))
+	client := newTestClient(t, server, owapi.ClientOptions{})
+
+	if _, err := client.GetStats(context.Background(), owapi.NewPlayer(testBattleTag), owapi.ModeCompetitive); errors.Cause(err) != owapi.ErrRateLimited {
+		t.Errorf("GetStats when rate limited returned %v, want %v", err, owapi.ErrRateLimited)
+	}
+	// Other requests are paused too long to be sent at all
+	server.Handle(owapitest.StatsPath("other#1234"), owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := client.GetStats(ctx, owapi.NewPlayer("other#1234"), owapi.ModeCompetitive); errors.Cause(err) != owapi.ErrRateLimited {
+		t.Errorf("GetStats when paused returned %v, want %v", err, owapi.ErrRateLimited)
+	}
+	if n := server.RequestsTo(owapitest.StatsPath("other#1234")); n != 0 {
+		t.Errorf("RequestsTo other player = %d, want 0", n)
+	}
+}
+
+func TestRetryNotForContextErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctx     func() (context.Context, context.CancelFunc)
+		wantErr error
+	}{
+		{"Canceled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+		{"DeadlineExceeded", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := owapitest.NewServer()
+			defer server.Close()
+			path := owapitest.StatsPath(testBattleTag)
+			server.Handle(path, owapitest.StatsResponse(owapi.RegionEU, newTestStats(25, 10), nil).WithDelay(time.Second))
+			client := newTestClient(t, server, owapi.ClientOptions{})
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			req, err := client.NewRequest(ctx, path)
+			if err != nil {
+				t.Fatalf("NewRequest returned error: %+v", err)
+			}
+			// Not the api's fault, so not an ErrUpstreamUnavailable
+			if _, err := client.Do(req, nil); errors.Cause(err) != tt.wantErr {
+				t.Errorf("Do returned %v, want %v", err, tt.wantErr)
+			}
+			if n := server.RequestsTo(path); n != 1 {
+				t.Errorf("RequestsTo = %d, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package owapi
+
+import "strings"
+
+// Role is a role that competitive players are ranked in.
+type Role string
+
+const (
+	RoleTank    Role = "tank"
+	RoleDamage  Role = "damage"
+	RoleSupport Role = "support"
+)
+
+// Roles are the ranked roles, in the order they are shown in game.
+var Roles = []Role{RoleTank, RoleDamage, RoleSupport}
+
+// String returns the human readable name of the role.
+func (r Role) String() string {
+	return strings.Title(string(r))
+}
+
+// RoleRank is the competitive rank of a player in a role.
+type RoleRank struct {
+	Role Role
+	// The skill rating in the role, 0 if not placed
+	Rank int
+	// The tier of the skill rating as named by the api, e.g. "gold".
+	// Empty if not placed
+	Tier string
+}
+
+// Placed returns true if the player has a rank in the role.
+func (rr RoleRank) Placed() bool {
+	return rr.Rank > 0
+}
+
+// Roles returns the rank of the user in each role, in the order of
+// Roles. Roles the user is not placed in are included, with a zero rank.
+func (us *UserStats) Roles() []RoleRank {
+	return []RoleRank{
+		{RoleTank, us.OverallStats.TankRank, us.OverallStats.TankTier},
+		{RoleDamage, us.OverallStats.DamageRank, us.OverallStats.DamageTier},
+		{RoleSupport, us.OverallStats.SupportRank, us.OverallStats.SupportTier},
+	}
+}
+
+// PlacedRoles returns the number of roles the user is placed in.
+func (us *UserStats) PlacedRoles() int {
+	placed := 0
+	for _, rr := range us.Roles() {
+		if rr.Placed() {
+			placed++
+		}
+	}
+	return placed
+}
+
+// gamesPlayed returns the number of games played. Quick play stats do
+// not include the number of games played, so wins and losses are used
+// if the number is missing.
+func (us *UserStats) gamesPlayed() int {
+	if us.OverallStats.Games > 0 {
+		return us.OverallStats.Games
+	}
+	return us.OverallStats.Wins + us.OverallStats.Losses
+}
+
+// playedMoreThan returns true if the user has played more in these stats
+// than in the other stats. Time played is compared first, as it is set
+// for all modes, then the number of games and last the number of roles
+// placed in.
+func (us *UserStats) playedMoreThan(other *UserStats) bool {
+	if us.GameStats.TimePlayed != other.GameStats.TimePlayed {
+		return us.GameStats.TimePlayed > other.GameStats.TimePlayed
+	}
+	if us.gamesPlayed() != other.gamesPlayed() {
+		return us.gamesPlayed() > other.gamesPlayed()
+	}
+	return us.PlacedRoles() > other.PlacedRoles()
+}
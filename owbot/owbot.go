@@ -5,7 +5,6 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/verath/owbot-bot/owbot/owapi"
 	"strings"
 	"time"
 )
@@ -31,15 +30,30 @@ const (
 var gitRevision = "master"
 
 // Bot is the main component of the ow-bot. It handles events
-// from Discord and uses the owapi client to respond to queries.
+// from Discord and uses the stats provider to respond to queries.
 type Bot struct {
 	logger         *logrus.Logger
 	discordSession *discordgo.Session
-	owAPIClient    *owapi.Client
+	statsProvider  StatsProvider
 	userSource     UserSource
+	// Previously seen achievements, used to find newly
+	// unlocked achievements
+	achievementSource AchievementSource
+	// Preferences of users and guilds, e.g. the output format
+	preferenceSource PreferenceSource
+	// The history of changes to the users of the userSource
+	historySource HistorySource
+	// Pending challenges of users verifying their accounts. Nil if
+	// verification is disabled
+	verifier *Verifier
 }
 
-func New(logger *logrus.Logger, discordToken string, userSource UserSource) (*Bot, error) {
+// New creates a new Bot. Users can verify their accounts by changing their
+// profile icon to one of the verifyIcons, verification is disabled if there
+// are no verifyIcons.
+func New(logger *logrus.Logger, discordToken string, statsProvider StatsProvider, userSource UserSource,
+	achievementSource AchievementSource, preferenceSource PreferenceSource, historySource HistorySource,
+	verifyIcons []VerifyIcon) (*Bot, error) {
 	// Make sure the token is prefixed by "Bot "
 	// see https://github.com/hammerandchisel/discord-api-docs/issues/119
 	if !strings.HasPrefix(discordToken, "Bot ") {
@@ -49,15 +63,19 @@ func New(logger *logrus.Logger, discordToken string, userSource UserSource) (*Bo
 	if err != nil {
 		return nil, errors.Wrap(err, "Error creating discordgo session")
 	}
-	owAPIClient, err := owapi.NewClient(logger)
-	if err != nil {
-		return nil, errors.Wrap(err, "Error creating owapi client")
+	var verifier *Verifier
+	if len(verifyIcons) > 0 {
+		verifier = NewVerifier(statsProvider, verifyIcons, verifyChallengeTimeout)
 	}
 	return &Bot{
-		logger:         logger,
-		discordSession: discordSession,
-		owAPIClient:    owAPIClient,
-		userSource:     userSource,
+		logger:            logger,
+		discordSession:    discordSession,
+		statsProvider:     statsProvider,
+		userSource:        userSource,
+		achievementSource: achievementSource,
+		preferenceSource:  preferenceSource,
+		historySource:     historySource,
+		verifier:          verifier,
 	}, nil
 }
 
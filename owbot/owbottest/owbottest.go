@@ -0,0 +1,531 @@
+// Package owbottest provides helpers for testing implementations of
+// the interfaces of the owbot package.
+//
+// TestUserSource checks that a UserSource behaves as the owbot expects
+// of it, and should be run against every implementation:
+//
+//	func TestMyUserSource(t *testing.T) {
+//		owbottest.TestUserSource(t, func() (owbot.UserSource, error) {
+//			return NewMyUserSource(), nil
+//		})
+//	}
+package owbottest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/verath/owbot-bot/owbot"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// The number of goroutines used by the concurrency tests
+const concurrency = 8
+
+// The number of operations done by each goroutine in the
+// concurrency tests
+const concurrencyOps = 50
+
+// TestUserSource runs the UserSource conformance tests, each as a subtest
+// of t. newSource must return a new, empty, UserSource each time it is
+// called. The sources are closed by the tests.
+func TestUserSource(t *testing.T, newSource func() (owbot.UserSource, error)) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, source owbot.UserSource)
+	}{
+		{"GetMissing", testGetMissing},
+		{"SaveGet", testSaveGet},
+		{"SaveOverwrites", testSaveOverwrites},
+		{"SaveCopies", testSaveCopies},
+		{"GetCopies", testGetCopies},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+		{"Scopes", testScopes},
+		{"List", testList},
+		{"ListResume", testListResume},
+		{"ListFilter", testListFilter},
+		{"ListCreatedByUpdated", testListCreatedByUpdated},
+		{"ListInvalidLimit", testListInvalidLimit},
+		{"ForEachUser", testForEachUser},
+		{"ForEachUserError", testForEachUserError},
+		{"FindByBattleTag", testFindByBattleTag},
+		{"Concurrent", testConcurrent},
+		{"Close", testClose},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			source, err := newSource()
+			if err != nil {
+				t.Fatalf("Could not create user source: %+v", err)
+			}
+			// Closing twice must be safe, so we can always close here
+			defer source.Close()
+			test.fn(t, source)
+		})
+	}
+}
+
+// newUser returns a user with all fields set.
+func newUser(id string) *owbot.User {
+	return &owbot.User{
+		ID: id,
+		Accounts: []owbot.Account{
+			{Label: "main", BattleTag: "player#" + id, Region: owapi.RegionEU, Platform: owapi.PlatformPC},
+			{Label: "alt", BattleTag: "alt#" + id, Platform: owapi.PlatformPSN},
+		},
+		Primary:   "alt",
+		CreatedBy: "creator" + id,
+	}
+}
+
+func mustSave(t *testing.T, source owbot.UserSource, user *owbot.User) {
+	t.Helper()
+	if err := source.Save(user); err != nil {
+		t.Fatalf("Save(%q) returned error: %+v", user.ID, err)
+	}
+}
+
+func mustGet(t *testing.T, source owbot.UserSource, guildID, userID string) *owbot.User {
+	t.Helper()
+	user, err := source.Get(guildID, userID)
+	if err != nil {
+		t.Fatalf("Get(%q, %q) returned error: %+v", guildID, userID, err)
+	}
+	return user
+}
+
+func testGetMissing(t *testing.T, source owbot.UserSource) {
+	if user := mustGet(t, source, owbot.GlobalScope, "missing"); user != nil {
+		t.Errorf("Get of missing user = %+v, want nil", user)
+	}
+	mustSave(t, source, newUser("1"))
+	if user := mustGet(t, source, owbot.GlobalScope, "missing"); user != nil {
+		t.Errorf("Get of missing user = %+v, want nil", user)
+	}
+}
+
+func testSaveGet(t *testing.T, source owbot.UserSource) {
+	want := newUser("1")
+	mustSave(t, source, want)
+	got := mustGet(t, source, owbot.GlobalScope, "1")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Get = %+v, want %+v", got, want)
+	}
+}
+
+func testSaveOverwrites(t *testing.T, source owbot.UserSource) {
+	mustSave(t, source, newUser("1"))
+	want := newUser("1")
+	want.Accounts = want.Accounts[:1]
+	want.Accounts[0].BattleTag = "other#1234"
+	want.Accounts[0].Region = ""
+	want.Primary = "main"
+	mustSave(t, source, want)
+	got := mustGet(t, source, owbot.GlobalScope, "1")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Get after overwrite = %+v, want %+v", got, want)
+	}
+}
+
+func testSaveCopies(t *testing.T, source owbot.UserSource) {
+	user := newUser("1")
+	mustSave(t, source, user)
+	// Modifying the saved user must not modify the stored user
+	user.Accounts[0].BattleTag = "modified#1234"
+	got := mustGet(t, source, owbot.GlobalScope, "1")
+	if want := newUser("1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Get after modifying saved user = %+v, want %+v", got, want)
+	}
+}
+
+func testGetCopies(t *testing.T, source owbot.UserSource) {
+	mustSave(t, source, newUser("1"))
+	// Modifying a returned user must not modify the stored user
+	mustGet(t, source, owbot.GlobalScope, "1").Accounts[0].BattleTag = "modified#1234"
+	got := mustGet(t, source, owbot.GlobalScope, "1")
+	if want := newUser("1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Get after modifying returned user = %+v, want %+v", got, want)
+	}
+	if mustGet(t, source, owbot.GlobalScope, "1") == got {
+		t.Error("Get returned the same pointer twice")
+	}
+}
+
+func testDelete(t *testing.T, source owbot.UserSource) {
+	mustSave(t, source, newUser("1"))
+	mustSave(t, source, newUser("2"))
+	if err := source.Delete(owbot.GlobalScope, "1"); err != nil {
+		t.Fatalf("Delete returned error: %+v", err)
+	}
+	if user := mustGet(t, source, owbot.GlobalScope, "1"); user != nil {
+		t.Errorf("Get of deleted user = %+v, want nil", user)
+	}
+	// Other users must be left alone
+	if got, want := mustGet(t, source, owbot.GlobalScope, "2"), newUser("2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Get of other user = %+v, want %+v", got, want)
+	}
+	// A deleted user can be saved again
+	mustSave(t, source, newUser("1"))
+	if got, want := mustGet(t, source, owbot.GlobalScope, "1"), newUser("1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Get of re-saved user = %+v, want %+v", got, want)
+	}
+}
+
+func testDeleteMissing(t *testing.T, source owbot.UserSource) {
+	if err := source.Delete(owbot.GlobalScope, "missing"); err != nil {
+		t.Errorf("Delete of missing user returned error: %+v", err)
+	}
+}
+
+func testScopes(t *testing.T, source owbot.UserSource) {
+	global := newUser("1")
+	guildA := newUser("1")
+	guildA.GuildID = "a"
+	guildA.Accounts[0].BattleTag = "guildA#1234"
+	guildB := newUser("1")
+	guildB.GuildID = "b"
+	guildB.Accounts[0].BattleTag = "guildB#1234"
+
+	// The global user must not be returned for a guild
+	mustSave(t, source, global)
+	if user := mustGet(t, source, "a", "1"); user != nil {
+		t.Errorf("Get in guild of global user = %+v, want nil", user)
+	}
+	// Nor a guild user for the global scope, or another guild
+	mustSave(t, source, guildA)
+	if got := mustGet(t, source, owbot.GlobalScope, "1"); !reflect.DeepEqual(got, global) {
+		t.Errorf("Get of global user = %+v, want %+v", got, global)
+	}
+	if user := mustGet(t, source, "b", "1"); user != nil {
+		t.Errorf("Get in other guild = %+v, want nil", user)
+	}
+	mustSave(t, source, guildB)
+	for _, want := range []*owbot.User{global, guildA, guildB} {
+		if got := mustGet(t, source, want.GuildID, want.ID); !reflect.DeepEqual(got, want) {
+			t.Errorf("Get(%q, %q) = %+v, want %+v", want.GuildID, want.ID, got, want)
+		}
+	}
+	// Deleting in one scope leaves the others alone
+	if err := source.Delete("a", "1"); err != nil {
+		t.Fatalf("Delete returned error: %+v", err)
+	}
+	if user := mustGet(t, source, "a", "1"); user != nil {
+		t.Errorf("Get of deleted guild user = %+v, want nil", user)
+	}
+	for _, want := range []*owbot.User{global, guildB} {
+		if got := mustGet(t, source, want.GuildID, want.ID); !reflect.DeepEqual(got, want) {
+			t.Errorf("Get(%q, %q) after delete = %+v, want %+v", want.GuildID, want.ID, got, want)
+		}
+	}
+	// Deleting in a guild without users is not an error
+	if err := source.Delete("missing", "1"); err != nil {
+		t.Errorf("Delete in guild without users returned error: %+v", err)
+	}
+}
+
+// listPages returns the users matching the filter, listed limit users at
+// a time, failing the test on errors
+func listPages(t *testing.T, source owbot.UserSource, filter owbot.UserFilter, limit int) []*owbot.User {
+	t.Helper()
+	var users []*owbot.User
+	var after *owbot.User
+	for {
+		page, err := source.List(filter, after, limit)
+		if err != nil {
+			t.Fatalf("List returned error: %+v", err)
+		}
+		if len(page) > limit {
+			t.Fatalf("List returned %d users, want at most %d", len(page), limit)
+		}
+		users = append(users, page...)
+		if len(page) < limit {
+			return users
+		}
+		after = page[len(page)-1]
+	}
+}
+
+// saveGuildUsers saves the users 1 and 2 of the global scope and of the
+// guilds a and b, out of order, returning them in order
+func saveGuildUsers(t *testing.T, source owbot.UserSource) []*owbot.User {
+	t.Helper()
+	var users []*owbot.User
+	for _, guildID := range []string{owbot.GlobalScope, "a", "b"} {
+		for _, id := range []string{"1", "2"} {
+			user := newUser(id)
+			user.GuildID = guildID
+			users = append(users, user)
+		}
+	}
+	// Saved out of order, List must sort them
+	for i := len(users) - 1; i >= 0; i-- {
+		mustSave(t, source, users[i])
+	}
+	return users
+}
+
+func testList(t *testing.T, source owbot.UserSource) {
+	want := saveGuildUsers(t, source)
+	for _, limit := range []int{1, 2, 4, len(want), 100} {
+		if got := listPages(t, source, owbot.UserFilter{}, limit); !reflect.DeepEqual(got, want) {
+			t.Errorf("List users %d at a time = %+v, want %+v", limit, got, want)
+		}
+	}
+	got, err := source.List(owbot.UserFilter{}, nil, len(want))
+	if err != nil {
+		t.Fatalf("List returned error: %+v", err)
+	}
+	// Modifying the users must not modify the stored users
+	got[0].Accounts[0].BattleTag = "modified#1234"
+	if user := mustGet(t, source, want[0].GuildID, want[0].ID); !reflect.DeepEqual(user, want[0]) {
+		t.Errorf("Get after modifying listed user = %+v, want %+v", user, want[0])
+	}
+}
+
+func testListResume(t *testing.T, source owbot.UserSource) {
+	users := saveGuildUsers(t, source)
+	tests := []struct {
+		name  string
+		after *owbot.User
+		want  []*owbot.User
+	}{
+		{"Listed", users[2], users[3:]},
+		{"Last", users[len(users)-1], nil},
+		// Only the GuildID and ID are used, so a page continues after
+		// the user of the previous page even if it has been deleted
+		{"Deleted", &owbot.User{GuildID: "a", ID: "0"}, users[2:]},
+		{"MissingGuild", &owbot.User{GuildID: "aa", ID: "1"}, users[4:]},
+	}
+	for _, test := range tests {
+		got, err := source.List(owbot.UserFilter{}, test.after, len(users))
+		if err != nil {
+			t.Fatalf("%s: List returned error: %+v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: List users = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func testListFilter(t *testing.T, source owbot.UserSource) {
+	users := make(map[string]*owbot.User)
+	for _, user := range saveGuildUsers(t, source) {
+		users[user.GuildID+":"+user.ID] = user
+	}
+	tests := []struct {
+		name   string
+		filter owbot.UserFilter
+		want   []*owbot.User
+	}{
+		{"Guild", owbot.UserFilter{GuildIDs: []string{"a"}},
+			[]*owbot.User{users["a:1"], users["a:2"]}},
+		{"Guilds", owbot.UserFilter{GuildIDs: []string{"b", owbot.GlobalScope}},
+			[]*owbot.User{users[":1"], users[":2"], users["b:1"], users["b:2"]}},
+		{"MissingGuild", owbot.UserFilter{GuildIDs: []string{"missing"}}, nil},
+		{"CreatedBy", owbot.UserFilter{CreatedBy: "creator2"},
+			[]*owbot.User{users[":2"], users["a:2"], users["b:2"]}},
+		{"GuildCreatedBy", owbot.UserFilter{GuildIDs: []string{"b"}, CreatedBy: "creator1"},
+			[]*owbot.User{users["b:1"]}},
+		{"MissingCreatedBy", owbot.UserFilter{CreatedBy: "missing"}, nil},
+	}
+	for _, test := range tests {
+		for _, limit := range []int{1, 100} {
+			if got := listPages(t, source, test.filter, limit); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: List users %d at a time = %+v, want %+v", test.name, limit, got, test.want)
+			}
+		}
+	}
+}
+
+func testListCreatedByUpdated(t *testing.T, source owbot.UserSource) {
+	user := newUser("1")
+	mustSave(t, source, user)
+	updated := newUser("1")
+	updated.CreatedBy = "updater"
+	mustSave(t, source, updated)
+	other := newUser("2")
+	mustSave(t, source, other)
+
+	creatorFilter := owbot.UserFilter{CreatedBy: user.CreatedBy}
+	if got := listPages(t, source, creatorFilter, 100); got != nil {
+		t.Errorf("List by previous CreatedBy = %+v, want none", got)
+	}
+	updaterFilter := owbot.UserFilter{CreatedBy: "updater"}
+	if got := listPages(t, source, updaterFilter, 100); !reflect.DeepEqual(got, []*owbot.User{updated}) {
+		t.Errorf("List by CreatedBy of update = %+v, want %+v", got, updated)
+	}
+	if err := source.Delete(updated.GuildID, updated.ID); err != nil {
+		t.Fatalf("Delete returned error: %+v", err)
+	}
+	if got := listPages(t, source, updaterFilter, 100); got != nil {
+		t.Errorf("List by CreatedBy of deleted user = %+v, want none", got)
+	}
+}
+
+func testListInvalidLimit(t *testing.T, source owbot.UserSource) {
+	saveGuildUsers(t, source)
+	for _, limit := range []int{0, -1} {
+		if users, err := source.List(owbot.UserFilter{}, nil, limit); err == nil {
+			t.Errorf("List with limit %d = %+v, want error", limit, users)
+		}
+	}
+}
+
+func testForEachUser(t *testing.T, source owbot.UserSource) {
+	// More users than are listed at a time by ForEachUser
+	var want []string
+	for i := 0; i < 250; i++ {
+		user := newUser(fmt.Sprintf("%03d", i))
+		mustSave(t, source, user)
+		want = append(want, user.ID)
+	}
+	var got []string
+	err := owbot.ForEachUser(source, owbot.UserFilter{}, func(user *owbot.User) error {
+		got = append(got, user.ID)
+		// The source must be usable from within fn
+		user.Primary = "main"
+		return source.Save(user)
+	})
+	if err != nil {
+		t.Fatalf("ForEachUser returned error: %+v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEachUser user ids = %v, want %v", got, want)
+	}
+	if user := mustGet(t, source, owbot.GlobalScope, want[0]); user.Primary != "main" {
+		t.Errorf("Primary of user saved by fn = %q, want %q", user.Primary, "main")
+	}
+}
+
+func testForEachUserError(t *testing.T, source owbot.UserSource) {
+	mustSave(t, source, newUser("1"))
+	mustSave(t, source, newUser("2"))
+	wantErr := errors.New("stop")
+	calls := 0
+	err := owbot.ForEachUser(source, owbot.UserFilter{}, func(user *owbot.User) error {
+		calls++
+		return wantErr
+	})
+	if err != wantErr {
+		t.Errorf("ForEachUser returned %v, want %v", err, wantErr)
+	}
+	if calls != 1 {
+		t.Errorf("ForEachUser called fn %d times after error, want 1", calls)
+	}
+}
+
+// findByBattleTag returns the users FindByBattleTag returns, failing
+// the test on errors
+func findByBattleTag(t *testing.T, source owbot.UserSource, battleTag string) []*owbot.User {
+	t.Helper()
+	users, err := source.FindByBattleTag(battleTag)
+	if err != nil {
+		t.Fatalf("FindByBattleTag(%q) returned error: %+v", battleTag, err)
+	}
+	return users
+}
+
+func testFindByBattleTag(t *testing.T, source owbot.UserSource) {
+	guildUser := newUser("1")
+	guildUser.GuildID = "a"
+	globalUser := newUser("1")
+	other := newUser("2")
+	// Another user, with the same BattleTag as the alt of user 1
+	other.Accounts[0].BattleTag = "alt#1"
+	mustSave(t, source, guildUser)
+	mustSave(t, source, globalUser)
+	mustSave(t, source, other)
+
+	// BattleTags are compared case insensitively
+	want := []*owbot.User{globalUser, other, guildUser}
+	if got := findByBattleTag(t, source, "ALT#1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindByBattleTag = %+v, want %+v", got, want)
+	}
+	if users := findByBattleTag(t, source, "missing#1234"); len(users) != 0 {
+		t.Errorf("FindByBattleTag of missing BattleTag = %+v, want none", users)
+	}
+
+	// Changed and removed accounts are no longer found
+	other.Accounts[0].BattleTag = "changed#2"
+	mustSave(t, source, other)
+	if err := source.Delete("a", "1"); err != nil {
+		t.Fatalf("Delete returned error: %+v", err)
+	}
+	want = []*owbot.User{globalUser}
+	if got := findByBattleTag(t, source, "alt#1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindByBattleTag after changes = %+v, want %+v", got, want)
+	}
+	want = []*owbot.User{other}
+	if got := findByBattleTag(t, source, "changed#2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindByBattleTag of changed BattleTag = %+v, want %+v", got, want)
+	}
+}
+
+func testConcurrent(t *testing.T, source owbot.UserSource) {
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency*concurrencyOps)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < concurrencyOps; j++ {
+				// Each goroutine has its own user, spread over two
+				// guilds, and they all share the global "shared" user
+				own := newUser(fmt.Sprintf("%d", i))
+				own.GuildID = fmt.Sprintf("guild%d", i%2)
+				own.Accounts[0].BattleTag = fmt.Sprintf("player#%d", j)
+				shared := newUser("shared")
+				shared.CreatedBy = own.ID
+				for _, user := range []*owbot.User{own, shared} {
+					if err := source.Save(user); err != nil {
+						errs <- err
+						return
+					}
+				}
+				got, err := source.Get(own.GuildID, own.ID)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !reflect.DeepEqual(got, own) {
+					errs <- fmt.Errorf("Get(%q) = %+v, want %+v", own.ID, got, own)
+					return
+				}
+				if _, err := source.Get(shared.GuildID, "shared"); err != nil {
+					errs <- err
+					return
+				}
+				if j%10 == 9 {
+					if err := source.Delete(own.GuildID, own.ID); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if shared := mustGet(t, source, owbot.GlobalScope, "shared"); shared == nil || shared.Accounts[0].BattleTag != "player#shared" {
+		t.Errorf("Get(%q) after concurrent saves = %+v", "shared", shared)
+	}
+}
+
+func testClose(t *testing.T, source owbot.UserSource) {
+	mustSave(t, source, newUser("1"))
+	if err := source.Close(); err != nil {
+		t.Errorf("Close returned error: %+v", err)
+	}
+	// The owbot closes all sources, which may share resources, so
+	// closing more than once must be safe
+	if err := source.Close(); err != nil {
+		t.Errorf("Second Close returned error: %+v", err)
+	}
+}
@@ -0,0 +1,351 @@
+// Package playoverwatch implements a stats provider that parses the
+// public career profile pages on playoverwatch.com. It is used as a
+// fallback for when the third-party owapi is unavailable.
+package playoverwatch
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/golang-lru"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The default base url of the career profile pages
+	profileBaseUrl = "https://playoverwatch.com/en-us/career/"
+
+	// The number of parsed profiles to cache
+	cacheSizeProfiles = 100
+
+	// Time before a parsed profile is considered stale and should be re-fetched
+	cacheDurationProfiles = 5 * time.Minute
+
+	// The data-category-id of the "ALL HEROES" category
+	categoryAllHeroes = "0x02E00000FFFFFFFF"
+)
+
+// ErrNotSupported is returned for requests that can not be answered
+// from the career profile page.
+var ErrNotSupported = errors.New("Not supported by the playoverwatch provider")
+
+var (
+	regexAvatar   = regexp.MustCompile(`<img class="player-portrait" src="([^"]+)"`)
+	regexLevel    = regexp.MustCompile(`class="player-level"[^>]*>\s*<div class="u-vertical-center">(\d+)</div>`)
+	regexCompRank = regexp.MustCompile(`(?s)class="competitive-rank".*?<div class="u-align-center h5">(\d+)</div>`)
+	regexRoleRank = regexp.MustCompile(`(?s)data-ow-tooltip-text="(Tank|Damage|Support) Skill Rating".*?<div class="competitive-rank-level">(\d+)</div>`)
+	regexStatRow  = regexp.MustCompile(`<td[^>]*>([^<]+)</td>\s*<td[^>]*>([^<]+)</td>`)
+)
+
+// profile is the data parsed from a career profile page
+type profile struct {
+	// The time the page was fetched
+	fetchedAt time.Time
+	level     int
+	compRank  int
+	// The skill rating of each role the player is placed in
+	roleRanks map[owapi.Role]int
+	// The "ALL HEROES" stats of each mode, mapping the stat name
+	// to its (unparsed) value
+	modeStats map[owapi.Mode]map[string]string
+	// The url of the profile icon, empty if not found
+	avatar string
+}
+
+type profileCacheEntry struct {
+	*profile
+	addedAt time.Time
+}
+
+// Client is a StatsProvider that parses career profile pages.
+type Client struct {
+	logger       *logrus.Entry
+	client       *http.Client
+	profileCache *lru.ARCCache
+	baseUrl      *url.URL
+}
+
+// Creates a new Client. The baseUrlStr is the url of the career profile
+// pages, or empty for the default playoverwatch.com url. If httpClient is
+// nil, http.DefaultClient is used.
+func NewClient(logger *logrus.Logger, httpClient *http.Client, baseUrlStr string) (*Client, error) {
+	profileCache, err := lru.NewARC(cacheSizeProfiles)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if baseUrlStr == "" {
+		baseUrlStr = profileBaseUrl
+	}
+	baseUrl, err := url.Parse(baseUrlStr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing baseUrl")
+	}
+	if !strings.HasSuffix(baseUrl.Path, "/") {
+		baseUrl.Path += "/"
+	}
+	return &Client{
+		logger:       logger.WithField("module", "playoverwatch"),
+		client:       httpClient,
+		profileCache: profileCache,
+		baseUrl:      baseUrl,
+	}, nil
+}
+
+// Returns a UserStats object for the provided player and mode. Returns
+// owapi.ErrNoCompetitiveData, or owapi.ErrNoStatsForMode for other modes,
+// if the player has no stats for the mode. The career profile has the same
+// stats for all regions, so the region of the player is ignored.
+func (c *Client) GetStats(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserStats, error) {
+	p, err := c.getProfile(ctx, player, false)
+	if err != nil {
+		return nil, err
+	}
+	return profileStats(p, player, mode)
+}
+
+// GetFreshStats returns the UserStats for the provided player and mode, as
+// GetStats, but from a profile page requested after the call was made
+// rather than from the cache.
+func (c *Client) GetFreshStats(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserStats, error) {
+	p, err := c.getProfile(ctx, player, true)
+	if err != nil {
+		return nil, err
+	}
+	return profileStats(p, player, mode)
+}
+
+// profileStats returns the UserStats of the player and mode in the
+// profile.
+func profileStats(p *profile, player owapi.Player, mode owapi.Mode) (*owapi.UserStats, error) {
+	stats, ok := p.modeStats[mode]
+	if !ok {
+		return nil, owapi.NoStatsError(mode)
+	}
+
+	userStats := &owapi.UserStats{
+		BattleTag: player.BattleTag,
+		Mode:      mode,
+		FetchedAt: p.fetchedAt,
+	}
+	userStats.OverallStats.Avatar = p.avatar
+	userStats.OverallStats.Level = p.level
+	if mode == owapi.ModeCompetitive {
+		userStats.OverallStats.CompRank = p.compRank
+		userStats.OverallStats.TankRank = p.roleRanks[owapi.RoleTank]
+		userStats.OverallStats.DamageRank = p.roleRanks[owapi.RoleDamage]
+		userStats.OverallStats.SupportRank = p.roleRanks[owapi.RoleSupport]
+	}
+	userStats.OverallStats.Games = int(parseNumber(stats["Games Played"]))
+	userStats.OverallStats.Wins = int(parseNumber(stats["Games Won"]))
+	userStats.OverallStats.Losses = int(parseNumber(stats["Games Lost"]))
+	if userStats.OverallStats.Games > 0 {
+		userStats.OverallStats.WinRate = float32(userStats.OverallStats.Wins) /
+			float32(userStats.OverallStats.Games) * 100
+	}
+	userStats.GameStats.Eliminations = parseNumber(stats["Eliminations"])
+	userStats.GameStats.Deaths = parseNumber(stats["Deaths"])
+	userStats.GameStats.SoloKills = parseNumber(stats["Solo Kills"])
+	if userStats.GameStats.Deaths > 0 {
+		userStats.GameStats.KPD = userStats.GameStats.Eliminations / userStats.GameStats.Deaths
+	}
+	userStats.GameStats.TimePlayed = parseHours(stats["Time Played"])
+	userStats.GameStats.Medals = parseNumber(stats["Medals"])
+	userStats.GameStats.MedalsGold = parseNumber(stats["Medals - Gold"])
+	userStats.GameStats.MedalsSilver = parseNumber(stats["Medals - Silver"])
+	userStats.GameStats.MedalsBronze = parseNumber(stats["Medals - Bronze"])
+	return userStats, nil
+}
+
+// GetHeroes is not supported by the career profile provider, and always
+// returns ErrNotSupported.
+func (c *Client) GetHeroes(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserHeroes, error) {
+	return nil, ErrNotSupported
+}
+
+// GetAchievements is not supported by the career profile provider, and
+// always returns ErrNotSupported.
+func (c *Client) GetAchievements(ctx context.Context, player owapi.Player) (*owapi.UserAchievements, error) {
+	return nil, ErrNotSupported
+}
+
+// getProfile returns the parsed career profile for the player, either
+// from cache or by requesting the profile page. If fresh, the profile page
+// is always requested.
+func (c *Client) getProfile(ctx context.Context, player owapi.Player, fresh bool) (*profile, error) {
+	platform := player.Platform
+	if platform == "" {
+		platform = owapi.PlatformPC
+	}
+	// Url friendly battleTag
+	battleTag := strings.Replace(player.BattleTag, "#", "-", -1)
+	path := fmt.Sprintf("%s/%s", platform, url.PathEscape(battleTag))
+
+	if cacheEntry, ok := c.profileCache.Get(path); ok && !fresh {
+		profileCacheEntry := cacheEntry.(profileCacheEntry)
+		if time.Since(profileCacheEntry.addedAt) <= cacheDurationProfiles {
+			return profileCacheEntry.profile, nil
+		}
+	}
+
+	ref, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", c.baseUrl.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	reqLogger := c.logger.WithFields(logrus.Fields{"method": req.Method, "url": req.URL})
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, owapi.UpstreamError(err)
+	}
+	defer resp.Body.Close()
+	if err := owapi.CheckResponse(resp); err != nil {
+		reqLogger.WithError(err).Warn("Bad response")
+		return nil, owapi.UpstreamError(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, owapi.UpstreamError(errors.Wrap(err, "Could not read response body"))
+	}
+	p, err := parseProfile(string(body))
+	if err != nil {
+		reqLogger.WithError(err).Warn("Could not parse profile page")
+		if errors.Cause(err) == owapi.ErrPrivateProfile {
+			return nil, err
+		}
+		// A page we can not parse is most likely an error page, or the
+		// layout of the page has changed
+		return nil, owapi.UpstreamError(err)
+	}
+	p.fetchedAt = time.Now()
+	reqLogger.Debug("Request was successful")
+
+	c.profileCache.Add(path, profileCacheEntry{p, time.Now()})
+	return p, nil
+}
+
+// parseProfile parses the html of a career profile page.
+func parseProfile(page string) (*profile, error) {
+	if strings.Contains(page, "profile is currently private") {
+		return nil, owapi.ErrPrivateProfile
+	}
+	matches := regexLevel.FindStringSubmatch(page)
+	if matches == nil {
+		return nil, errors.New("Could not find player level in profile page")
+	}
+	p := &profile{
+		modeStats: make(map[owapi.Mode]map[string]string),
+		roleRanks: make(map[owapi.Role]int),
+	}
+	p.level, _ = strconv.Atoi(matches[1])
+	if matches := regexAvatar.FindStringSubmatch(page); matches != nil {
+		p.avatar = matches[1]
+	}
+	// Profiles have either role ranks, or a single rank from before
+	// role queue
+	for _, matches := range regexRoleRank.FindAllStringSubmatch(page, -1) {
+		role := owapi.Role(strings.ToLower(matches[1]))
+		p.roleRanks[role], _ = strconv.Atoi(matches[2])
+	}
+	if len(p.roleRanks) == 0 {
+		if matches := regexCompRank.FindStringSubmatch(page); matches != nil {
+			p.compRank, _ = strconv.Atoi(matches[1])
+		}
+	}
+	for _, mode := range []owapi.Mode{owapi.ModeQuickplay, owapi.ModeCompetitive} {
+		if stats := parseModeStats(page, mode); stats != nil {
+			p.modeStats[mode] = stats
+		}
+	}
+	return p, nil
+}
+
+// parseModeStats returns the "ALL HEROES" stats table for the mode, or
+// nil if the page has no stats for the mode.
+func parseModeStats(page string, mode owapi.Mode) map[string]string {
+	start := strings.Index(page, fmt.Sprintf(`id="%s"`, string(mode)))
+	if start == -1 {
+		return nil
+	}
+	section := page[start:]
+	// The mode sections follow each other, so the section ends at the
+	// start of any other mode section
+	for _, other := range []owapi.Mode{owapi.ModeQuickplay, owapi.ModeCompetitive} {
+		if other == mode {
+			continue
+		}
+		if end := strings.Index(section, fmt.Sprintf(`id="%s"`, string(other))); end != -1 {
+			section = section[:end]
+		}
+	}
+	start = strings.Index(section, fmt.Sprintf(`data-group-id="stats" data-category-id="%s"`, categoryAllHeroes))
+	if start == -1 {
+		return nil
+	}
+	section = section[start+1:]
+	if end := strings.Index(section, `data-group-id="stats"`); end != -1 {
+		section = section[:end]
+	}
+	stats := make(map[string]string)
+	for _, row := range regexStatRow.FindAllStringSubmatch(section, -1) {
+		stats[strings.TrimSpace(row[1])] = strings.TrimSpace(row[2])
+	}
+	if len(stats) == 0 {
+		return nil
+	}
+	return stats
+}
+
+// parseNumber parses a number such as "1,234" or "56%". Returns 0 if
+// the value could not be parsed.
+func parseNumber(value string) float32 {
+	value = strings.Replace(value, ",", "", -1)
+	value = strings.TrimSuffix(value, "%")
+	f, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return 0
+	}
+	return float32(f)
+}
+
+// parseHours parses a duration such as "12:34:56", "34:56", "12 hours"
+// or "34 minutes" to a number of hours. Returns 0 if the value could not
+// be parsed.
+func parseHours(value string) float32 {
+	if strings.Contains(value, ":") {
+		var seconds float32
+		for _, part := range strings.Split(value, ":") {
+			seconds = seconds*60 + parseNumber(part)
+		}
+		return seconds / 3600
+	}
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return parseNumber(value)
+	}
+	switch strings.TrimSuffix(fields[1], "s") {
+	case "hour":
+		return parseNumber(fields[0])
+	case "minute":
+		return parseNumber(fields[0]) / 60
+	case "second":
+		return parseNumber(fields[0]) / 3600
+	default:
+		return 0
+	}
+}
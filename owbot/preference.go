@@ -0,0 +1,158 @@
+package owbot
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"sync"
+)
+
+// OutputFormat is the format responses are sent in.
+type OutputFormat string
+
+const (
+	// Responses are sent as rich embeds
+	OutputEmbed OutputFormat = "embed"
+	// Responses are sent as markdown text
+	OutputText OutputFormat = "text"
+)
+
+// defaultOutputFormat is used when neither the user nor the guild has
+// an output preference
+const defaultOutputFormat = OutputEmbed
+
+// Preferences are the settings of a user or a guild.
+type Preferences struct {
+	// The format to send responses in. Empty if not set
+	Output OutputFormat `json:"output,omitempty"`
+	// The id of the channel that changes of BattleTags are posted to.
+	// Only used for guilds, empty if not set
+	ModLogChannel string `json:"modLogChannel,omitempty"`
+	// Set if the user is not to be shown by the whois command. Only
+	// used for users
+	HideFromWhois bool `json:"hideFromWhois,omitempty"`
+}
+
+// userPreferencesKey returns the key of the preferences of a user
+func userPreferencesKey(userID string) string {
+	return "user:" + userID
+}
+
+// guildPreferencesKey returns the key of the preferences of a guild
+func guildPreferencesKey(guildID string) string {
+	return "guild:" + guildID
+}
+
+// A simple interface for a data source of preferences, keyed by the
+// user or guild they belong to
+type PreferenceSource interface {
+	io.Closer
+	// Returns the preferences stored for the key, or nil if no
+	// preferences have been stored.
+	Get(key string) (*Preferences, error)
+
+	// Stores the preferences for the key
+	Save(key string, prefs *Preferences) error
+}
+
+// An in memory implementation of a preference source
+type MemoryPreferenceSource struct {
+	mu   sync.Mutex
+	data map[string]Preferences
+}
+
+func NewMemoryPreferenceSource() *MemoryPreferenceSource {
+	return &MemoryPreferenceSource{
+		data: make(map[string]Preferences),
+	}
+}
+
+func (s *MemoryPreferenceSource) Get(key string) (*Preferences, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefs, ok := s.data[key]
+	if !ok {
+		return nil, nil
+	}
+	return &prefs, nil
+}
+
+func (s *MemoryPreferenceSource) Save(key string, prefs *Preferences) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = *prefs
+	return nil
+}
+
+func (s *MemoryPreferenceSource) Close() error {
+	return nil
+}
+
+var bucketPreferences = []byte("preferences")
+
+type BoltPreferenceSource struct {
+	logger *logrus.Entry
+	db     *bolt.DB
+}
+
+func createPreferencesBucket(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketPreferences)
+		return err
+	})
+}
+
+func NewBoltPreferenceSource(logger *logrus.Logger, db *bolt.DB) (*BoltPreferenceSource, error) {
+	// Make sure the preferences bucket exist
+	if err := createPreferencesBucket(db); err != nil {
+		return nil, err
+	}
+
+	// Store the logger as an Entry, adding the module to all log calls
+	loggerEntry := logger.WithField("module", "boltPreferenceSource")
+
+	return &BoltPreferenceSource{
+		db:     db,
+		logger: loggerEntry,
+	}, nil
+}
+
+func (s *BoltPreferenceSource) mustGetBucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		s.logger.WithField("name", name).Panic("Bucket not found")
+	}
+	return bucket
+}
+
+func (s *BoltPreferenceSource) Get(key string) (*Preferences, error) {
+	var prefs *Preferences
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := s.mustGetBucket(tx, bucketPreferences)
+		v := bucket.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		prefs = &Preferences{}
+		return json.Unmarshal(v, prefs)
+	})
+	return prefs, err
+}
+
+func (s *BoltPreferenceSource) Save(key string, prefs *Preferences) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := s.mustGetBucket(tx, bucketPreferences)
+		data, err := json.Marshal(prefs)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), data)
+	})
+}
+
+// Close closes the underlying bolt db. The db is shared with the other
+// bolt sources, closing it more than once is safe.
+func (s *BoltPreferenceSource) Close() error {
+	return s.db.Close()
+}
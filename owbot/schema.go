@@ -0,0 +1,254 @@
+package owbot
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"strconv"
+)
+
+// The meta bucket holds data about the bolt db itself
+var bucketMeta = []byte("meta")
+
+// keySchemaVersion is the key in the meta bucket of the schema version
+var keySchemaVersion = []byte("schemaVersion")
+
+// ErrSchemaTooNew is returned when the schema version of the bolt db is
+// newer than the schema versions known to this version of the bot
+var ErrSchemaTooNew = errors.New("Database schema is newer than supported")
+
+// A schemaMigration changes the data of the bolt db from one schema
+// version to the next
+type schemaMigration struct {
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// schemaMigrations are the migrations of the bolt db, in the order they
+// are applied. The schema version of a db is the number of migrations
+// applied to it, so migrations must only ever be appended.
+var schemaMigrations = []schemaMigration{
+	{"Move users to the global scope", migrateUsersToGlobalScope},
+	{"Convert users to accounts", migrateUsersToAccounts},
+	{"Index users by BattleTag", migrateBattleTagIndex},
+	{"Index users by CreatedBy", migrateCreatedByIndex},
+}
+
+// SchemaVersion returns the schema version of the bolt db used by this
+// version of the bot.
+func SchemaVersion() int {
+	return len(schemaMigrations)
+}
+
+// getSchemaVersion returns the schema version of the bolt db, 0 if no
+// version has been stored.
+func getSchemaVersion(tx *bolt.Tx) (int, error) {
+	bucket := tx.Bucket(bucketMeta)
+	if bucket == nil {
+		return 0, nil
+	}
+	v := bucket.Get(keySchemaVersion)
+	if v == nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid schema version '%s'", v)
+	}
+	return version, nil
+}
+
+// MigrateBoltDB applies the migrations not yet applied to the bolt db,
+// and stores the new schema version. All migrations are applied in a
+// single transaction, so either all or none are applied. Returns
+// ErrSchemaTooNew if the db has a newer schema version than SchemaVersion.
+// Must be called before the db is used by any bolt source.
+func MigrateBoltDB(logger *logrus.Logger, db *bolt.DB) error {
+	logEntry := logger.WithField("module", "boltSchema")
+	return db.Update(func(tx *bolt.Tx) error {
+		version, err := getSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > SchemaVersion() {
+			return errors.Wrapf(ErrSchemaTooNew, "Database schema version %d, supported up to %d",
+				version, SchemaVersion())
+		}
+		if version == SchemaVersion() {
+			return nil
+		}
+		for i := version; i < SchemaVersion(); i++ {
+			migration := schemaMigrations[i]
+			logEntry.WithFields(logrus.Fields{
+				"version":     i + 1,
+				"description": migration.description,
+			}).Info("Applying schema migration")
+			if err := migration.migrate(tx); err != nil {
+				return errors.Wrapf(err, "Schema migration %d (%s) failed", i+1, migration.description)
+			}
+		}
+		bucket, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		logEntry.WithField("version", SchemaVersion()).Info("Database schema up to date")
+		return bucket.Put(keySchemaVersion, []byte(strconv.Itoa(SchemaVersion())))
+	})
+}
+
+// migrateUsersToGlobalScope moves users stored before users were scoped
+// by guild, directly in the users bucket, to the GlobalScope.
+func migrateUsersToGlobalScope(tx *bolt.Tx) error {
+	bucket := tx.Bucket(bucketUsers)
+	if bucket == nil {
+		return nil
+	}
+	global, err := bucket.CreateBucketIfNotExists(bucketUsersGlobal)
+	if err != nil {
+		return err
+	}
+	// Keys can not be deleted while iterating, so collect them first
+	var keys [][]byte
+	err = bucket.ForEach(func(k, v []byte) error {
+		// Nested buckets have a nil value
+		if v != nil {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := global.Put(k, bucket.Get(k)); err != nil {
+			return err
+		}
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateUsersToAccounts converts users stored before users could have
+// more than one account, with a single BattleTag, to users with that
+// BattleTag as their primary account.
+func migrateUsersToAccounts(tx *bolt.Tx) error {
+	// legacyUser is a user that may have been stored with a BattleTag
+	type legacyUser struct {
+		User
+		BattleTag string
+		Region    owapi.Region
+		Platform  owapi.Platform
+	}
+	users := tx.Bucket(bucketUsers)
+	if users == nil {
+		return nil
+	}
+	// Modifying a nested bucket may modify its parent bucket, so the
+	// scopes are collected before any users are converted
+	var scopes [][]byte
+	err := users.ForEach(func(k, v []byte) error {
+		// Nested buckets have a nil value
+		if v == nil {
+			scopes = append(scopes, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, scope := range scopes {
+		bucket := users.Bucket(scope)
+		// The bucket can not be modified while iterating, so
+		// collect the converted users first
+		updated := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var legacy legacyUser
+			if err := json.Unmarshal(v, &legacy); err != nil {
+				return err
+			}
+			if len(legacy.Accounts) > 0 || legacy.BattleTag == "" {
+				return nil
+			}
+			user := legacy.User
+			user.SetAccount(Account{
+				Label:     defaultAccountLabel,
+				BattleTag: legacy.BattleTag,
+				Region:    legacy.Region,
+				Platform:  legacy.Platform,
+			})
+			data, err := json.Marshal(&user)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, data := range updated {
+			if err := bucket.Put([]byte(k), data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateBattleTagIndex indexes the users stored before users were
+// indexed by the BattleTags of their accounts.
+func migrateBattleTagIndex(tx *bolt.Tx) error {
+	index, err := tx.CreateBucketIfNotExists(bucketBattleTags)
+	if err != nil {
+		return err
+	}
+	users := tx.Bucket(bucketUsers)
+	if users == nil {
+		return nil
+	}
+	return users.ForEach(func(scope, v []byte) error {
+		bucket := users.Bucket(scope)
+		if bucket == nil {
+			return nil
+		}
+		// Only the index is modified while iterating the users
+		return bucket.ForEach(func(k, v []byte) error {
+			user := &User{}
+			if err := json.Unmarshal(v, user); err != nil {
+				return errors.Wrapf(err, "Could not decode user '%s' in '%s'", k, scope)
+			}
+			return indexUser(index, user)
+		})
+	})
+}
+
+// migrateCreatedByIndex indexes the users stored before users were
+// indexed by their CreatedBy.
+func migrateCreatedByIndex(tx *bolt.Tx) error {
+	index, err := tx.CreateBucketIfNotExists(bucketCreatedBy)
+	if err != nil {
+		return err
+	}
+	users := tx.Bucket(bucketUsers)
+	if users == nil {
+		return nil
+	}
+	return users.ForEach(func(scope, v []byte) error {
+		bucket := users.Bucket(scope)
+		if bucket == nil {
+			return nil
+		}
+		// Only the index is modified while iterating the users
+		return bucket.ForEach(func(k, v []byte) error {
+			user := &User{}
+			if err := json.Unmarshal(v, user); err != nil {
+				return errors.Wrapf(err, "Could not decode user '%s' in '%s'", k, scope)
+			}
+			return indexCreatedBy(index, user)
+		})
+	})
+}
@@ -0,0 +1,208 @@
+package owbot_test
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/verath/owbot-bot/owbot"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// openTestDB opens a new bolt db in a temp dir. The returned func closes
+// the db and removes the dir.
+func openTestDB(t *testing.T) (*bolt.DB, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "owbot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "owbot.boltdb"), 0600, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+// schemaVersion returns the schema version stored in the db, or -1 if
+// no version is stored
+func schemaVersion(t *testing.T, db *bolt.DB) int {
+	t.Helper()
+	version := -1
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("meta"))
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get([]byte("schemaVersion"))
+		if v == nil {
+			return nil
+		}
+		var err error
+		version, err = strconv.Atoi(string(v))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+// putLegacyUsers stores the users, as json, the way users were stored
+// before the db had a schema version
+func putLegacyUsers(t *testing.T, db *bolt.DB, users map[string]string) {
+	t.Helper()
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("users"))
+		if err != nil {
+			return err
+		}
+		for id, data := range users {
+			if err := bucket.Put([]byte(id), []byte(data)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateBoltDBNewDB(t *testing.T) {
+	db, closeDB := openTestDB(t)
+	defer closeDB()
+
+	if err := owbot.MigrateBoltDB(newTestLogger(), db); err != nil {
+		t.Fatalf("MigrateBoltDB returned error: %+v", err)
+	}
+	if got, want := schemaVersion(t, db), owbot.SchemaVersion(); got != want {
+		t.Errorf("schema version = %d, want %d", got, want)
+	}
+}
+
+func TestMigrateBoltDBLegacyUsers(t *testing.T) {
+	db, closeDB := openTestDB(t)
+	defer closeDB()
+
+	// Users stored before users were scoped by guild, directly in
+	// the users bucket, and before users could have more than one
+	// account
+	putLegacyUsers(t, db, map[string]string{
+		"1": `{"ID":"1","BattleTag":"player#1234","Region":"eu","Platform":"","CreatedBy":"1"}`,
+	})
+	want := &owbot.User{
+		ID:        "1",
+		Accounts:  []owbot.Account{{Label: "main", BattleTag: "player#1234", Region: "eu"}},
+		Primary:   "main",
+		CreatedBy: "1",
+	}
+
+	logger := newTestLogger()
+	// Migrating twice makes sure the migrations are only applied once
+	for i := 0; i < 2; i++ {
+		if err := owbot.MigrateBoltDB(logger, db); err != nil {
+			t.Fatalf("MigrateBoltDB returned error: %+v", err)
+		}
+		if got, want := schemaVersion(t, db), owbot.SchemaVersion(); got != want {
+			t.Errorf("schema version = %d, want %d", got, want)
+		}
+		source, err := owbot.NewBoltUserSource(logger, db)
+		if err != nil {
+			t.Fatalf("NewBoltUserSource returned error: %+v", err)
+		}
+		got, err := source.Get(owbot.GlobalScope, "1")
+		if err != nil {
+			t.Fatalf("Get returned error: %+v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Get of migrated user = %+v, want %+v", got, want)
+		}
+		if user, err := source.Get("guild", "1"); err != nil || user != nil {
+			t.Errorf("Get in guild of migrated user = %+v, %v, want nil", user, err)
+		}
+		users, err := source.FindByBattleTag("player#1234")
+		if err != nil {
+			t.Fatalf("FindByBattleTag returned error: %+v", err)
+		}
+		if !reflect.DeepEqual(users, []*owbot.User{want}) {
+			t.Errorf("FindByBattleTag of migrated user = %+v, want %+v", users, want)
+		}
+		users, err = source.List(owbot.UserFilter{CreatedBy: "1"}, nil, 10)
+		if err != nil {
+			t.Fatalf("List returned error: %+v", err)
+		}
+		if !reflect.DeepEqual(users, []*owbot.User{want}) {
+			t.Errorf("List by CreatedBy of migrated user = %+v, want %+v", users, want)
+		}
+	}
+}
+
+func TestMigrateBoltDBFailureRollsBack(t *testing.T) {
+	db, closeDB := openTestDB(t)
+	defer closeDB()
+
+	// The invalid user fails the second migration, after the first
+	// migration has moved the users
+	putLegacyUsers(t, db, map[string]string{
+		"1": `{"ID":"1","BattleTag":"player#1234","CreatedBy":"1"}`,
+		"2": `not json`,
+	})
+	if err := owbot.MigrateBoltDB(newTestLogger(), db); err == nil {
+		t.Fatal("MigrateBoltDB of invalid user returned no error")
+	}
+	if version := schemaVersion(t, db); version != -1 {
+		t.Errorf("schema version after failed migration = %d, want none", version)
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("users"))
+		if bucket.Bucket([]byte("global")) != nil {
+			t.Error("users moved to the global scope by failed migration")
+		}
+		if bucket.Get([]byte("1")) == nil {
+			t.Error("user not left in place by failed migration")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateBoltDBNewerSchema(t *testing.T) {
+	db, closeDB := openTestDB(t)
+	defer closeDB()
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("meta"))
+		if err != nil {
+			return err
+		}
+		version := strconv.Itoa(owbot.SchemaVersion() + 1)
+		return bucket.Put([]byte("schemaVersion"), []byte(version))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = owbot.MigrateBoltDB(newTestLogger(), db)
+	if errors.Cause(err) != owbot.ErrSchemaTooNew {
+		t.Errorf("MigrateBoltDB of newer schema returned %v, want %v", err, owbot.ErrSchemaTooNew)
+	}
+	if got, want := schemaVersion(t, db), owbot.SchemaVersion()+1; got != want {
+		t.Errorf("schema version after refusing = %d, want %d", got, want)
+	}
+}
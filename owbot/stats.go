@@ -0,0 +1,108 @@
+package owbot
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/verath/owbot-bot/owbot/owapi"
+)
+
+// StatsProvider is a source of Overwatch player stats. The owapi.Client
+// is the default StatsProvider.
+type StatsProvider interface {
+	// Returns the stats of the player for the mode. Returns
+	// owapi.NoStatsError(mode) if the player has no stats for the mode.
+	// Other errors should be, or wrap, the typed errors of the owapi
+	// package where one applies.
+	GetStats(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserStats, error)
+
+	// Returns the stats of the player for the mode, as GetStats, but
+	// fetched after the call was made rather than read from a cache.
+	GetFreshStats(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserStats, error)
+
+	// Returns the per hero stats of the player for the mode. Returns
+	// owapi.NoStatsError(mode) if the player has no stats for the mode.
+	GetHeroes(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserHeroes, error)
+
+	// Returns the achievements of the player.
+	GetAchievements(ctx context.Context, player owapi.Player) (*owapi.UserAchievements, error)
+}
+
+// Make sure the owapi client can be used as a StatsProvider
+var _ StatsProvider = (*owapi.Client)(nil)
+
+// FallbackStatsProvider is a StatsProvider that tries each of its
+// providers in order, until one of them succeeds.
+type FallbackStatsProvider struct {
+	logger    *logrus.Entry
+	providers []StatsProvider
+}
+
+// NewFallbackStatsProvider creates a new FallbackStatsProvider, trying the
+// providers in the order given. At least one provider must be given.
+func NewFallbackStatsProvider(logger *logrus.Logger, providers ...StatsProvider) (*FallbackStatsProvider, error) {
+	if len(providers) == 0 {
+		return nil, errors.New("At least one stats provider is required")
+	}
+	return &FallbackStatsProvider{
+		logger:    logger.WithField("module", "fallbackStatsProvider"),
+		providers: providers,
+	}, nil
+}
+
+// isFinalError returns true if err is an error that another provider
+// would not be able to do anything about.
+func isFinalError(ctx context.Context, err error) bool {
+	cause := errors.Cause(err)
+	return cause == owapi.ErrNoCompetitiveData || cause == owapi.ErrNoStatsForMode || ctx.Err() != nil
+}
+
+// try calls fn with each provider until fn succeeds or returns a final
+// error. The error of the last provider tried is returned.
+func (p *FallbackStatsProvider) try(ctx context.Context, fn func(provider StatsProvider) error) error {
+	var err error
+	for i, provider := range p.providers {
+		err = fn(provider)
+		if err == nil || isFinalError(ctx, err) {
+			return err
+		}
+		p.logger.WithError(err).WithField("provider", i).Warn("Stats provider failed, trying next")
+	}
+	return err
+}
+
+func (p *FallbackStatsProvider) GetStats(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserStats, error) {
+	var stats *owapi.UserStats
+	err := p.try(ctx, func(provider StatsProvider) (err error) {
+		stats, err = provider.GetStats(ctx, player, mode)
+		return err
+	})
+	return stats, err
+}
+
+func (p *FallbackStatsProvider) GetFreshStats(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserStats, error) {
+	var stats *owapi.UserStats
+	err := p.try(ctx, func(provider StatsProvider) (err error) {
+		stats, err = provider.GetFreshStats(ctx, player, mode)
+		return err
+	})
+	return stats, err
+}
+
+func (p *FallbackStatsProvider) GetHeroes(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserHeroes, error) {
+	var heroes *owapi.UserHeroes
+	err := p.try(ctx, func(provider StatsProvider) (err error) {
+		heroes, err = provider.GetHeroes(ctx, player, mode)
+		return err
+	})
+	return heroes, err
+}
+
+func (p *FallbackStatsProvider) GetAchievements(ctx context.Context, player owapi.Player) (*owapi.UserAchievements, error) {
+	var achievements *owapi.UserAchievements
+	err := p.try(ctx, func(provider StatsProvider) (err error) {
+		achievements, err = provider.GetAchievements(ctx, player)
+		return err
+	})
+	return achievements, err
+}
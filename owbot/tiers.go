@@ -0,0 +1,37 @@
+package owbot
+
+// rankTier is a competitive tier, a range of skill ratings.
+type rankTier struct {
+	Name string
+	// The color of the tier, as an RGB integer (the format used by
+	// Discord embeds)
+	Color int
+	// An emoji representing the tier
+	Emoji string
+	// The lowest skill rating of the tier
+	MinRank int
+}
+
+// rankTiers are the competitive tiers, lowest first.
+var rankTiers = []*rankTier{
+	{Name: "Bronze", Color: 0xCD7F32, Emoji: "🥉", MinRank: 1},
+	{Name: "Silver", Color: 0xC0C0C0, Emoji: "🥈", MinRank: 1500},
+	{Name: "Gold", Color: 0xFFD700, Emoji: "🥇", MinRank: 2000},
+	{Name: "Platinum", Color: 0x7FB8C9, Emoji: "💠", MinRank: 2500},
+	{Name: "Diamond", Color: 0x5DADEC, Emoji: "💎", MinRank: 3000},
+	{Name: "Master", Color: 0xF2A03D, Emoji: "🏅", MinRank: 3500},
+	{Name: "Grandmaster", Color: 0xE8D9A7, Emoji: "🏆", MinRank: 4000},
+}
+
+// tierForRank returns the tier of the skill rating, or nil if the rank
+// is 0 (i.e. not placed).
+func tierForRank(rank int) *rankTier {
+	var tier *rankTier
+	for _, t := range rankTiers {
+		if rank < t.MinRank {
+			break
+		}
+		tier = t
+	}
+	return tier
+}
@@ -0,0 +1,443 @@
+package owbot
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TransferFormat is a file format that users are exported to, and
+// imported from.
+type TransferFormat string
+
+const (
+	// A JSON array of users, as they are stored
+	TransferJSON TransferFormat = "json"
+	// A CSV file with a header row, and a row per account of each user.
+	// The columns are named by csvColumns, only csvUserID and
+	// csvBattleTag are required when importing
+	TransferCSV TransferFormat = "csv"
+)
+
+// The columns of the CSV format
+const (
+	csvUserID    = "user_id"
+	csvGuildID   = "guild_id"
+	csvLabel     = "label"
+	csvBattleTag = "battletag"
+	csvRegion    = "region"
+	csvPlatform  = "platform"
+	csvPrimary   = "primary"
+	csvCreatedBy = "created_by"
+	csvVerified  = "verified"
+)
+
+// csvColumns are the columns of the CSV format, in the order exported
+var csvColumns = []string{csvUserID, csvGuildID, csvLabel, csvBattleTag, csvRegion, csvPlatform, csvPrimary, csvCreatedBy, csvVerified}
+
+// ImportMode decides what happens to users that are both imported and
+// already stored.
+type ImportMode string
+
+const (
+	// Accounts are added to the stored user. Accounts with the same
+	// label as a stored account are conflicts, and are not imported
+	ImportMerge ImportMode = "merge"
+	// The imported user replaces the stored user. Stored accounts
+	// that differ from the imported accounts are conflicts, and are
+	// replaced
+	ImportOverwrite ImportMode = "overwrite"
+)
+
+// A Discord id (snowflake) is a number
+var regexSnowflake = regexp.MustCompile(`^\d+$`)
+
+// ImportConflict is an account that differs between an imported user
+// and the stored user.
+type ImportConflict struct {
+	GuildID string
+	UserID  string
+	// The stored account, nil if only the stored user is missing
+	// the account
+	Stored *Account
+	// The imported account, nil if only the imported user is missing
+	// the account
+	Imported *Account
+}
+
+func (c ImportConflict) String() string {
+	scope := "global"
+	if c.GuildID != GlobalScope {
+		scope = "guild " + c.GuildID
+	}
+	describe := func(account *Account) string {
+		if account == nil {
+			return "none"
+		}
+		return fmt.Sprintf("%s (%s %s)", account.BattleTag, account.Platform, account.Region)
+	}
+	label := ""
+	if c.Stored != nil {
+		label = c.Stored.Label
+	} else if c.Imported != nil {
+		label = c.Imported.Label
+	}
+	return fmt.Sprintf("user %s in %s, account %q: stored %s, imported %s",
+		c.UserID, scope, label, describe(c.Stored), describe(c.Imported))
+}
+
+// ImportReport summarizes an import of users.
+type ImportReport struct {
+	// The number of users that were not stored before
+	Created int
+	// The number of stored users that were changed
+	Updated int
+	// The number of stored users that were left as they were
+	Unchanged int
+	// The accounts that differed between the imported and the stored
+	// users. What was done with them depends on the ImportMode
+	Conflicts []ImportConflict
+}
+
+// ExportUsers writes the users of the source matching the filter to w,
+// in the format. Returns the number of users written.
+func ExportUsers(w io.Writer, source UserSource, filter UserFilter, format TransferFormat) (int, error) {
+	var users []*User
+	err := ForEachUser(source, filter, func(user *User) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not read users from user source")
+	}
+	switch format {
+	case TransferJSON:
+		if users == nil {
+			// An empty array, rather than null
+			users = []*User{}
+		}
+		data, err := json.MarshalIndent(users, "", "  ")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return 0, err
+		}
+	case TransferCSV:
+		writer := csv.NewWriter(w)
+		writer.Write(csvColumns)
+		for _, user := range users {
+			for _, account := range user.Accounts {
+				writer.Write([]string{
+					user.ID,
+					user.GuildID,
+					account.Label,
+					account.BattleTag,
+					string(account.Region),
+					string(account.Platform),
+					strconv.FormatBool(account.Label == user.Primary),
+					user.CreatedBy,
+					strconv.FormatBool(account.Verified),
+				})
+			}
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, errors.Errorf("Unknown format '%s'", format)
+	}
+	return len(users), nil
+}
+
+// ImportUsers reads users from r, in the format, and stores them to the
+// source as decided by the mode. All users are validated before any user
+// is stored, if any user is invalid nothing is imported and the returned
+// error lists the problems. The changed accounts of each user are appended
+// to the history, as changed by ChangedByImport, before the user is
+// stored.
+//
+// A file does not prove that a user owns an account, so imported accounts
+// are only verified if keepVerified, or if the stored account they replace
+// is a verified account of the same player.
+func ImportUsers(r io.Reader, source UserSource, history HistorySource, format TransferFormat, mode ImportMode,
+	keepVerified bool) (*ImportReport, error) {
+	if mode != ImportMerge && mode != ImportOverwrite {
+		return nil, errors.Errorf("Unknown import mode '%s'", mode)
+	}
+	var users []*User
+	var err error
+	switch format {
+	case TransferJSON:
+		err = json.NewDecoder(r).Decode(&users)
+	case TransferCSV:
+		users, err = readCSVUsers(r)
+	default:
+		return nil, errors.Errorf("Unknown format '%s'", format)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read %s users", format)
+	}
+	if err := validateImportUsers(users); err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{}
+	now := time.Now()
+	save := func(stored, user *User) error {
+		changes := accountChanges(stored, user, ChangedByImport, now)
+		return storeChanges(history, changes, func() error {
+			if err := source.Save(user); err != nil {
+				return errors.Wrapf(err, "Failed saving user (%+v) to user source", user)
+			}
+			return nil
+		})
+	}
+	for _, user := range users {
+		stored, err := source.Get(user.GuildID, user.ID)
+		if err != nil {
+			return report, errors.Wrapf(err, "Could not get user '%s' in guild '%s' from user source", user.ID, user.GuildID)
+		}
+		if !keepVerified {
+			unverifyImportedAccounts(stored, user)
+		}
+		if stored == nil {
+			report.Created++
+			if err := save(nil, user); err != nil {
+				return report, err
+			}
+			continue
+		}
+		conflicts := importConflicts(stored, user)
+		report.Conflicts = append(report.Conflicts, conflicts...)
+		updated := user
+		if mode == ImportMerge {
+			// Only the accounts missing from the stored user are added,
+			// everything else is kept as it is stored
+			updated = stored.copy()
+			for _, account := range user.Accounts {
+				if updated.Account(account.Label) == nil {
+					updated.SetAccount(account)
+				}
+			}
+		}
+		if reflect.DeepEqual(updated, stored) {
+			report.Unchanged++
+			continue
+		}
+		report.Updated++
+		if err := save(stored, updated); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// unverifyImportedAccounts clears Verified of the accounts of the imported
+// user, except for accounts that are the same player as the verified account
+// with the same label of the stored user, which may be nil.
+func unverifyImportedAccounts(stored, imported *User) {
+	for i := range imported.Accounts {
+		account := &imported.Accounts[i]
+		var storedAccount *Account
+		if stored != nil {
+			storedAccount = stored.Account(account.Label)
+		}
+		account.Verified = storedAccount != nil && storedAccount.Verified &&
+			storedAccount.BattleTag == account.BattleTag && storedAccount.Platform == account.Platform
+	}
+}
+
+// importConflicts returns the accounts that differ between the stored
+// and the imported user. Accounts only the stored user has are conflicts
+// too, as they are lost when the stored user is overwritten.
+func importConflicts(stored, imported *User) []ImportConflict {
+	var conflicts []ImportConflict
+	for i := range stored.Accounts {
+		storedAccount := &stored.Accounts[i]
+		importedAccount := imported.Account(storedAccount.Label)
+		if importedAccount == nil || *importedAccount != *storedAccount {
+			conflicts = append(conflicts, ImportConflict{
+				GuildID:  stored.GuildID,
+				UserID:   stored.ID,
+				Stored:   storedAccount,
+				Imported: importedAccount,
+			})
+		}
+	}
+	return conflicts
+}
+
+// readCSVUsers reads users from the CSV format. Rows of the same user,
+// in the same guild, are the accounts of the user.
+func readCSVUsers(r io.Reader) ([]*User, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read header")
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{csvUserID, csvBattleTag} {
+		if _, ok := columns[name]; !ok {
+			return nil, errors.Errorf("Missing column '%s'", name)
+		}
+	}
+
+	var users []*User
+	byKey := make(map[userKey]*User)
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		key := userKey{guildID: field(csvGuildID), userID: field(csvUserID)}
+		user, ok := byKey[key]
+		if !ok {
+			user = &User{ID: key.userID, GuildID: key.guildID, CreatedBy: field(csvCreatedBy)}
+			byKey[key] = user
+			users = append(users, user)
+		}
+		label := strings.ToLower(field(csvLabel))
+		if label == "" {
+			label = defaultAccountLabel
+		}
+		if user.Account(label) != nil {
+			return nil, errors.Errorf("Line %d: user '%s' has more than one account '%s'", line, user.ID, label)
+		}
+		verified, err := parseCSVBool(field(csvVerified))
+		if err != nil {
+			return nil, errors.Errorf("Line %d: invalid %s %q", line, csvVerified, field(csvVerified))
+		}
+		primary, err := parseCSVBool(field(csvPrimary))
+		if err != nil {
+			return nil, errors.Errorf("Line %d: invalid %s %q", line, csvPrimary, field(csvPrimary))
+		}
+		user.Accounts = append(user.Accounts, Account{
+			Label:     label,
+			BattleTag: field(csvBattleTag),
+			Region:    owapi.Region(strings.ToLower(field(csvRegion))),
+			Platform:  owapi.Platform(strings.ToLower(field(csvPlatform))),
+			Verified:  verified,
+		})
+		if primary || user.Primary == "" {
+			user.Primary = label
+		}
+	}
+	return users, nil
+}
+
+// parseCSVBool parses a boolean column of the CSV format, where an empty
+// value is false
+func parseCSVBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// validateImportUsers returns an error describing every problem with the
+// users, or nil if all users are valid.
+func validateImportUsers(users []*User) error {
+	var problems []string
+	seen := make(map[userKey]bool, len(users))
+	for i, user := range users {
+		if user == nil {
+			problems = append(problems, fmt.Sprintf("user %d: is null", i+1))
+			continue
+		}
+		problem := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf("user %d (%s): ", i+1, user.ID)+fmt.Sprintf(format, args...))
+		}
+		if !regexSnowflake.MatchString(user.ID) {
+			problem("invalid user id")
+		}
+		if user.GuildID != GlobalScope && !regexSnowflake.MatchString(user.GuildID) {
+			problem("invalid guild id %q", user.GuildID)
+		}
+		if user.CreatedBy != "" && !regexSnowflake.MatchString(user.CreatedBy) {
+			problem("invalid created by %q", user.CreatedBy)
+		}
+		key := user.key()
+		if seen[key] {
+			problem("more than one user for the same guild")
+		}
+		seen[key] = true
+		if len(user.Accounts) == 0 {
+			problem("no accounts")
+		} else if user.Account(user.Primary) == nil {
+			problem("primary account %q does not exist", user.Primary)
+		}
+		labels := make(map[string]bool, len(user.Accounts))
+		for _, account := range user.Accounts {
+			if !isValidLabel(account.Label) {
+				problem("invalid label %q", account.Label)
+			}
+			if labels[account.Label] {
+				problem("more than one account %q", account.Label)
+			}
+			labels[account.Label] = true
+			if !isValidPlatform(account.Platform) {
+				problem("invalid platform %q", account.Platform)
+			} else if !isValidBattleTag(account.BattleTag, account.Platform) {
+				problem("invalid BattleTag %q", account.BattleTag)
+			}
+			if !isValidRegion(account.Region) {
+				problem("invalid region %q", account.Region)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("Invalid users, nothing imported:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// isValidPlatform returns true if the platform is empty, or one of the
+// owapi platforms
+func isValidPlatform(platform owapi.Platform) bool {
+	if platform == "" {
+		return true
+	}
+	for _, p := range owapi.Platforms {
+		if p == platform {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidRegion returns true if the region is empty, or one of the
+// owapi regions
+func isValidRegion(region owapi.Region) bool {
+	if region == "" {
+		return true
+	}
+	for _, r := range owapi.Regions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,342 @@
+package owbot_test
+
+import (
+	"bytes"
+	"github.com/verath/owbot-bot/owbot"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// allUsers returns all users of the source
+func allUsers(t *testing.T, source owbot.UserSource) []*owbot.User {
+	t.Helper()
+	var users []*owbot.User
+	err := owbot.ForEachUser(source, owbot.UserFilter{}, func(user *owbot.User) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachUser returned error: %+v", err)
+	}
+	return users
+}
+
+func newTransferSource(t *testing.T) owbot.UserSource {
+	t.Helper()
+	source := owbot.NewMemoryUserSource()
+	users := []*owbot.User{
+		{
+			ID:      "1",
+			GuildID: "100",
+			Accounts: []owbot.Account{
+				{Label: "main", BattleTag: "player#1234", Region: owapi.RegionEU},
+				{Label: "alt", BattleTag: "console-name", Platform: owapi.PlatformPSN, Verified: true},
+			},
+			Primary:   "alt",
+			CreatedBy: "2",
+		},
+		{
+			ID:        "2",
+			Accounts:  []owbot.Account{{Label: "main", BattleTag: "other#5678"}},
+			Primary:   "main",
+			CreatedBy: "2",
+		},
+	}
+	for _, user := range users {
+		if err := source.Save(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return source
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []owbot.TransferFormat{owbot.TransferJSON, owbot.TransferCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			source := newTransferSource(t)
+			var buf bytes.Buffer
+			n, err := owbot.ExportUsers(&buf, source, owbot.UserFilter{}, format)
+			if err != nil {
+				t.Fatalf("ExportUsers returned error: %+v", err)
+			}
+			if n != 2 {
+				t.Errorf("ExportUsers exported %d users, want 2", n)
+			}
+
+			imported := owbot.NewMemoryUserSource()
+			// The users are exported by the bot itself, so can be trusted
+			report, err := owbot.ImportUsers(&buf, imported, owbot.NewMemoryHistorySource(), format, owbot.ImportMerge, true)
+			if err != nil {
+				t.Fatalf("ImportUsers returned error: %+v", err)
+			}
+			if report.Created != 2 || report.Updated != 0 || len(report.Conflicts) != 0 {
+				t.Errorf("ImportUsers report = %+v, want 2 created", report)
+			}
+			if got, want := allUsers(t, imported), allUsers(t, source); !reflect.DeepEqual(got, want) {
+				t.Errorf("imported users = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestExportUsersFilter(t *testing.T) {
+	source := newTransferSource(t)
+	var buf bytes.Buffer
+	filter := owbot.UserFilter{GuildIDs: []string{"100"}}
+	n, err := owbot.ExportUsers(&buf, source, filter, owbot.TransferCSV)
+	if err != nil {
+		t.Fatalf("ExportUsers returned error: %+v", err)
+	}
+	if n != 1 {
+		t.Errorf("ExportUsers exported %d users, want 1", n)
+	}
+	// The header, and the two accounts of the user of the guild
+	if lines := strings.Count(buf.String(), "\n"); lines != 3 {
+		t.Errorf("ExportUsers wrote %d lines, want 3:\n%s", lines, buf.String())
+	}
+}
+
+func TestImportUsersCSVSpreadsheet(t *testing.T) {
+	// Only the user id and BattleTag are required, and the columns
+	// can be in any order
+	csv := "BattleTag,User_ID,Label\n" +
+		"player#1234,1,\n" +
+		"alt#1234,1,Alt\n" +
+		"other#5678,2,\n"
+	source := owbot.NewMemoryUserSource()
+	if _, err := owbot.ImportUsers(strings.NewReader(csv), source, owbot.NewMemoryHistorySource(), owbot.TransferCSV, owbot.ImportMerge, false); err != nil {
+		t.Fatalf("ImportUsers returned error: %+v", err)
+	}
+	want := []*owbot.User{
+		{
+			ID: "1",
+			Accounts: []owbot.Account{
+				{Label: "main", BattleTag: "player#1234"},
+				{Label: "alt", BattleTag: "alt#1234"},
+			},
+			Primary: "main",
+		},
+		{ID: "2", Accounts: []owbot.Account{{Label: "main", BattleTag: "other#5678"}}, Primary: "main"},
+	}
+	if got := allUsers(t, source); !reflect.DeepEqual(got, want) {
+		t.Errorf("imported users = %+v, want %+v", got, want)
+	}
+}
+
+func TestImportUsersInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+	}{
+		{"BattleTag", "user_id,battletag\n1,player#1234\n2,not a battletag\n"},
+		{"UserID", "user_id,battletag\nuser,player#1234\n"},
+		{"Region", "user_id,battletag,region\n1,player#1234,moon\n"},
+		{"Platform", "user_id,battletag,platform\n1,player#1234,switch\n"},
+		{"Label", "user_id,battletag,label\n1,player#1234,eu\n"},
+		{"DuplicateLabel", "user_id,battletag\n1,player#1234\n1,other#1234\n"},
+		{"Verified", "user_id,battletag,verified\n1,player#1234,maybe\n"},
+		{"Primary", "user_id,battletag,primary\n1,player#1234,yes\n"},
+		{"MissingColumn", "user_id\n1\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := owbot.NewMemoryUserSource()
+			_, err := owbot.ImportUsers(strings.NewReader(test.csv), source, owbot.NewMemoryHistorySource(), owbot.TransferCSV, owbot.ImportMerge, false)
+			if err == nil {
+				t.Error("ImportUsers returned no error")
+			}
+			// Nothing is imported if any user is invalid
+			if users := allUsers(t, source); len(users) != 0 {
+				t.Errorf("users after invalid import = %+v, want none", users)
+			}
+		})
+	}
+}
+
+func TestImportUsersModes(t *testing.T) {
+	// The stored user 1 has a different main account, and no alt account
+	json := `[
+		{"ID": "1", "GuildID": "100", "Accounts": [
+			{"Label": "main", "BattleTag": "changed#1234"},
+			{"Label": "new", "BattleTag": "new#1234"}
+		], "Primary": "main", "CreatedBy": "3"},
+		{"ID": "2", "Accounts": [{"Label": "main", "BattleTag": "other#5678"}], "Primary": "main", "CreatedBy": "2"},
+		{"ID": "3", "Accounts": [{"Label": "main", "BattleTag": "third#1234"}], "Primary": "main", "CreatedBy": "4"}
+	]`
+
+	t.Run("Merge", func(t *testing.T) {
+		source := newTransferSource(t)
+		report, err := owbot.ImportUsers(strings.NewReader(json), source, owbot.NewMemoryHistorySource(), owbot.TransferJSON, owbot.ImportMerge, false)
+		if err != nil {
+			t.Fatalf("ImportUsers returned error: %+v", err)
+		}
+		if report.Created != 1 || report.Updated != 1 || report.Unchanged != 1 {
+			t.Errorf("ImportUsers report = %+v, want 1 created, 1 updated, 1 unchanged", report)
+		}
+		// The changed main, and the missing alt, accounts
+		if len(report.Conflicts) != 2 {
+			t.Errorf("ImportUsers conflicts = %v, want 2", report.Conflicts)
+		}
+		got, err := source.Get("100", "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &owbot.User{
+			ID:      "1",
+			GuildID: "100",
+			Accounts: []owbot.Account{
+				{Label: "main", BattleTag: "player#1234", Region: owapi.RegionEU},
+				{Label: "alt", BattleTag: "console-name", Platform: owapi.PlatformPSN, Verified: true},
+				{Label: "new", BattleTag: "new#1234"},
+			},
+			Primary:   "alt",
+			CreatedBy: "2",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("merged user = %+v, want %+v", got, want)
+		}
+		created, err := source.Get(owbot.GlobalScope, "3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created == nil || created.CreatedBy != "4" {
+			t.Errorf("created user = %+v, want CreatedBy preserved", created)
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		source := newTransferSource(t)
+		report, err := owbot.ImportUsers(strings.NewReader(json), source, owbot.NewMemoryHistorySource(), owbot.TransferJSON, owbot.ImportOverwrite, false)
+		if err != nil {
+			t.Fatalf("ImportUsers returned error: %+v", err)
+		}
+		if report.Created != 1 || report.Updated != 1 || report.Unchanged != 1 {
+			t.Errorf("ImportUsers report = %+v, want 1 created, 1 updated, 1 unchanged", report)
+		}
+		if len(report.Conflicts) != 2 {
+			t.Errorf("ImportUsers conflicts = %v, want 2", report.Conflicts)
+		}
+		got, err := source.Get("100", "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &owbot.User{
+			ID:      "1",
+			GuildID: "100",
+			Accounts: []owbot.Account{
+				{Label: "main", BattleTag: "changed#1234"},
+				{Label: "new", BattleTag: "new#1234"},
+			},
+			Primary:   "main",
+			CreatedBy: "3",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("overwritten user = %+v, want %+v", got, want)
+		}
+	})
+}
+
+func TestImportUsersVerified(t *testing.T) {
+	// The alt account of the stored user 1 is verified
+	json := `[
+		{"ID": "1", "GuildID": "100", "Accounts": [
+			{"Label": "main", "BattleTag": "player#1234", "Region": "eu", "Verified": true},
+			{"Label": "alt", "BattleTag": "console-name", "Platform": "psn", "Verified": true}
+		], "Primary": "alt", "CreatedBy": "2"},
+		{"ID": "3", "Accounts": [{"Label": "main", "BattleTag": "third#1234", "Verified": true}], "Primary": "main"}
+	]`
+	tests := []struct {
+		name         string
+		keepVerified bool
+		// The verified accounts after the import, as user id/label
+		want []string
+	}{
+		// Only the account replacing a verified account of the same
+		// player is verified
+		{"Dropped", false, []string{"1/alt"}},
+		{"Kept", true, []string{"3/main", "1/main", "1/alt"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := newTransferSource(t)
+			_, err := owbot.ImportUsers(strings.NewReader(json), source, owbot.NewMemoryHistorySource(),
+				owbot.TransferJSON, owbot.ImportOverwrite, test.keepVerified)
+			if err != nil {
+				t.Fatalf("ImportUsers returned error: %+v", err)
+			}
+			var got []string
+			for _, user := range allUsers(t, source) {
+				for _, account := range user.Accounts {
+					if account.Verified {
+						got = append(got, user.ID+"/"+account.Label)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("verified accounts = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// A changed BattleTag is not the verified player
+	source := newTransferSource(t)
+	json = `[{"ID": "1", "GuildID": "100", "Accounts": [
+		{"Label": "alt", "BattleTag": "other-name", "Platform": "psn", "Verified": true}
+	], "Primary": "alt", "CreatedBy": "2"}]`
+	_, err := owbot.ImportUsers(strings.NewReader(json), source, owbot.NewMemoryHistorySource(),
+		owbot.TransferJSON, owbot.ImportOverwrite, false)
+	if err != nil {
+		t.Fatalf("ImportUsers returned error: %+v", err)
+	}
+	if user, _ := source.Get("100", "1"); user == nil || user.Accounts[0].Verified {
+		t.Errorf("imported user with changed BattleTag = %+v, want unverified", user)
+	}
+}
+
+func TestImportUsersHistory(t *testing.T) {
+	json := `[
+		{"ID": "1", "GuildID": "100", "Accounts": [
+			{"Label": "main", "BattleTag": "changed#1234"},
+			{"Label": "new", "BattleTag": "new#1234"}
+		], "Primary": "main", "CreatedBy": "3"},
+		{"ID": "2", "Accounts": [{"Label": "main", "BattleTag": "other#5678"}], "Primary": "main", "CreatedBy": "2"},
+		{"ID": "3", "Accounts": [{"Label": "main", "BattleTag": "third#1234"}], "Primary": "main", "CreatedBy": "4"}
+	]`
+	source := newTransferSource(t)
+	history := owbot.NewMemoryHistorySource()
+	if _, err := owbot.ImportUsers(strings.NewReader(json), source, history, owbot.TransferJSON, owbot.ImportOverwrite, false); err != nil {
+		t.Fatalf("ImportUsers returned error: %+v", err)
+	}
+
+	type change struct{ label, oldBattleTag, newBattleTag string }
+	tests := []struct {
+		guildID string
+		userID  string
+		want    []change
+	}{
+		// The changed main account, the new account and the removed alt account
+		{"100", "1", []change{{"main", "player#1234", "changed#1234"}, {"new", "", "new#1234"}, {"alt", "console-name", ""}}},
+		// Unchanged
+		{owbot.GlobalScope, "2", nil},
+		// Created
+		{owbot.GlobalScope, "3", []change{{"main", "", "third#1234"}}},
+	}
+	for _, tt := range tests {
+		entries, err := history.Get(tt.guildID, tt.userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []change
+		for _, entry := range entries {
+			if !entry.Imported() {
+				t.Errorf("History entry %+v not made by an import", entry)
+			}
+			got = append(got, change{entry.Label, entry.OldBattleTag, entry.NewBattleTag})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("History of user %s in guild %q = %v, want %v", tt.userID, tt.guildID, got, tt.want)
+		}
+	}
+}
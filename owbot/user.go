@@ -1,20 +1,59 @@
 package owbot
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
-	"github.com/sirupsen/logrus"
 	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/verath/owbot-bot/owbot/owapi"
 	"io"
+	"sort"
+	"strings"
+	"sync"
 )
 
+// defaultAccountLabel is the label of accounts set without a label
+const defaultAccountLabel = "main"
+
+// An account is a BattleTag linked to a user, identified by a label
+// unique to the user
+type Account struct {
+	// The label of the account, e.g. "main" or "alt"
+	Label string
+	// The Battle.net BattleTag for the account, or the PSN/XBL
+	// name for console accounts
+	BattleTag string
+	// The preferred region to show stats for. If empty, the
+	// region with the most games played is used
+	Region owapi.Region
+	// The platform the BattleTag is for. PC if empty
+	Platform owapi.Platform
+	// Set if the user has proven that they own the account, by
+	// completing a VerifyChallenge
+	Verified bool `json:",omitempty"`
+}
+
+// Player returns the player of the account
+func (a Account) Player() owapi.Player {
+	return owapi.Player{BattleTag: a.BattleTag, Region: a.Region, Platform: a.Platform}
+}
+
 // A user is a mapping between a Discord user id and
-// a battleTag
+// its linked accounts, within a guild or globally
 type User struct {
 	// The Discord id (snowflake) of the user
 	ID string
-	// The Battle.net BattleTag for the user
-	BattleTag string
+	// The Discord id of the guild the mapping belongs to, or
+	// GlobalScope if it is the default mapping of the user in
+	// all guilds
+	GuildID string `json:",omitempty"`
+	// The accounts linked to the user, in the order they were
+	// added
+	Accounts []Account
+	// The label of the primary account, the account used when
+	// no account is asked for
+	Primary string
 	// The Discord id (snowflake) of the user that last
 	// created or updated this User entry. Used so we can
 	// prioritize the "real" user, while still letting others
@@ -22,52 +61,510 @@ type User struct {
 	CreatedBy string
 }
 
-// A simple interface for a data source of users
+// Account returns the account with the label, or nil if the user has
+// no such account
+func (u *User) Account(label string) *Account {
+	for i := range u.Accounts {
+		if u.Accounts[i].Label == label {
+			return &u.Accounts[i]
+		}
+	}
+	return nil
+}
+
+// PrimaryAccount returns the primary account of the user, or nil if
+// the user has no accounts
+func (u *User) PrimaryAccount() *Account {
+	if account := u.Account(u.Primary); account != nil {
+		return account
+	}
+	// Should not happen, but better to show any account than none
+	if len(u.Accounts) > 0 {
+		return &u.Accounts[0]
+	}
+	return nil
+}
+
+// hasVerifiedAccount returns true if any account of the user is verified
+func (u *User) hasVerifiedAccount() bool {
+	for _, account := range u.Accounts {
+		if account.Verified {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAccount adds the account, replacing any account with the same
+// label. The first account added becomes the primary account.
+func (u *User) SetAccount(account Account) {
+	if existing := u.Account(account.Label); existing != nil {
+		*existing = account
+	} else {
+		u.Accounts = append(u.Accounts, account)
+	}
+	if u.Account(u.Primary) == nil {
+		u.Primary = account.Label
+	}
+}
+
+// RemoveAccount removes the account with the label, returning false if the
+// user has no such account. If the primary account is removed, the first
+// of the remaining accounts becomes the primary account.
+func (u *User) RemoveAccount(label string) bool {
+	for i := range u.Accounts {
+		if u.Accounts[i].Label != label {
+			continue
+		}
+		u.Accounts = append(u.Accounts[:i:i], u.Accounts[i+1:]...)
+		if u.Primary == label {
+			u.Primary = ""
+			if len(u.Accounts) > 0 {
+				u.Primary = u.Accounts[0].Label
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// copy returns a deep copy of the user
+func (u *User) copy() *User {
+	userCopy := new(User)
+	*userCopy = *u
+	userCopy.Accounts = append([]Account(nil), u.Accounts...)
+	return userCopy
+}
+
+// userKey identifies a user by its guild and user id, e.g. as the key of
+// maps of users or of data about users
+type userKey struct {
+	guildID string
+	userID  string
+}
+
+// key returns the userKey of the user
+func (u *User) key() userKey {
+	return userKey{u.GuildID, u.ID}
+}
+
+// less returns true if the user of k is ordered before the user of other,
+// by guild id and then user id
+func (k userKey) less(other userKey) bool {
+	if k.guildID != other.guildID {
+		return k.guildID < other.guildID
+	}
+	return k.userID < other.userID
+}
+
+// normalizeBattleTag returns the form of the BattleTag that users are
+// indexed by. BattleTags are compared case insensitively.
+func normalizeBattleTag(battleTag string) string {
+	return strings.ToLower(battleTag)
+}
+
+// GlobalScope is the guild id of users that are not scoped to a
+// guild, and so are used in all guilds without a user of their own
+const GlobalScope = ""
+
+// A simple interface for a data source of users. Users are scoped by
+// guild, the same Discord user id may have a user in each guild and
+// one in the GlobalScope.
 type UserSource interface {
 	io.Closer
-	// Returns the user for the provided Discord user id, or nil
-	// if no such user exist.
-	Get(userID string) (*User, error)
+	// Returns the user for the provided guild and Discord user id,
+	// or nil if no such user exist. Users of the GlobalScope are not
+	// returned for other guilds.
+	Get(guildID, userID string) (*User, error)
 
-	// Stores a user to the data source
+	// Stores a user to the data source, in the scope of its GuildID
 	Save(user *User) error
+
+	// Removes the user with the provided guild and Discord user id.
+	// Removing a user that does not exist is not an error.
+	Delete(guildID, userID string) error
+
+	// Returns at most limit users matching the filter, ordered by guild
+	// id and then user id, starting after the user after. Only the
+	// GuildID and ID of after are used, so the users of the next page
+	// are listed by passing the last user of the previous page. Lists
+	// from the first user if after is nil.
+	List(filter UserFilter, after *User, limit int) ([]*User, error)
+
+	// Returns the users, of all scopes, that have an account with the
+	// BattleTag, compared case insensitively. Ordered by guild id and
+	// then user id.
+	FindByBattleTag(battleTag string) ([]*User, error)
+}
+
+// A UserFilter selects the users of a UserSource.List. The zero value
+// selects all users.
+type UserFilter struct {
+	// Only users of these guilds, each listed once, GlobalScope for
+	// the global users. Users of all guilds if empty
+	GuildIDs []string
+	// Only users last created or updated by this Discord user id. Users
+	// created by anyone if empty
+	CreatedBy string
 }
 
-// An in memory implementation of a user source
+// listGuildIDs returns the GuildIDs of the filter in order, or all of
+// guildIDs in order if the filter has no GuildIDs
+func (f UserFilter) listGuildIDs(guildIDs []string) []string {
+	if len(f.GuildIDs) > 0 {
+		guildIDs = f.GuildIDs
+	}
+	sorted := append([]string(nil), guildIDs...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// userPageSize is the number of users ForEachUser lists at a time
+const userPageSize = 100
+
+// ForEachUser calls fn for each user of the source matching the filter,
+// ordered by guild id and then user id. Stops at, and returns, the first
+// error returned by fn. The users are listed a page at a time, and the
+// source is not held while fn is called, so fn may use the source.
+func ForEachUser(source UserSource, filter UserFilter, fn func(user *User) error) error {
+	var after *User
+	for {
+		users, err := source.List(filter, after, userPageSize)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if len(users) < userPageSize {
+			return nil
+		}
+		after = users[len(users)-1]
+	}
+}
+
+// sortUsers sorts the users by guild id, and then by user id
+func sortUsers(users []*User) {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].key().less(users[j].key())
+	})
+}
+
+// An in memory implementation of a user source. It is safe
+// for concurrent use.
 type MemoryUserSource struct {
-	data map[string]*User
+	mu sync.Mutex
+	// The users, by guild id and then user id
+	data map[string]map[string]*User
+	// The keys of the users, by the normalized BattleTags of their
+	// accounts
+	index map[string]map[userKey]bool
+	// The keys of all users, and of the users by their CreatedBy, in the
+	// order users are listed in
+	keys      []userKey
+	createdBy map[string][]userKey
 }
 
 func NewMemoryUserSource() *MemoryUserSource {
 	return &MemoryUserSource{
-		data: make(map[string]*User),
+		data:      make(map[string]map[string]*User),
+		index:     make(map[string]map[userKey]bool),
+		createdBy: make(map[string][]userKey),
+	}
+}
+
+// indexUser adds the accounts, and the CreatedBy, of the user to the
+// indexes. Must be called with the lock held.
+func (s *MemoryUserSource) indexUser(user *User) {
+	key := user.key()
+	s.keys = insertKey(s.keys, key)
+	s.createdBy[user.CreatedBy] = insertKey(s.createdBy[user.CreatedBy], key)
+	for _, account := range user.Accounts {
+		battleTag := normalizeBattleTag(account.BattleTag)
+		if s.index[battleTag] == nil {
+			s.index[battleTag] = make(map[userKey]bool)
+		}
+		s.index[battleTag][key] = true
 	}
 }
 
-func (s *MemoryUserSource) Get(userID string) (*User, error) {
-	user, _ := s.data[userID]
+// unindexUser removes the accounts, and the CreatedBy, of the user from
+// the indexes. Must be called with the lock held.
+func (s *MemoryUserSource) unindexUser(user *User) {
+	key := user.key()
+	s.keys = removeKey(s.keys, key)
+	s.createdBy[user.CreatedBy] = removeKey(s.createdBy[user.CreatedBy], key)
+	if len(s.createdBy[user.CreatedBy]) == 0 {
+		delete(s.createdBy, user.CreatedBy)
+	}
+	for _, account := range user.Accounts {
+		battleTag := normalizeBattleTag(account.BattleTag)
+		delete(s.index[battleTag], key)
+		if len(s.index[battleTag]) == 0 {
+			delete(s.index, battleTag)
+		}
+	}
+}
+
+// insertKey returns the sorted keys with key inserted in order
+func insertKey(keys []userKey, key userKey) []userKey {
+	i := sort.Search(len(keys), func(i int) bool { return !keys[i].less(key) })
+	if i < len(keys) && keys[i] == key {
+		return keys
+	}
+	keys = append(keys, userKey{})
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
+	return keys
+}
+
+// removeKey returns the sorted keys with key removed
+func removeKey(keys []userKey, key userKey) []userKey {
+	i := sort.Search(len(keys), func(i int) bool { return !keys[i].less(key) })
+	if i < len(keys) && keys[i] == key {
+		return append(keys[:i], keys[i+1:]...)
+	}
+	return keys
+}
+
+// containsSorted returns true if the sorted strs contains str
+func containsSorted(strs []string, str string) bool {
+	i := sort.SearchStrings(strs, str)
+	return i < len(strs) && strs[i] == str
+}
+
+func (s *MemoryUserSource) Get(guildID, userID string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, _ := s.data[guildID][userID]
 	if user == nil {
 		return user, nil
 	} else {
-		userCopy := new(User)
-		*userCopy = *user
-		return userCopy, nil
+		return user.copy(), nil
 	}
 }
 
 func (s *MemoryUserSource) Save(user *User) error {
-	userCopy := new(User)
-	*userCopy = *user
-	s.data[userCopy.ID] = userCopy
+	if user == nil {
+		return errors.New("User can not be nil")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userCopy := user.copy()
+	guild := s.data[userCopy.GuildID]
+	if guild == nil {
+		guild = make(map[string]*User)
+		s.data[userCopy.GuildID] = guild
+	}
+	if prev := guild[userCopy.ID]; prev != nil {
+		s.unindexUser(prev)
+	}
+	guild[userCopy.ID] = userCopy
+	s.indexUser(userCopy)
 	return nil
 }
 
+func (s *MemoryUserSource) Delete(guildID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	guild := s.data[guildID]
+	if prev := guild[userID]; prev != nil {
+		s.unindexUser(prev)
+	}
+	delete(guild, userID)
+	if len(guild) == 0 {
+		delete(s.data, guildID)
+	}
+	return nil
+}
+
+func (s *MemoryUserSource) List(filter UserFilter, after *User, limit int) ([]*User, error) {
+	if limit <= 0 {
+		return nil, errors.Errorf("Limit must be positive, not %d", limit)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.keys
+	if filter.CreatedBy != "" {
+		// Only the users created by the user are considered
+		keys = s.createdBy[filter.CreatedBy]
+	}
+	i := 0
+	if after != nil {
+		afterKey := after.key()
+		i = sort.Search(len(keys), func(i int) bool { return afterKey.less(keys[i]) })
+	}
+	guildIDs := append([]string(nil), filter.GuildIDs...)
+	sort.Strings(guildIDs)
+	var users []*User
+	for i < len(keys) && len(users) < limit {
+		key := keys[i]
+		if len(guildIDs) == 0 || containsSorted(guildIDs, key.guildID) {
+			users = append(users, s.data[key.guildID][key.userID].copy())
+			i++
+			continue
+		}
+		// Skip to the first user of the next guild of the filter
+		next := sort.SearchStrings(guildIDs, key.guildID)
+		if next == len(guildIDs) {
+			break
+		}
+		nextKey := userKey{guildIDs[next], ""}
+		i += sort.Search(len(keys)-i, func(j int) bool { return !keys[i+j].less(nextKey) })
+	}
+	return users, nil
+}
+
+func (s *MemoryUserSource) FindByBattleTag(battleTag string) ([]*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var users []*User
+	for key := range s.index[normalizeBattleTag(battleTag)] {
+		users = append(users, s.data[key.guildID][key.userID].copy())
+	}
+	sortUsers(users)
+	return users, nil
+}
+
 func (s *MemoryUserSource) Close() error {
 	return nil
 }
 
+// The users bucket has a nested bucket for each scope, holding the
+// users of the scope keyed by their Discord user id
 var bucketUsers = []byte("users")
 
+// bucketUsersGlobal is the nested bucket of the GlobalScope
+var bucketUsersGlobal = []byte("global")
+
+// userScopeBucketName returns the name of the nested bucket of the
+// users of the guild
+func userScopeBucketName(guildID string) []byte {
+	if guildID == GlobalScope {
+		return bucketUsersGlobal
+	}
+	return []byte("guild:" + guildID)
+}
+
+// The battletags bucket indexes the users by the BattleTags of their
+// accounts. It has a nested bucket for each normalized BattleTag,
+// holding the battleTagIndexKey of each user with the BattleTag.
+var bucketBattleTags = []byte("battletags")
+
+// battleTagIndexKey returns the key of a user in the battletags bucket.
+// Snowflakes never contain ":", so the key can be split at the first ":".
+func battleTagIndexKey(guildID, userID string) []byte {
+	return []byte(guildID + ":" + userID)
+}
+
+// indexUser adds the accounts of the user to the battletags bucket
+func indexUser(index *bolt.Bucket, user *User) error {
+	for _, account := range user.Accounts {
+		bucket, err := index.CreateBucketIfNotExists([]byte(normalizeBattleTag(account.BattleTag)))
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(battleTagIndexKey(user.GuildID, user.ID), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexUser removes the accounts of the user from the battletags
+// bucket, removing the nested buckets left empty
+func unindexUser(index *bolt.Bucket, user *User) error {
+	for _, account := range user.Accounts {
+		name := []byte(normalizeBattleTag(account.BattleTag))
+		bucket := index.Bucket(name)
+		if bucket == nil {
+			// Another account of the user with the same BattleTag
+			continue
+		}
+		if err := bucket.Delete(battleTagIndexKey(user.GuildID, user.ID)); err != nil {
+			return err
+		}
+		if k, _ := bucket.Cursor().First(); k == nil {
+			if err := index.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The createdby bucket indexes the users by their CreatedBy. It has a
+// nested bucket for each CreatedBy, holding a nested bucket for each
+// scope, named as in the users bucket, holding the ids of the users.
+// Users without a CreatedBy are not indexed.
+var bucketCreatedBy = []byte("createdby")
+
+// indexCreatedBy adds the user to the createdby bucket
+func indexCreatedBy(index *bolt.Bucket, user *User) error {
+	if user.CreatedBy == "" {
+		return nil
+	}
+	creator, err := index.CreateBucketIfNotExists([]byte(user.CreatedBy))
+	if err != nil {
+		return err
+	}
+	scope, err := creator.CreateBucketIfNotExists(userScopeBucketName(user.GuildID))
+	if err != nil {
+		return err
+	}
+	return scope.Put([]byte(user.ID), []byte{})
+}
+
+// unindexCreatedBy removes the user from the createdby bucket, removing
+// the nested buckets left empty
+func unindexCreatedBy(index *bolt.Bucket, user *User) error {
+	creator := index.Bucket([]byte(user.CreatedBy))
+	if creator == nil {
+		return nil
+	}
+	scopeName := userScopeBucketName(user.GuildID)
+	scope := creator.Bucket(scopeName)
+	if scope == nil {
+		return nil
+	}
+	if err := scope.Delete([]byte(user.ID)); err != nil {
+		return err
+	}
+	if k, _ := scope.Cursor().First(); k != nil {
+		return nil
+	}
+	if err := creator.DeleteBucket(scopeName); err != nil {
+		return err
+	}
+	if k, _ := creator.Cursor().First(); k != nil {
+		return nil
+	}
+	return index.DeleteBucket([]byte(user.CreatedBy))
+}
+
+// scopeGuildIDs returns the guild ids of the nested scope buckets of the
+// bucket, in order
+func scopeGuildIDs(bucket *bolt.Bucket) ([]string, error) {
+	var guildIDs []string
+	err := bucket.ForEach(func(k, v []byte) error {
+		// Nested buckets have a nil value
+		if v != nil {
+			return nil
+		}
+		if bytes.Equal(k, bucketUsersGlobal) {
+			guildIDs = append(guildIDs, GlobalScope)
+		} else if guildID := strings.TrimPrefix(string(k), "guild:"); guildID != string(k) {
+			guildIDs = append(guildIDs, guildID)
+		} else {
+			return errors.Errorf("Invalid scope bucket '%s'", k)
+		}
+		return nil
+	})
+	return guildIDs, err
+}
+
 type BoltUserSource struct {
 	logger *logrus.Entry
 	db     *bolt.DB
@@ -75,7 +572,13 @@ type BoltUserSource struct {
 
 func createUsersBucket(db *bolt.DB) error {
 	return db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bucketUsers)
+		if _, err := tx.CreateBucketIfNotExists(bucketUsers); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(bucketBattleTags); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketCreatedBy)
 		return err
 	})
 }
@@ -103,10 +606,14 @@ func (s *BoltUserSource) mustGetBucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
 	return bucket
 }
 
-func (s *BoltUserSource) Get(userID string) (*User, error) {
+func (s *BoltUserSource) Get(guildID, userID string) (*User, error) {
 	var user *User
 	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := s.mustGetBucket(tx, bucketUsers)
+		bucket := s.mustGetBucket(tx, bucketUsers).Bucket(userScopeBucketName(guildID))
+		if bucket == nil {
+			// No user has been stored for the guild
+			return nil
+		}
 		v := bucket.Get([]byte(userID))
 		if v == nil {
 			return nil
@@ -117,20 +624,166 @@ func (s *BoltUserSource) Get(userID string) (*User, error) {
 	return user, err
 }
 
+// unindexStoredUser removes the user stored in the bucket with the id,
+// if any, from the battletags and createdby buckets
+func (s *BoltUserSource) unindexStoredUser(tx *bolt.Tx, bucket *bolt.Bucket, userID string) error {
+	v := bucket.Get([]byte(userID))
+	if v == nil {
+		return nil
+	}
+	prev := &User{}
+	if err := json.Unmarshal(v, prev); err != nil {
+		return errors.Wrapf(err, "Could not decode stored user '%s'", userID)
+	}
+	if err := unindexUser(s.mustGetBucket(tx, bucketBattleTags), prev); err != nil {
+		return err
+	}
+	return unindexCreatedBy(s.mustGetBucket(tx, bucketCreatedBy), prev)
+}
+
 func (s *BoltUserSource) Save(user *User) error {
 	if user == nil {
 		return errors.New("User can not be nil")
 	}
 	return s.db.Update(func(tx *bolt.Tx) error {
-		bucket := s.mustGetBucket(tx, bucketUsers)
+		bucket, err := s.mustGetBucket(tx, bucketUsers).CreateBucketIfNotExists(userScopeBucketName(user.GuildID))
+		if err != nil {
+			return err
+		}
 		data, err := json.Marshal(user)
 		if err != nil {
 			return err
 		}
+		// The index is updated in the same transaction, so it is
+		// always in sync with the users
+		if err := s.unindexStoredUser(tx, bucket, user.ID); err != nil {
+			return err
+		}
+		if err := indexUser(s.mustGetBucket(tx, bucketBattleTags), user); err != nil {
+			return err
+		}
+		if err := indexCreatedBy(s.mustGetBucket(tx, bucketCreatedBy), user); err != nil {
+			return err
+		}
 		return bucket.Put([]byte(user.ID), data)
 	})
 }
 
+func (s *BoltUserSource) Delete(guildID, userID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := s.mustGetBucket(tx, bucketUsers).Bucket(userScopeBucketName(guildID))
+		if bucket == nil {
+			return nil
+		}
+		if err := s.unindexStoredUser(tx, bucket, userID); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(userID))
+	})
+}
+
+func (s *BoltUserSource) List(filter UserFilter, after *User, limit int) ([]*User, error) {
+	if limit <= 0 {
+		return nil, errors.Errorf("Limit must be positive, not %d", limit)
+	}
+	var users []*User
+	err := s.db.View(func(tx *bolt.Tx) error {
+		scopes := s.mustGetBucket(tx, bucketUsers)
+		// The ids of the users are read from the scope buckets of the
+		// users, or from those of the createdby bucket when filtering on
+		// CreatedBy, so that only the listed users are decoded
+		ids := scopes
+		if filter.CreatedBy != "" {
+			ids = s.mustGetBucket(tx, bucketCreatedBy).Bucket([]byte(filter.CreatedBy))
+			if ids == nil {
+				return nil
+			}
+		}
+		guildIDs, err := scopeGuildIDs(ids)
+		if err != nil {
+			return err
+		}
+		for _, guildID := range filter.listGuildIDs(guildIDs) {
+			if after != nil && guildID < after.GuildID {
+				continue
+			}
+			scopeName := userScopeBucketName(guildID)
+			scope, scopeIDs := scopes.Bucket(scopeName), ids.Bucket(scopeName)
+			if scope == nil || scopeIDs == nil {
+				// No user has been stored for the guild
+				continue
+			}
+			c := scopeIDs.Cursor()
+			k, _ := c.First()
+			if after != nil && guildID == after.GuildID {
+				// Keys are ordered, so the page continues at the
+				// first id after that of after
+				k, _ = c.Seek([]byte(after.ID))
+				if k != nil && string(k) == after.ID {
+					k, _ = c.Next()
+				}
+			}
+			for ; k != nil; k, _ = c.Next() {
+				if len(users) >= limit {
+					return nil
+				}
+				data := scope.Get(k)
+				if data == nil {
+					return errors.Errorf("CreatedBy index refers to missing user '%s' in '%s'", k, scopeName)
+				}
+				user := &User{}
+				if err := json.Unmarshal(data, user); err != nil {
+					return errors.Wrapf(err, "Could not decode user '%s' in '%s'", k, scopeName)
+				}
+				users = append(users, user)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *BoltUserSource) FindByBattleTag(battleTag string) ([]*User, error) {
+	var users []*User
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := s.mustGetBucket(tx, bucketBattleTags).Bucket([]byte(normalizeBattleTag(battleTag)))
+		if bucket == nil {
+			return nil
+		}
+		scopes := s.mustGetBucket(tx, bucketUsers)
+		return bucket.ForEach(func(k, v []byte) error {
+			parts := strings.SplitN(string(k), ":", 2)
+			if len(parts) != 2 {
+				return errors.Errorf("Invalid BattleTag index key '%s'", k)
+			}
+			scope := scopes.Bucket(userScopeBucketName(parts[0]))
+			if scope == nil {
+				return errors.Errorf("BattleTag index refers to missing guild '%s'", parts[0])
+			}
+			data := scope.Get([]byte(parts[1]))
+			if data == nil {
+				return errors.Errorf("BattleTag index refers to missing user '%s'", k)
+			}
+			user := &User{}
+			if err := json.Unmarshal(data, user); err != nil {
+				return errors.Wrapf(err, "Could not decode user '%s'", k)
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The keys are not in guild order, as the guild ids of the keys
+	// differ in length
+	sortUsers(users)
+	return users, nil
+}
+
 func (s *BoltUserSource) Close() error {
 	return s.db.Close()
 }
@@ -0,0 +1,67 @@
+package owbot_test
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+	"github.com/verath/owbot-bot/owbot"
+	"github.com/verath/owbot-bot/owbot/owbottest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestMemoryUserSource(t *testing.T) {
+	owbottest.TestUserSource(t, func() (owbot.UserSource, error) {
+		return owbot.NewMemoryUserSource(), nil
+	})
+}
+
+func TestBoltUserSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "owbot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	n := 0
+	owbottest.TestUserSource(t, func() (owbot.UserSource, error) {
+		// A new db for each test, so that each test starts empty
+		n++
+		db, err := bolt.Open(filepath.Join(dir, strconv.Itoa(n)+".boltdb"), 0600, nil)
+		if err != nil {
+			return nil, err
+		}
+		return owbot.NewBoltUserSource(logger, db)
+	})
+}
+
+func TestUserRemoveAccount(t *testing.T) {
+	user := &owbot.User{ID: "1"}
+	user.SetAccount(owbot.Account{Label: "main", BattleTag: "main#1234"})
+	user.SetAccount(owbot.Account{Label: "alt", BattleTag: "alt#1234"})
+	user.SetAccount(owbot.Account{Label: "smurf", BattleTag: "smurf#1234"})
+
+	if user.RemoveAccount("missing") {
+		t.Error("RemoveAccount of missing account returned true")
+	}
+	if !user.RemoveAccount("alt") || user.Account("alt") != nil || len(user.Accounts) != 2 {
+		t.Errorf("Accounts after removing alt = %+v, want main and smurf", user.Accounts)
+	}
+	if user.Primary != "main" {
+		t.Errorf("Primary after removing other account = %q, want %q", user.Primary, "main")
+	}
+	// Removing the primary account moves primary to another account
+	if !user.RemoveAccount("main") {
+		t.Fatal("RemoveAccount of main returned false")
+	}
+	if user.Primary != "smurf" {
+		t.Errorf("Primary after removing primary account = %q, want %q", user.Primary, "smurf")
+	}
+	if !user.RemoveAccount("smurf") || len(user.Accounts) != 0 || user.Primary != "" {
+		t.Errorf("User after removing all accounts = %+v, want no accounts and no primary", user)
+	}
+}
@@ -0,0 +1,203 @@
+package owbot
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// verifyChallengeTimeout is how long a user has to complete a
+// verification challenge
+const verifyChallengeTimeout = 30 * time.Minute
+
+var (
+	// ErrNoChallenge is returned when verifying a user that has no
+	// challenge, or whose challenge has expired
+	ErrNoChallenge = errors.New("No verification challenge")
+	// ErrProfileNotUpdated is returned when the stats of the account have
+	// not been fetched since the challenge was issued, so can not show
+	// whether the challenge was completed
+	ErrProfileNotUpdated = errors.New("Profile not updated since the challenge was issued")
+	// ErrChallengeNotCompleted is returned when the profile icon of the
+	// account is not the target icon of the challenge
+	ErrChallengeNotCompleted = errors.New("Profile icon not changed to the target icon")
+	// ErrNoAvatar is returned when the stats provider does not provide
+	// the profile icon of the account
+	ErrNoAvatar = errors.New("Profile icon not available")
+)
+
+// A VerifyIcon is a profile icon that users can be asked to change the
+// profile icon of their account to
+type VerifyIcon struct {
+	// The name of the icon, as shown in the game
+	Name string
+	// The url of the icon, as in the stats of players using the icon
+	Avatar string
+}
+
+// ReadVerifyIcons reads the icons used for verification from a JSON array
+// of VerifyIcons. At least two icons with different urls are required, so
+// that there is an icon other than the current icon of any account.
+func ReadVerifyIcons(r io.Reader) ([]VerifyIcon, error) {
+	var icons []VerifyIcon
+	if err := json.NewDecoder(r).Decode(&icons); err != nil {
+		return nil, errors.Wrap(err, "Could not decode verify icons")
+	}
+	avatars := make(map[string]bool)
+	for i, icon := range icons {
+		if icon.Name == "" || icon.Avatar == "" {
+			return nil, errors.Errorf("Verify icon %d must have a Name and an Avatar", i)
+		}
+		avatars[icon.Avatar] = true
+	}
+	if len(avatars) < 2 {
+		return nil, errors.New("At least two verify icons with different Avatars are required")
+	}
+	return icons, nil
+}
+
+// A VerifyChallenge asks a user to prove that they own an account, by
+// changing the profile icon of the account to a target icon. Only the
+// owner of an account can change its profile icon.
+type VerifyChallenge struct {
+	// The guild of the user, GlobalScope for global users
+	GuildID string
+	// The Discord id (snowflake) of the user
+	UserID string
+	// The account to verify, as it was when the challenge was issued
+	Account Account
+	// The icon the profile icon of the account must be changed to,
+	// other than the icon of the account when the challenge was issued
+	Target VerifyIcon
+	// When the challenge was issued
+	IssuedAt time.Time
+	// When the challenge can no longer be completed
+	ExpiresAt time.Time
+}
+
+// A Verifier issues, and checks the completion of, verification challenges
+// using a StatsProvider. A user has at most one challenge at a time. It is
+// safe for concurrent use.
+type Verifier struct {
+	statsProvider StatsProvider
+	icons         []VerifyIcon
+	timeout       time.Duration
+
+	mu         sync.Mutex
+	rand       *rand.Rand
+	challenges map[userKey]*VerifyChallenge
+}
+
+// NewVerifier returns a Verifier using the stats provider to look up the
+// profile icon of accounts, asking users to change to one of the icons.
+// Challenges expire after the timeout.
+func NewVerifier(statsProvider StatsProvider, icons []VerifyIcon, timeout time.Duration) *Verifier {
+	return &Verifier{
+		statsProvider: statsProvider,
+		icons:         icons,
+		timeout:       timeout,
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		challenges:    make(map[userKey]*VerifyChallenge),
+	}
+}
+
+// getAvatar returns the profile icon of the player, and the time it was
+// fetched. The stats are always fetched, as cached stats could show an
+// icon the account no longer has. All players have quick play stats, but
+// competitive stats are tried if the provider has none.
+func (v *Verifier) getAvatar(ctx context.Context, player owapi.Player) (string, time.Time, error) {
+	stats, err := v.statsProvider.GetFreshStats(ctx, player, owapi.ModeQuickplay)
+	if errors.Cause(err) == owapi.ErrNoStatsForMode {
+		stats, err = v.statsProvider.GetFreshStats(ctx, player, owapi.ModeCompetitive)
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if stats.OverallStats.Avatar == "" {
+		return "", time.Time{}, ErrNoAvatar
+	}
+	return stats.OverallStats.Avatar, stats.FetchedAt, nil
+}
+
+// Challenge issues a new challenge for the account of the user in the
+// guild, replacing any challenge of the user. The target icon is picked at
+// random from the icons other than the current icon of the account.
+func (v *Verifier) Challenge(ctx context.Context, guildID, userID string, account Account) (*VerifyChallenge, error) {
+	avatar, _, err := v.getAvatar(ctx, account.Player())
+	if err != nil {
+		return nil, err
+	}
+	var targets []VerifyIcon
+	for _, icon := range v.icons {
+		if icon.Avatar != avatar {
+			targets = append(targets, icon)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("No verify icon other than the current profile icon")
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	challenge := &VerifyChallenge{
+		GuildID:   guildID,
+		UserID:    userID,
+		Account:   account,
+		Target:    targets[v.rand.Intn(len(targets))],
+		IssuedAt:  now,
+		ExpiresAt: now.Add(v.timeout),
+	}
+	v.challenges[userKey{guildID, userID}] = challenge
+	return challenge, nil
+}
+
+// Pending returns the challenge of the user in the guild, or nil if the
+// user has no challenge or it has expired.
+func (v *Verifier) Pending(guildID, userID string) *VerifyChallenge {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key := userKey{guildID, userID}
+	challenge := v.challenges[key]
+	if challenge != nil && !time.Now().Before(challenge.ExpiresAt) {
+		delete(v.challenges, key)
+		return nil
+	}
+	return challenge
+}
+
+// Verify checks if the user in the guild has completed their challenge,
+// by comparing the current profile icon of the account to the target icon
+// of the challenge. Returns the completed challenge, which is removed.
+// Returns ErrNoChallenge if the user has no challenge, ErrProfileNotUpdated
+// if the stats are older than the challenge, and ErrChallengeNotCompleted
+// if the profile icon is not the target icon.
+func (v *Verifier) Verify(ctx context.Context, guildID, userID string) (*VerifyChallenge, error) {
+	challenge := v.Pending(guildID, userID)
+	if challenge == nil {
+		return nil, ErrNoChallenge
+	}
+	avatar, fetchedAt, err := v.getAvatar(ctx, challenge.Account.Player())
+	if err != nil {
+		return nil, err
+	}
+	if fetchedAt.Before(challenge.IssuedAt) {
+		return nil, ErrProfileNotUpdated
+	}
+	if avatar != challenge.Target.Avatar {
+		return nil, ErrChallengeNotCompleted
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key := userKey{guildID, userID}
+	if v.challenges[key] != challenge {
+		// Replaced by a new challenge while the stats were fetched
+		return nil, ErrNoChallenge
+	}
+	delete(v.challenges, key)
+	return challenge, nil
+}
@@ -0,0 +1,219 @@
+package owbot_test
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/verath/owbot-bot/owbot"
+	"github.com/verath/owbot-bot/owbot/owapi"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStatsProvider is a StatsProvider returning stats with the profile
+// icon it is set up with.
+type fakeStatsProvider struct {
+	mu     sync.Mutex
+	avatar string
+	// The FetchedAt of the returned stats, the current time if zero
+	fetchedAt time.Time
+	// Set if the player has no quick play stats
+	noQuickplay bool
+}
+
+func (p *fakeStatsProvider) setAvatar(avatar string, fetchedAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.avatar = avatar
+	p.fetchedAt = fetchedAt
+}
+
+// GetStats is not used by the Verifier, as cached stats could show an
+// icon the account no longer has.
+func (p *fakeStatsProvider) GetStats(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserStats, error) {
+	return nil, errors.New("GetStats used for verification")
+}
+
+func (p *fakeStatsProvider) GetFreshStats(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserStats, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.noQuickplay && mode == owapi.ModeQuickplay {
+		return nil, owapi.NoStatsError(mode)
+	}
+	stats := &owapi.UserStats{BattleTag: player.BattleTag, Mode: mode, FetchedAt: p.fetchedAt}
+	if stats.FetchedAt.IsZero() {
+		stats.FetchedAt = time.Now()
+	}
+	stats.OverallStats.Avatar = p.avatar
+	return stats, nil
+}
+
+func (p *fakeStatsProvider) GetHeroes(ctx context.Context, player owapi.Player, mode owapi.Mode) (*owapi.UserHeroes, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (p *fakeStatsProvider) GetAchievements(ctx context.Context, player owapi.Player) (*owapi.UserAchievements, error) {
+	return nil, errors.New("not implemented")
+}
+
+var verifyTestAccount = owbot.Account{Label: "main", BattleTag: "player#1234"}
+
+var verifyTestIcons = []owbot.VerifyIcon{
+	{Name: "One", Avatar: "icon-1"},
+	{Name: "Two", Avatar: "icon-2"},
+	{Name: "Three", Avatar: "icon-3"},
+}
+
+func TestVerifier(t *testing.T) {
+	ctx := context.Background()
+	provider := &fakeStatsProvider{avatar: "icon-1"}
+	verifier := owbot.NewVerifier(provider, verifyTestIcons, time.Hour)
+
+	if _, err := verifier.Verify(ctx, "guild", "1"); err != owbot.ErrNoChallenge {
+		t.Errorf("Verify without challenge returned %v, want %v", err, owbot.ErrNoChallenge)
+	}
+	challenge, err := verifier.Challenge(ctx, "guild", "1", verifyTestAccount)
+	if err != nil {
+		t.Fatalf("Challenge returned error: %+v", err)
+	}
+	if challenge.Account != verifyTestAccount {
+		t.Errorf("Challenge account = %+v, want %+v", challenge.Account, verifyTestAccount)
+	}
+	// The target is one of the icons, other than the current icon
+	var other owbot.VerifyIcon
+	switch challenge.Target {
+	case verifyTestIcons[1]:
+		other = verifyTestIcons[2]
+	case verifyTestIcons[2]:
+		other = verifyTestIcons[1]
+	default:
+		t.Fatalf("Challenge target = %+v, want icon-2 or icon-3", challenge.Target)
+	}
+	if pending := verifier.Pending("guild", "1"); pending != challenge {
+		t.Errorf("Pending = %+v, want %+v", pending, challenge)
+	}
+	// Challenges are per guild
+	if pending := verifier.Pending(owbot.GlobalScope, "1"); pending != nil {
+		t.Errorf("Pending in other guild = %+v, want nil", pending)
+	}
+
+	// The profile icon has not been changed
+	if _, err := verifier.Verify(ctx, "guild", "1"); err != owbot.ErrChallengeNotCompleted {
+		t.Errorf("Verify of unchanged icon returned %v, want %v", err, owbot.ErrChallengeNotCompleted)
+	}
+	// Any other icon than the target does not complete the challenge
+	provider.setAvatar(other.Avatar, time.Time{})
+	if _, err := verifier.Verify(ctx, "guild", "1"); err != owbot.ErrChallengeNotCompleted {
+		t.Errorf("Verify of other icon returned %v, want %v", err, owbot.ErrChallengeNotCompleted)
+	}
+	// The icon was changed, but the stats are from before the challenge
+	provider.setAvatar(challenge.Target.Avatar, challenge.IssuedAt.Add(-time.Minute))
+	if _, err := verifier.Verify(ctx, "guild", "1"); err != owbot.ErrProfileNotUpdated {
+		t.Errorf("Verify of stale stats returned %v, want %v", err, owbot.ErrProfileNotUpdated)
+	}
+
+	provider.setAvatar(challenge.Target.Avatar, time.Time{})
+	verified, err := verifier.Verify(ctx, "guild", "1")
+	if err != nil {
+		t.Fatalf("Verify of target icon returned error: %+v", err)
+	}
+	if verified != challenge {
+		t.Errorf("Verify = %+v, want %+v", verified, challenge)
+	}
+	// A challenge can only be completed once
+	if pending := verifier.Pending("guild", "1"); pending != nil {
+		t.Errorf("Pending after Verify = %+v, want nil", pending)
+	}
+	if _, err := verifier.Verify(ctx, "guild", "1"); err != owbot.ErrNoChallenge {
+		t.Errorf("Verify of completed challenge returned %v, want %v", err, owbot.ErrNoChallenge)
+	}
+}
+
+func TestVerifierTargetNotCurrentIcon(t *testing.T) {
+	ctx := context.Background()
+	icons := verifyTestIcons[:2]
+	for _, current := range icons {
+		provider := &fakeStatsProvider{avatar: current.Avatar}
+		verifier := owbot.NewVerifier(provider, icons, time.Hour)
+		// The target is picked at random, but only one icon differs
+		// from the current icon
+		for i := 0; i < 10; i++ {
+			challenge, err := verifier.Challenge(ctx, "guild", "1", verifyTestAccount)
+			if err != nil {
+				t.Fatalf("Challenge returned error: %+v", err)
+			}
+			if challenge.Target.Avatar == current.Avatar {
+				t.Fatalf("Challenge target = %+v, the current icon", challenge.Target)
+			}
+		}
+	}
+}
+
+func TestVerifierExpired(t *testing.T) {
+	ctx := context.Background()
+	provider := &fakeStatsProvider{avatar: "icon-1"}
+	// Challenges expire as soon as they are issued
+	verifier := owbot.NewVerifier(provider, verifyTestIcons, 0)
+	challenge, err := verifier.Challenge(ctx, "guild", "1", verifyTestAccount)
+	if err != nil {
+		t.Fatalf("Challenge returned error: %+v", err)
+	}
+	if pending := verifier.Pending("guild", "1"); pending != nil {
+		t.Errorf("Pending of expired challenge = %+v, want nil", pending)
+	}
+	provider.setAvatar(challenge.Target.Avatar, time.Time{})
+	if _, err := verifier.Verify(ctx, "guild", "1"); err != owbot.ErrNoChallenge {
+		t.Errorf("Verify of expired challenge returned %v, want %v", err, owbot.ErrNoChallenge)
+	}
+}
+
+func TestVerifierCompetitiveOnly(t *testing.T) {
+	ctx := context.Background()
+	provider := &fakeStatsProvider{avatar: "icon-1", noQuickplay: true}
+	verifier := owbot.NewVerifier(provider, verifyTestIcons[:2], time.Hour)
+	challenge, err := verifier.Challenge(ctx, "guild", "1", verifyTestAccount)
+	if err != nil {
+		t.Fatalf("Challenge returned error: %+v", err)
+	}
+	if challenge.Target != verifyTestIcons[1] {
+		t.Errorf("Challenge target = %+v, want %+v", challenge.Target, verifyTestIcons[1])
+	}
+}
+
+func TestVerifierNoAvatar(t *testing.T) {
+	verifier := owbot.NewVerifier(&fakeStatsProvider{}, verifyTestIcons, time.Hour)
+	_, err := verifier.Challenge(context.Background(), "guild", "1", verifyTestAccount)
+	if err != owbot.ErrNoAvatar {
+		t.Errorf("Challenge without avatar returned %v, want %v", err, owbot.ErrNoAvatar)
+	}
+}
+
+func TestReadVerifyIcons(t *testing.T) {
+	icons, err := owbot.ReadVerifyIcons(strings.NewReader(
+		`[{"Name": "One", "Avatar": "icon-1"}, {"Name": "Two", "Avatar": "icon-2"}]`))
+	if err != nil {
+		t.Fatalf("ReadVerifyIcons returned error: %+v", err)
+	}
+	if want := verifyTestIcons[:2]; !reflect.DeepEqual(icons, want) {
+		t.Errorf("ReadVerifyIcons = %+v, want %+v", icons, want)
+	}
+
+	invalid := []struct {
+		name string
+		json string
+	}{
+		{"NotJSON", `not json`},
+		{"NoIcons", `[]`},
+		{"SingleIcon", `[{"Name": "One", "Avatar": "icon-1"}]`},
+		{"SameAvatar", `[{"Name": "One", "Avatar": "icon-1"}, {"Name": "Two", "Avatar": "icon-1"}]`},
+		{"NoName", `[{"Name": "One", "Avatar": "icon-1"}, {"Avatar": "icon-2"}]`},
+		{"NoAvatar", `[{"Name": "One", "Avatar": "icon-1"}, {"Name": "Two"}]`},
+	}
+	for _, test := range invalid {
+		if _, err := owbot.ReadVerifyIcons(strings.NewReader(test.json)); err == nil {
+			t.Errorf("%s: ReadVerifyIcons returned no error", test.name)
+		}
+	}
+}